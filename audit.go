@@ -0,0 +1,463 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The changes an audit entry records
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+// maxRequestIDLength is the longest request ID a client may send. Longer ones are replaced
+const maxRequestIDLength = 128
+
+// auditEntry records one change to the stores. Hash is the SHA-256 of the entry without its hash, and PrevHash
+// is the hash of the entry before it, so that changing or removing an entry breaks the chain after it
+type auditEntry struct {
+	Seq        int64           `json:"seq"`
+	At         string          `json:"at"`
+	ActorID    string          `json:"actorId,omitempty"` // empty for changes the server makes by itself, e.g. expiring transfers
+	RequestID  string          `json:"requestId,omitempty"`
+	Reason     string          `json:"reason,omitempty"` // given by admins for changes outside the usual workflow
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource"` // certificate, user, transfer or webhook
+	ResourceID string          `json:"resourceId"`
+	CertID     string          `json:"certId,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	PrevHash   string          `json:"prevHash"`
+	Hash       string          `json:"hash"`
+}
+
+// hash returns the hash of the entry, which covers every field but Hash
+func (e auditEntry) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditLog is the append-only log of every change to the stores. It is kept in a file of JSON lines,
+// or in memory when it has no file. It is only written to while the store's exclusive lock is held
+type auditLog struct {
+	file     *os.File     // nil for a log kept in memory
+	entries  []auditEntry // the entries of a log kept in memory
+	seq      int64        // sequence number of the last entry
+	lastHash string
+
+	// who is making the changes that are being recorded. Set by store.updateBy
+	actorID   string
+	requestID string
+	reason    string
+
+	// the entries recorded since begin, and where the log ended then, so that they can be written or taken back together
+	pending []auditEntry
+	mark    auditMark
+}
+
+// auditMark is where the log ended when the changes being recorded began
+type auditMark struct {
+	seq      int64
+	lastHash string
+	entries  int   // how many entries a log kept in memory held
+	size     int64 // how long the file of a log kept in a file was
+}
+
+// newMemoryAuditLog returns an empty audit log that is kept in memory
+func newMemoryAuditLog() *auditLog {
+	return &auditLog{}
+}
+
+// openAuditLog opens the audit log kept in path, or creates an empty one if the file doesn't exist yet.
+// New entries are chained to the last entry in the file
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &auditLog{file: f}
+	entries, err := l.load()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read audit log %s: %v", path, err)
+	}
+	if n := len(entries); n > 0 {
+		l.seq, l.lastHash = entries[n-1].Seq, entries[n-1].Hash
+	}
+	return l, nil
+}
+
+// close closes the file of a log kept in a file
+func (l *auditLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// load returns all the entries of the log. The entries of a log kept in a file are read from the file,
+// so that changes made to it behind the server's back show up
+func (l *auditLog) load() ([]auditEntry, error) {
+	if l.file == nil {
+		return append([]auditEntry(nil), l.entries...), nil
+	}
+
+	data, err := readAll(l.file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []auditEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 4*maxBodyBytes) // an entry holds two snapshots of up to a body each
+	for line := 1; scanner.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("line %d is not an audit entry: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// readAll reads the whole file from its start, whatever its offset is
+func readAll(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, info.Size())
+	n, err := f.ReadAt(data, 0)
+	if err != nil && n < len(data) {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// snapshot returns the JSON form of a resource before or after a change, or nil when there is none
+func snapshot(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// record adds an entry for a change to a resource. before is nil for a new resource, and after for a deleted one.
+// The entry is only written to the log by commit
+func (l *auditLog) record(action, resource, id, certID string, before, after interface{}) error {
+	e := auditEntry{
+		Seq: l.seq + 1, At: time.Now().UTC().Format(time.RFC3339Nano), ActorID: l.actorID, RequestID: l.requestID, Reason: l.reason,
+		Action: action, Resource: resource, ResourceID: id, CertID: certID, PrevHash: l.lastHash,
+	}
+	var err error
+	if e.Before, err = snapshot(before); err != nil {
+		return err
+	}
+	if e.After, err = snapshot(after); err != nil {
+		return err
+	}
+	if e.Hash, err = e.hash(); err != nil {
+		return err
+	}
+
+	l.pending = append(l.pending, e)
+	l.seq, l.lastHash = e.Seq, e.Hash
+	return nil
+}
+
+// begin marks where the log ends, before the changes of a request are recorded
+func (l *auditLog) begin() error {
+	l.pending = nil
+	l.mark = auditMark{seq: l.seq, lastHash: l.lastHash, entries: len(l.entries)}
+	if l.file != nil {
+		info, err := l.file.Stat()
+		if err != nil {
+			return err
+		}
+		l.mark.size = info.Size()
+	}
+	return nil
+}
+
+// commit writes the entries recorded since begin to the log, with a single write to the file of a log kept in a file.
+// If they cannot all be written, none are
+func (l *auditLog) commit() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	if l.file == nil {
+		l.entries = append(l.entries, l.pending...)
+		l.pending = nil
+		return nil
+	}
+
+	var lines bytes.Buffer
+	for _, e := range l.pending {
+		line, err := json.Marshal(e)
+		if err != nil {
+			l.rollback()
+			return err
+		}
+		lines.Write(append(line, '\n'))
+	}
+	_, err := l.file.Write(lines.Bytes())
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		l.rollback()
+		return err
+	}
+	l.pending = nil
+	return nil
+}
+
+// rollback takes back the entries recorded since begin, whether or not they were committed
+func (l *auditLog) rollback() {
+	if l.file != nil {
+		l.file.Truncate(l.mark.size)
+	}
+	l.entries = l.entries[:l.mark.entries]
+	l.pending = nil
+	l.seq, l.lastHash = l.mark.seq, l.mark.lastHash
+}
+
+// auditVerification is the outcome of checking the chain of the audit log
+type auditVerification struct {
+	Valid    bool   `json:"valid"`
+	Entries  int    `json:"entries"`            // how many entries were checked
+	BrokenAt int64  `json:"brokenAt,omitempty"` // sequence number of the first entry that doesn't fit the chain
+	Reason   string `json:"reason,omitempty"`
+}
+
+// verify checks that every entry of the log is intact and chained to the one before it, and that no entry is missing
+// from the end of the log
+func (l *auditLog) verify() auditVerification {
+	entries, err := l.load()
+	if err != nil {
+		return auditVerification{Entries: len(entries), BrokenAt: int64(len(entries)) + 1, Reason: err.Error()}
+	}
+
+	prevHash := ""
+	for i, e := range entries {
+		seq := int64(i) + 1
+		hash, err := e.hash()
+		switch {
+		case err != nil:
+			return auditVerification{Entries: i, BrokenAt: seq, Reason: err.Error()}
+		case e.Seq != seq:
+			return auditVerification{Entries: i, BrokenAt: seq, Reason: fmt.Sprintf("entry %d has sequence number %d", seq, e.Seq)}
+		case e.PrevHash != prevHash:
+			return auditVerification{Entries: i, BrokenAt: seq, Reason: fmt.Sprintf("entry %d isn't chained to the entry before it", seq)}
+		case e.Hash != hash:
+			return auditVerification{Entries: i, BrokenAt: seq, Reason: fmt.Sprintf("entry %d was changed after it was written", seq)}
+		}
+		prevHash = e.Hash
+	}
+	// A chain that was rewritten from some entry on, or cut short, is only told apart by the last entry the server wrote
+	switch n := int64(len(entries)); {
+	case n != l.seq:
+		return auditVerification{Entries: len(entries), BrokenAt: n + 1, Reason: fmt.Sprintf("the log ends at entry %d, but %d entries were written", n, l.seq)}
+	case prevHash != l.lastHash:
+		return auditVerification{Entries: len(entries), BrokenAt: n, Reason: fmt.Sprintf("entry %d isn't the last entry that was written", n)}
+	}
+	return auditVerification{Valid: true, Entries: len(entries)}
+}
+
+// auditedCerts records every change to a certificates store in the audit log
+type auditedCerts struct {
+	CertificateStore
+	log *auditLog
+}
+
+// PutCert adds or replaces the certificate, and records the change
+func (a auditedCerts) PutCert(cert certificate) error {
+	before, existed := a.CertificateStore.GetCert(cert.ID)
+	if err := a.CertificateStore.PutCert(cert); err != nil {
+		return err
+	}
+	cert, _ = a.CertificateStore.GetCert(cert.ID) // as the store keeps it, with its times
+	if !existed {
+		return a.log.record(auditCreate, "certificate", cert.ID, cert.ID, nil, cert)
+	}
+	return a.log.record(auditUpdate, "certificate", cert.ID, cert.ID, before, cert)
+}
+
+// DeleteCert removes the certificate, and records the change
+func (a auditedCerts) DeleteCert(id string) error {
+	before, existed := a.CertificateStore.GetCert(id)
+	if err := a.CertificateStore.DeleteCert(id); err != nil || !existed {
+		return err
+	}
+	return a.log.record(auditDelete, "certificate", id, id, before, nil)
+}
+
+// auditedUsers records every change to a users store in the audit log
+type auditedUsers struct {
+	UserStore
+	log *auditLog
+}
+
+// PutUser adds or replaces the user, and records the change
+func (a auditedUsers) PutUser(u user) error {
+	before, existed := a.UserStore.GetUser(u.ID)
+	if err := a.UserStore.PutUser(u); err != nil {
+		return err
+	}
+	if !existed {
+		return a.log.record(auditCreate, "user", u.ID, "", nil, u)
+	}
+	return a.log.record(auditUpdate, "user", u.ID, "", before, u)
+}
+
+// DeleteUser removes the user, and records the change
+func (a auditedUsers) DeleteUser(id string) error {
+	before, existed := a.UserStore.GetUser(id)
+	if err := a.UserStore.DeleteUser(id); err != nil || !existed {
+		return err
+	}
+	return a.log.record(auditDelete, "user", id, "", before, nil)
+}
+
+// auditedTransfers records every change to a transfers store in the audit log
+type auditedTransfers struct {
+	TransferStore
+	log *auditLog
+}
+
+// PutTransfer adds or replaces the transfer, and records the change
+func (a auditedTransfers) PutTransfer(xfer transfer) error {
+	before, existed := a.TransferStore.GetTransfer(xfer.ID)
+	if err := a.TransferStore.PutTransfer(xfer); err != nil {
+		return err
+	}
+	if !existed {
+		return a.log.record(auditCreate, "transfer", xfer.ID, xfer.CertID, nil, xfer)
+	}
+	return a.log.record(auditUpdate, "transfer", xfer.ID, xfer.CertID, before, xfer)
+}
+
+// auditedWebhooks records every change to a webhooks store in the audit log. Webhooks are recorded without their secrets
+type auditedWebhooks struct {
+	WebhookStore
+	log *auditLog
+}
+
+// PutWebhook adds or replaces the webhook, and records the change
+func (a auditedWebhooks) PutWebhook(hook webhook) error {
+	before, existed := a.WebhookStore.GetWebhook(hook.ID)
+	if err := a.WebhookStore.PutWebhook(hook); err != nil {
+		return err
+	}
+	if !existed {
+		return a.log.record(auditCreate, "webhook", hook.ID, "", nil, hook.public())
+	}
+	return a.log.record(auditUpdate, "webhook", hook.ID, "", before.public(), hook.public())
+}
+
+// DeleteWebhook removes the webhook, and records the change
+func (a auditedWebhooks) DeleteWebhook(id string) error {
+	before, existed := a.WebhookStore.GetWebhook(id)
+	if err := a.WebhookStore.DeleteWebhook(id); err != nil || !existed {
+		return err
+	}
+	return a.log.record(auditDelete, "webhook", id, "", before.public(), nil)
+}
+
+// requestIDMiddleware gives every request an ID, which is sent back in the X-Request-ID header and recorded
+// with the changes the request makes. A client may choose the ID by sending the header itself
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > maxRequestIDLength || !printable(id) {
+			id = newID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+// printable checks that s only holds printable ASCII characters
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID of the request
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// listAudit lists the entries of the audit log, oldest first, one page at a time. The certId, userId and since
+// query parameters select the changes to a certificate and its transfers, the changes made by or to a user,
+// and the changes made at or after a time
+func listAudit(w http.ResponseWriter, r *http.Request) {
+	paging, err := parsePageRequest(r, "seq")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	certID, userID := query.Get("certId"), query.Get("userId")
+	var since time.Time
+	if s := query.Get("since"); s != "" {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeError(w, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Since "+s+" is invalid. It must be an RFC 3339 time, e.g. 2019-03-29T10:00:00Z.").with("parameter", "since"))
+			return
+		}
+	}
+
+	if err := authorize(r, actionReadAudit, target{}); err != nil {
+		writeError(w, err)
+		return
+	}
+	entries, err := db.auditTrail()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var list []auditEntry
+	for _, e := range entries {
+		if certID != "" && e.CertID != certID {
+			continue
+		}
+		if userID != "" && e.ActorID != userID && !(e.Resource == "user" && e.ResourceID == userID) {
+			continue
+		}
+		if at, err := time.Parse(time.RFC3339Nano, e.At); !since.IsZero() && (err != nil || at.Before(since)) {
+			continue
+		}
+		list = append(list, e)
+	}
+	json.NewEncoder(w).Encode(paging.paginate(auditPageItems(list))) // Return a JSON with the matching entries
+}
+
+// verifyAudit checks the chain of the audit log. A broken chain is reported in the response, and not as an error
+func verifyAudit(w http.ResponseWriter, r *http.Request) {
+	if err := authorize(r, actionReadAudit, target{}); err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(db.verifyAudit()) // Return a JSON with the outcome of the check
+}
@@ -0,0 +1,227 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listAuditEntries returns the audit entries that match the query
+func listAuditEntries(t *testing.T, query string) []auditEntry {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/audit?"+query, nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var p struct {
+		Items []auditEntry `json:"items"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &p)
+	return p.Items
+}
+
+// TestAuditTrail runs a certificate through its life, and verifies that every change is recorded with its actor,
+// its request and the certificate before and after it
+func TestAuditTrail(t *testing.T) {
+	withTestStore(func() {
+		steps := []struct {
+			method, path, body, userID string
+		}{
+			{"POST", "/certificates/1", `{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`, "10"},
+			{"PUT", "/certificates/1", `{"title":"renamed cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`, "10"},
+			{"POST", "/certificates/1/transfers", `{"to":"test12@test.com"}`, "10"},
+			{"POST", "/certificates/1/transfers/accept", ``, "12"},
+			{"DELETE", "/certificates/1", ``, "12"},
+		}
+		for i, step := range steps {
+			req, _ := http.NewRequest(step.method, "http://localhost:8080"+step.path, bytes.NewBufferString(step.body))
+			req.Header.Set("X-Request-ID", "request-"+string(rune('a'+i)))
+			if code := executeRequest(asUser(req, step.userID)).Code; code != http.StatusOK && code != http.StatusNoContent {
+				t.Fatalf("%s %s: unexpected response code %d", step.method, step.path, code)
+			}
+		}
+
+		expected := []struct {
+			action, resource, actorID, requestID string
+		}{
+			{auditCreate, "certificate", "10", "request-a"},
+			{auditUpdate, "certificate", "10", "request-b"},
+			{auditCreate, "transfer", "10", "request-c"},
+			{auditUpdate, "certificate", "10", "request-c"},
+			{auditUpdate, "transfer", "12", "request-d"},
+			{auditUpdate, "certificate", "12", "request-d"},
+			{auditUpdate, "certificate", "12", "request-e"}, // moved to the trash
+		}
+		entries := listAuditEntries(t, "certId=1")
+		if len(entries) != len(expected) {
+			t.Fatalf("Expected %d entries. Got %d", len(expected), len(entries))
+		}
+		for i, e := range entries {
+			if e.Action != expected[i].action || e.Resource != expected[i].resource || e.ActorID != expected[i].actorID || e.RequestID != expected[i].requestID {
+				t.Errorf("Entry %d: expected %v. Got %s %s by %s in %s", i, expected[i], e.Action, e.Resource, e.ActorID, e.RequestID)
+			}
+		}
+
+		renamed := entries[1]
+		if !bytes.Contains(renamed.Before, []byte(`"title":"first cert"`)) || !bytes.Contains(renamed.After, []byte(`"title":"renamed cert"`)) {
+			t.Errorf("Expected the update to hold the certificate before and after it. Got %s and %s", renamed.Before, renamed.After)
+		}
+		if deleted := entries[len(entries)-1]; bytes.Contains(deleted.Before, []byte("deletedAt")) || !bytes.Contains(deleted.After, []byte("deletedAt")) {
+			t.Errorf("Expected the deletion to move the certificate to the trash. Got %s and %s", deleted.Before, deleted.After)
+		}
+
+		if byUser := listAuditEntries(t, "userId=12"); len(byUser) != 3 {
+			t.Errorf("Expected the 3 changes made by user 12. Got %d", len(byUser))
+		}
+		if later := listAuditEntries(t, "since="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)); len(later) != 0 {
+			t.Errorf("Expected no changes in the future. Got %d", len(later))
+		}
+
+		req, _ := http.NewRequest("GET", "http://localhost:8080/audit?since=yesterday", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusBadRequest, codeInvalidParameter, "Since yesterday is invalid. It must be an RFC 3339 time, e.g. 2019-03-29T10:00:00Z.")
+	})
+}
+
+// TestAuditLeavesOutSecrets verifies that webhooks are recorded without their secrets
+func TestAuditLeavesOutSecrets(t *testing.T) {
+	withWebhooks(func() {
+		hook := subscribe(t, "http://localhost:9/hook", eventCertCreated)
+		for _, e := range listAuditEntries(t, "") {
+			if bytes.Contains(e.After, []byte(hook.Secret)) {
+				t.Errorf("Expected the webhook's secret to be left out. Got %s", e.After)
+			}
+		}
+	})
+}
+
+// TestRequestID verifies that every response carries a request ID, and that the client's own ID is kept if it is sensible
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		sent string
+		kept bool
+	}{
+		{"", false},
+		{"my-request-1", true},
+		{strings.Repeat("x", maxRequestIDLength+1), false},
+		{"line\nbreak", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/certificates", nil)
+		req.Header.Set("X-Request-ID", test.sent)
+		got := executeRequest(req).Header().Get("X-Request-ID")
+		if got == "" || (got == test.sent) != test.kept {
+			t.Errorf("Sent %q: expected it to be kept: %t. Got %q", test.sent, test.kept, got)
+		}
+	}
+}
+
+// verifyChain returns the outcome of checking the chain of the audit log through the API
+func verifyChain(t *testing.T) auditVerification {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/audit/verify", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var v auditVerification
+	json.Unmarshal(response.Body.Bytes(), &v)
+	return v
+}
+
+// TestAuditVerify tampers with an audit log kept in memory, and verifies that the chain is reported broken
+func TestAuditVerify(t *testing.T) {
+	withTestStore(func() {
+		for _, id := range []string{"1", "2", "3"} {
+			req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/"+id, bytes.NewBufferString(`{"title":"cert `+id+`","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+			checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		}
+		if v := verifyChain(t); !v.Valid || v.Entries != 3 {
+			t.Errorf("Expected a valid chain of 3 entries. Got %+v", v)
+		}
+
+		db.audit.entries[1].After = json.RawMessage(`{"id":"2","title":"forged"}`)
+		if v := verifyChain(t); v.Valid || v.BrokenAt != 2 {
+			t.Errorf("Expected the chain to break at entry 2. Got %+v", v)
+		}
+	})
+}
+
+// TestAuditFileLog writes an audit log to a file, tampers with the file, and verifies that every kind of tampering is caught
+func TestAuditFileLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.begin()
+	for _, id := range []string{"1", "2", "3"} {
+		if err := l.record(auditCreate, "certificate", id, id, nil, certificate{ID: id, Title: "cert " + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v := l.verify(); !v.Valid || v.Entries != 3 {
+		t.Fatalf("Expected a valid chain of 3 entries. Got %+v", v)
+	}
+
+	// Entries that are taken back are gone from the file, even once they were committed
+	l.begin()
+	if err := l.record(auditDelete, "certificate", "3", "3", certificate{ID: "3", Title: "cert 3"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.commit(); err != nil {
+		t.Fatal(err)
+	}
+	l.rollback()
+	if v := l.verify(); !v.Valid || v.Entries != 3 {
+		t.Fatalf("Expected a valid chain of 3 entries after a rollback. Got %+v", v)
+	}
+
+	// A reopened log goes on from the last entry
+	l, err = openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.begin()
+	if err := l.record(auditDelete, "certificate", "1", "1", certificate{ID: "1", Title: "cert 1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v := l.verify(); !v.Valid || v.Entries != 4 {
+		t.Fatalf("Expected a valid chain of 4 entries after reopening. Got %+v", v)
+	}
+
+	original, _ := ioutil.ReadFile(path)
+	lines := strings.SplitAfter(strings.TrimSuffix(string(original), "\n"), "\n")
+	tests := []struct {
+		name, content string
+		brokenAt      int64
+	}{
+		{"changed entry", strings.Replace(string(original), "cert 2", "cert X", 1), 2},
+		{"removed entry", lines[0] + lines[2] + lines[3], 2},
+		{"removed last entry", lines[0] + lines[1] + lines[2], 4},
+		{"garbage", lines[0] + "not json\n", 2},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if v := l.verify(); v.Valid || v.BrokenAt != test.brokenAt {
+			t.Errorf("%s: expected the chain to break at entry %d. Got %+v", test.name, test.brokenAt, v)
+		}
+	}
+}
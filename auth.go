@@ -0,0 +1,242 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// authenticator resolves the API key or the bearer token sent with a request to one of the users
+type authenticator struct {
+	enabled bool
+	apiKeys map[string]string // user IDs, keyed by the hex SHA-256 of their API key
+	hmacKey []byte            // secret of HS256 bearer tokens
+	rsaKey  *rsa.PublicKey    // public key of RS256 bearer tokens
+}
+
+// auth authenticates every request served by the router
+var auth *authenticator
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	requestIDContextKey
+)
+
+// newAuthenticator returns an authenticator that accepts no credentials until API keys or token keys are added.
+// A disabled authenticator lets every request through anonymously
+func newAuthenticator(enabled bool) *authenticator {
+	return &authenticator{enabled: enabled, apiKeys: make(map[string]string)}
+}
+
+// hashAPIKey returns the form in which API keys are kept, so that the keys themselves never stay in memory
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// addAPIKey lets requests that carry this key act as the user with this id
+func (a *authenticator) addAPIKey(key, userID string) {
+	a.apiKeys[hashAPIKey(key)] = userID
+}
+
+// loadAPIKeys reads a JSON file that maps API keys to user IDs
+func (a *authenticator) loadAPIKeys(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]string)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("cannot read API keys %s: %v", path, err)
+	}
+	for key, userID := range keys {
+		a.addAPIKey(key, userID)
+	}
+	return nil
+}
+
+// bootstrapAdmin makes sure that the user exists and is an admin, and lets requests that carry this key act as the user.
+// A new deployment starts with no users, and only admins may create them, so without it nobody could be let in
+func (a *authenticator) bootstrapAdmin(key string, admin user) error {
+	admin.Role = string(roleAdmin)
+	if err := validateUser(admin); err != nil {
+		return err
+	}
+	err := db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		u, ok := users.GetUser(admin.ID)
+		if ok && role(u.Role) == roleAdmin {
+			return nil
+		}
+		if !ok {
+			if emailInUse(users, admin.Email, admin.ID) {
+				return fmt.Errorf("cannot create admin %s: e-mail address %s is already in use", admin.ID, admin.Email)
+			}
+			u = admin
+		}
+		u.Role = admin.Role
+		return users.PutUser(u)
+	})
+	if err != nil {
+		return err
+	}
+	a.addAPIKey(key, admin.ID)
+	return nil
+}
+
+// loadRSAKey reads the PEM-encoded public key that RS256 bearer tokens are signed with
+func (a *authenticator) loadRSAKey(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no PEM data in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("cannot read RSA key %s: %v", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%s doesn't hold an RSA public key", path)
+	}
+	a.rsaKey = rsaKey
+	return nil
+}
+
+// tokenClaims are the JWT claims a bearer token must carry. The subject is the user ID
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+// verifyToken checks the signature and the validity period of a JWT, and returns the user ID it was issued to
+func (a *authenticator) verifyToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if data, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(data, &header) != nil {
+		return "", errors.New("malformed header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+
+	// The algorithm is only trusted to pick one of the keys configured on the server, never to skip verification
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && a.hmacKey != nil:
+		mac := hmac.New(sha256.New, a.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return "", errors.New("bad signature")
+		}
+	case header.Alg == "RS256" && a.rsaKey != nil:
+		sum := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(a.rsaKey, crypto.SHA256, sum[:], sig) != nil {
+			return "", errors.New("bad signature")
+		}
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	var claims tokenClaims
+	if data, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(data, &claims) != nil {
+		return "", errors.New("malformed claims")
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return "", errors.New("expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return "", errors.New("not valid yet")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("no subject")
+	}
+	return claims.Subject, nil
+}
+
+// identify returns the ID of the user the request's credentials belong to
+func (a *authenticator) identify(r *http.Request) (string, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		userID, ok := a.apiKeys[hashAPIKey(key)]
+		if !ok {
+			return "", errors.New("API key is invalid.")
+		}
+		return userID, nil
+	}
+
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", errors.New("Missing credentials. Send an X-API-Key header or an Authorization: Bearer header.")
+	}
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", errors.New("Authorization scheme is not supported. Use Bearer.")
+	}
+	userID, err := a.verifyToken(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		return "", errors.New("Bearer token is invalid: " + err.Error() + ".")
+	}
+	return userID, nil
+}
+
+// middleware puts the user that sent the request on the request's context, and rejects requests
+// whose credentials are missing, invalid or belong to a user that doesn't exist
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userID, err := a.identify(r)
+		var u user
+		if err == nil {
+			db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+				var ok bool
+				if u, ok = users.GetUser(userID); !ok {
+					err = errors.New("User ID " + userID + " is invalid.")
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="certificates"`)
+			writeError(w, newAPIError(http.StatusUnauthorized, codeUnauthenticated, err.Error()))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, u)))
+	})
+}
+
+// currentUser returns the authenticated user that sent the request
+func currentUser(r *http.Request) (user, bool) {
+	u, ok := r.Context().Value(userContextKey).(user)
+	return u, ok
+}
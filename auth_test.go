@@ -0,0 +1,233 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testHMACKey = []byte("test-hmac-secret")
+
+// signToken builds a JWT with these claims, signed with HS256 using key, or with RS256 using rsaKey when key is nil
+func signToken(alg string, claims tokenClaims, key []byte, rsaKey *rsa.PrivateKey) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch {
+	case rsaKey != nil:
+		sum := sha256.Sum256([]byte(signed))
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+	case key != nil:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// whoAmI answers with the ID of the authenticated user
+func whoAmI(w http.ResponseWriter, r *http.Request) {
+	if u, ok := currentUser(r); ok {
+		fmt.Fprint(w, u.ID)
+	}
+}
+
+// TestAuthentication sends requests with every kind of credentials and checks which user, if any, they are resolved to
+func TestAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withTestStore(func() {
+		a := newAuthenticator(true)
+		a.addAPIKey("key-11", "11")
+		a.addAPIKey("key-gone", "99")
+		a.hmacKey = testHMACKey
+		a.rsaKey = &rsaKey.PublicKey
+		handler := a.middleware(http.HandlerFunc(whoAmI))
+
+		valid := tokenClaims{Subject: "12", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+		expired := tokenClaims{Subject: "12", ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+		notYet := tokenClaims{Subject: "12", ExpiresAt: time.Now().Add(time.Hour).Unix(), NotBefore: time.Now().Add(time.Minute).Unix()}
+		noExpiry := tokenClaims{Subject: "12"}
+		tampered := signToken("HS256", valid, testHMACKey, nil)
+		tampered = tampered[:len(tampered)-2] + "AA"
+
+		tests := []struct {
+			name, header, value string
+			code                int
+			body                string
+		}{
+			{"API key", "X-API-Key", "key-11", http.StatusOK, "11"},
+			{"HS256 token", "Authorization", "Bearer " + signToken("HS256", valid, testHMACKey, nil), http.StatusOK, "12"},
+			{"RS256 token", "Authorization", "Bearer " + signToken("RS256", valid, nil, rsaKey), http.StatusOK, "12"},
+			{"no credentials", "", "", http.StatusUnauthorized, "Missing credentials. Send an X-API-Key header or an Authorization: Bearer header."},
+			{"unknown API key", "X-API-Key", "key-12", http.StatusUnauthorized, "API key is invalid."},
+			{"API key of a deleted user", "X-API-Key", "key-gone", http.StatusUnauthorized, "User ID 99 is invalid."},
+			{"basic scheme", "Authorization", "Basic dGVzdDp0ZXN0", http.StatusUnauthorized, "Authorization scheme is not supported. Use Bearer."},
+			{"malformed token", "Authorization", "Bearer abc", http.StatusUnauthorized, "Bearer token is invalid: malformed token."},
+			{"wrong HMAC key", "Authorization", "Bearer " + signToken("HS256", valid, []byte("other"), nil), http.StatusUnauthorized, "Bearer token is invalid: bad signature."},
+			{"wrong RSA key", "Authorization", "Bearer " + signToken("RS256", valid, nil, otherRSAKey), http.StatusUnauthorized, "Bearer token is invalid: bad signature."},
+			{"tampered token", "Authorization", "Bearer " + tampered, http.StatusUnauthorized, "Bearer token is invalid: bad signature."},
+			{"unsigned token", "Authorization", "Bearer " + signToken("none", valid, nil, nil), http.StatusUnauthorized, "Bearer token is invalid: unsupported algorithm \"none\"."},
+			{"expired token", "Authorization", "Bearer " + signToken("HS256", expired, testHMACKey, nil), http.StatusUnauthorized, "Bearer token is invalid: expired."},
+			{"token without expiry", "Authorization", "Bearer " + signToken("HS256", noExpiry, testHMACKey, nil), http.StatusUnauthorized, "Bearer token is invalid: expired."},
+			{"token used too early", "Authorization", "Bearer " + signToken("HS256", notYet, testHMACKey, nil), http.StatusUnauthorized, "Bearer token is invalid: not valid yet."},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+			if test.header != "" {
+				req.Header.Set(test.header, test.value)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			t.Log(test.name)
+			if test.code == http.StatusOK {
+				checkResponseCode(t, test.code, recorder.Code)
+				if body := recorder.Body.String(); body != test.body {
+					t.Errorf("\nExpected user %s\nGot\t %s", test.body, body)
+				}
+			} else {
+				checkErrorResponse(t, recorder, test.code, codeUnauthenticated, test.body)
+			}
+		}
+	})
+}
+
+// TestAuthenticationDisabled verifies that a disabled authenticator lets requests through anonymously
+func TestAuthenticationDisabled(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	newAuthenticator(false).middleware(http.HandlerFunc(whoAmI)).ServeHTTP(recorder, req)
+
+	checkResponseCode(t, http.StatusOK, recorder.Code)
+	if body := recorder.Body.String(); body != "" {
+		t.Errorf("Expected an anonymous request. Got user %s", body)
+	}
+}
+
+// TestRoutesRequireAuthentication verifies that the router rejects requests without credentials
+func TestRoutesRequireAuthentication(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/certificates", nil)
+	response := executeRawRequest(req)
+
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	if response.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a WWW-Authenticate header")
+	}
+}
+
+// TestBootstrapAdmin starts from a store with no users, lets the admin in with its key, and verifies that the admin can
+// then create the first user, who is let in with the key given to it
+func TestBootstrapAdmin(t *testing.T) {
+	withTestStore(func() {
+		saved := auth
+		defer func() { auth = saved }()
+		db = newStore(make(certsMap), make(usersMap), make(transfersMap), make(webhooksMap), make(revisionsMap), newMemoryAuditLog())
+		auth = newAuthenticator(true)
+
+		req, _ := http.NewRequest("GET", "http://localhost:8080/users", nil)
+		req.Header.Set("X-API-Key", "admin-key")
+		checkResponseCode(t, http.StatusUnauthorized, executeRawRequest(req).Code)
+
+		admin := user{ID: "admin", Email: "admin@localhost", Name: "Administrator"}
+		if err := auth.bootstrapAdmin("admin-key", admin); err != nil {
+			t.Fatal(err)
+		}
+		// Starting again with the same store keeps the admin as it is
+		if err := auth.bootstrapAdmin("admin-key", admin); err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/users", nil)
+		req.Header.Set("X-API-Key", "admin-key")
+		response := executeRawRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if body := response.Body.String(); !strings.Contains(body, `"role":"admin"`) {
+			t.Errorf("Expected the admin to be listed. Got %s", body)
+		}
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/users/10", bytes.NewBuffer([]byte(`{"email":"test10@test.com","name":"Test User 10"}`)))
+		req.Header.Set("X-API-Key", "admin-key")
+		checkResponseCode(t, http.StatusOK, executeRawRequest(req).Code)
+		auth.addAPIKey("key-10", "10")
+		req, _ = http.NewRequest("GET", "http://localhost:8080/users/10", nil)
+		req.Header.Set("X-API-Key", "key-10")
+		checkResponseCode(t, http.StatusOK, executeRawRequest(req).Code)
+
+		// An existing user is made an admin
+		if err := auth.bootstrapAdmin("key-10", user{ID: "10", Email: "other@localhost"}); err != nil {
+			t.Fatal(err)
+		}
+		db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			if u, _ := users.GetUser("10"); u.Role != "admin" || u.Email != "test10@test.com" {
+				t.Errorf("Expected user 10 to be an admin with its own e-mail address. Got %+v", u)
+			}
+			return nil
+		})
+	})
+}
+
+// TestLoadKeys loads API keys and an RSA public key from files, and verifies that requests signed with them are accepted
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	keyPath := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	keysPath := filepath.Join(dir, "keys.json")
+	ioutil.WriteFile(keysPath, []byte(`{"key-11":"11"}`), 0600)
+
+	a := newAuthenticator(true)
+	if err := a.loadAPIKeys(keysPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.loadRSAKey(keyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if userID, ok := a.apiKeys[hashAPIKey("key-11")]; !ok || userID != "11" {
+		t.Errorf("Expected key-11 to belong to user 11. Got %q", userID)
+	}
+	token := signToken("RS256", tokenClaims{Subject: "12", ExpiresAt: time.Now().Add(time.Hour).Unix()}, nil, rsaKey)
+	if userID, err := a.verifyToken(token); err != nil || userID != "12" {
+		t.Errorf("Expected the token to belong to user 12. Got %q, %v", userID, err)
+	}
+
+	if err := a.loadRSAKey(keysPath); err == nil {
+		t.Errorf("Expected an error when loading an RSA key from a file without PEM data")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"net/http"
+)
+
+// role is a part a user plays, either everywhere (admin, auditor) or towards one certificate or user
+type role string
+
+const (
+	roleAdmin     role = "admin"     // may do anything except accept or reject a transfer meant for someone else
+	roleAuditor   role = "auditor"   // may read everything, but change nothing
+	roleOwner     role = "owner"     // owns the certificate
+	roleRecipient role = "recipient" // is the target of the certificate's pending transfer
+	roleSelf      role = "self"      // is the user being read or changed
+)
+
+// action is an operation that requires a permission
+type action string
+
+const (
+	actionReadCert          action = "read certificate"
+	actionCreateCert        action = "create certificate"
+	actionUpdateCert        action = "update certificate"
+	actionDeleteCert        action = "delete certificate"
+	actionRestoreCert       action = "restore certificate"
+	actionReadCertHistory   action = "read the history of certificate"
+	actionReassignCert      action = "reassign certificate"
+	actionCreateTransfer    action = "transfer certificate"
+	actionAcceptTransfer    action = "accept the transfer of certificate"
+	actionRejectTransfer    action = "reject the transfer of certificate"
+	actionCancelTransfer    action = "cancel the transfer of certificate"
+	actionListCertTransfers action = "list the transfers of certificate"
+	actionListUsers         action = "list users"
+	actionReadUser          action = "read user"
+	actionCreateUser        action = "create user"
+	actionUpdateUser        action = "update user"
+	actionDeleteUser        action = "delete user"
+	actionListUserCerts     action = "list the certificates of user"
+	actionListUserTransfers action = "list the transfers of user"
+	actionChangeRole        action = "change the role of user"
+	actionManageWebhooks    action = "manage webhooks"
+	actionReadWebhooks      action = "read webhooks"
+	actionReadAudit         action = "read the audit log"
+	actionExport            action = "export data"
+	actionImport            action = "import data"
+)
+
+// permissions lists the roles that are allowed to perform each action
+var permissions = map[action][]role{
+	actionReadCert:          {roleOwner, roleRecipient, roleAdmin, roleAuditor},
+	actionCreateCert:        {roleOwner, roleAdmin},
+	actionUpdateCert:        {roleOwner, roleAdmin},
+	actionDeleteCert:        {roleOwner, roleAdmin},
+	actionRestoreCert:       {roleOwner, roleAdmin},
+	actionReadCertHistory:   {roleOwner, roleAdmin, roleAuditor},
+	actionReassignCert:      {roleAdmin},
+	actionCreateTransfer:    {roleOwner, roleAdmin},
+	actionAcceptTransfer:    {roleRecipient},
+	actionRejectTransfer:    {roleRecipient},
+	actionCancelTransfer:    {roleOwner, roleAdmin},
+	actionListCertTransfers: {roleOwner, roleAdmin, roleAuditor},
+	actionListUsers:         {roleAdmin, roleAuditor},
+	actionReadUser:          {roleSelf, roleAdmin, roleAuditor},
+	actionCreateUser:        {roleAdmin},
+	actionUpdateUser:        {roleSelf, roleAdmin},
+	actionDeleteUser:        {roleSelf, roleAdmin},
+	actionListUserCerts:     {roleSelf, roleAdmin, roleAuditor},
+	actionListUserTransfers: {roleSelf, roleAdmin, roleAuditor},
+	actionChangeRole:        {roleAdmin},
+	actionManageWebhooks:    {roleAdmin},
+	actionReadWebhooks:      {roleAdmin, roleAuditor},
+	actionReadAudit:         {roleAdmin, roleAuditor},
+	actionExport:            {roleAdmin, roleAuditor},
+	actionImport:            {roleAdmin},
+}
+
+// target is the certificate or the user an action is performed on. Either field may be empty
+type target struct {
+	cert   *certificate
+	userID string
+}
+
+// rolesOf returns all the roles u plays towards the target
+func rolesOf(u user, t target) []role {
+	var roles []role
+	if u.Role != "" {
+		roles = append(roles, role(u.Role))
+	}
+	if t.cert != nil {
+		if t.cert.OwnerID == u.ID {
+			roles = append(roles, roleOwner)
+		}
+		if t.cert.Transfer.pending() && t.cert.Transfer.To == u.Email {
+			roles = append(roles, roleRecipient)
+		}
+	}
+	if t.userID != "" && t.userID == u.ID {
+		roles = append(roles, roleSelf)
+	}
+	return roles
+}
+
+// can checks whether u plays one of the roles that are allowed to perform the action on the target
+func can(u user, a action, t target) bool {
+	for _, allowed := range permissions[a] {
+		for _, r := range rolesOf(u, t) {
+			if r == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorize checks whether the user that sent the request may perform the action on the target.
+// When authentication is turned off there is no user on the request, and everything is allowed
+func authorize(r *http.Request, a action, t target) error {
+	u, ok := currentUser(r)
+	if !ok || can(u, a, t) {
+		return nil
+	}
+
+	name := ""
+	switch {
+	case t.cert != nil:
+		name = " " + t.cert.ID
+	case t.userID != "":
+		name = " " + t.userID
+	}
+	return newAPIError(http.StatusForbidden, codeForbidden, "User "+u.ID+" is not allowed to "+string(a)+name+".").with("userId", u.ID).with("action", string(a))
+}
+
+// mayRead checks whether the user that sent the request may read the certificate. It is used to filter listings
+func mayRead(r *http.Request, cert certificate) bool {
+	return authorize(r, actionReadCert, target{cert: &cert}) == nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// The users the authorization tests act as, one for each role
+var authzRoles = []struct {
+	name, userID string
+}{
+	{"admin", "1"},
+	{"auditor", "2"},
+	{"owner", "10"},
+	{"recipient", "12"},
+	{"other", "11"},
+}
+
+// withAuthzStore runs fn on a fresh store holding the test users and an auditor, user 2. Certificates 1 and 2 are owned
+// by user 10, and certificate 1 is waiting to be transferred to user 12
+func withAuthzStore(fn func()) {
+	withTestStore(func() {
+		db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			users.PutUser(user{"2", "auditor@test.com", "Test Auditor", "auditor"})
+			certificates.PutCert(certificate{ID: "1", Title: "first cert", OwnerID: "10", Year: 2019, Transfer: transfer{To: "test12@test.com", Status: "Requested"}})
+			certificates.PutCert(certificate{ID: "2", Title: "second cert", OwnerID: "10", Year: 2019})
+			return nil
+		})
+		auth.addAPIKey(testAPIKey("2"), "2")
+		defer delete(auth.apiKeys, hashAPIKey(testAPIKey("2")))
+
+		fn()
+	})
+}
+
+// TestAuthorizationMatrix sends every request as every role, and checks which of them are allowed
+func TestAuthorizationMatrix(t *testing.T) {
+	const (
+		ok        = http.StatusOK
+		created   = http.StatusCreated
+		noContent = http.StatusNoContent
+		denied    = http.StatusForbidden
+	)
+
+	tests := []struct {
+		method, path, body string
+		expected           []int // admin, auditor, owner, recipient, other
+	}{
+		{"GET", "/certificates/1", ``, []int{ok, ok, ok, ok, denied}},
+		{"POST", "/certificates/5", `{"id":"5","title":"new cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`, []int{ok, denied, ok, denied, denied}},
+		{"PUT", "/certificates/2", `{"id":"2","title":"updated cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`, []int{ok, denied, ok, denied, denied}},
+		{"DELETE", "/certificates/2", ``, []int{noContent, denied, noContent, denied, denied}},
+		{"POST", "/certificates/2/owner", `{"ownerId":"11","reason":"support ticket 42"}`, []int{ok, denied, denied, denied, denied}},
+		{"POST", "/certificates/2/transfers", `{"to":"test11@test.com","status":"Requested"}`, []int{ok, denied, ok, denied, denied}},
+		{"PUT", "/certificates/1/transfers", ``, []int{denied, denied, denied, ok, denied}},
+		{"POST", "/certificates/1/transfers/reject", ``, []int{denied, denied, denied, ok, denied}},
+		{"POST", "/certificates/1/transfers/cancel", ``, []int{ok, denied, ok, denied, denied}},
+		{"GET", "/users/10/certificates", ``, []int{ok, ok, ok, denied, denied}},
+		{"GET", "/certificates/1/transfers", ``, []int{ok, ok, ok, denied, denied}},
+		{"GET", "/users/10/transfers", ``, []int{ok, ok, ok, denied, denied}},
+		{"GET", "/users/12/transfers/pending", ``, []int{ok, ok, denied, ok, denied}},
+		{"GET", "/users", ``, []int{ok, ok, denied, denied, denied}},
+		{"GET", "/users/10", ``, []int{ok, ok, ok, denied, denied}},
+		{"POST", "/users/20", `{"email":"test20@test.com","name":"Test User 20"}`, []int{ok, denied, denied, denied, denied}},
+		{"PUT", "/users/10", `{"email":"test10@test.com","name":"Renamed User 10"}`, []int{ok, denied, ok, denied, denied}},
+		{"PUT", "/users/10", `{"email":"test10@test.com","name":"Test User 10","role":"admin"}`, []int{ok, denied, denied, denied, denied}},
+		{"DELETE", "/users/11", ``, []int{noContent, denied, denied, denied, noContent}},
+		{"POST", "/webhooks", `{"url":"http://localhost:9/hook","events":["certificate.created"]}`, []int{created, denied, denied, denied, denied}},
+		{"GET", "/webhooks", ``, []int{ok, ok, denied, denied, denied}},
+		{"GET", "/audit", ``, []int{ok, ok, denied, denied, denied}},
+		{"GET", "/audit/verify", ``, []int{ok, ok, denied, denied, denied}},
+		{"GET", "/export", ``, []int{ok, ok, denied, denied, denied}},
+		{"POST", "/import?format=ndjson", `{"type":"user","user":{"id":"20","email":"test20@test.com","name":"Test User 20"}}`, []int{ok, denied, denied, denied, denied}},
+	}
+
+	for _, test := range tests {
+		for i, r := range authzRoles {
+			withAuthzStore(func() {
+				req, _ := http.NewRequest(test.method, "http://localhost:8080"+test.path, bytes.NewBufferString(test.body))
+				response := executeRequest(asUser(req, r.userID))
+				if response.Code != test.expected[i] {
+					t.Errorf("%s %s as %s: expected response code %d. Got %d %s", test.method, test.path, r.name, test.expected[i], response.Code, response.Body.String())
+				}
+			})
+		}
+	}
+}
+
+// TestAuthorizationForbiddenMessage checks the error returned when a user isn't allowed to perform a request
+func TestAuthorizationForbiddenMessage(t *testing.T) {
+	withAuthzStore(func() {
+		req, _ := http.NewRequest("PUT", "http://localhost:8080/certificates/1/transfers", nil)
+		response := executeRequest(asUser(req, "11"))
+
+		checkErrorResponse(t, response, http.StatusForbidden, codeForbidden, "User 11 is not allowed to accept the transfer of certificate 1.")
+	})
+}
+
+// TestAuthorizationFiltersListing verifies that the certificates listing only holds the certificates each role may read
+func TestAuthorizationFiltersListing(t *testing.T) {
+	expected := map[string][]string{
+		"admin":     {"1", "2"},
+		"auditor":   {"1", "2"},
+		"owner":     {"1", "2"},
+		"recipient": {"1"},
+		"other":     nil,
+	}
+
+	withAuthzStore(func() {
+		for _, r := range authzRoles {
+			req, _ := http.NewRequest("GET", "http://localhost:8080/certificates", nil)
+			response := executeRequest(asUser(req, r.userID))
+
+			var p pageOfCerts
+			json.Unmarshal(response.Body.Bytes(), &p)
+			var ids []string
+			for _, cert := range p.Items {
+				ids = append(ids, cert.ID)
+			}
+			if !reflect.DeepEqual(ids, expected[r.name]) {
+				t.Errorf("%s: expected certificates %v. Got %v", r.name, expected[r.name], ids)
+			}
+		}
+	})
+}
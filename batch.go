@@ -0,0 +1,154 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The modes a batch can be run in
+const (
+	batchAtomic     = "atomic"     // every operation is made, or none is
+	batchBestEffort = "bestEffort" // every operation that can be made is made, whatever happens to the others
+)
+
+// The operations a batch can hold
+const (
+	batchCreate   = "create"
+	batchUpdate   = "update"
+	batchDelete   = "delete"
+	batchTransfer = "transfer"
+)
+
+// batchRequest is the body of a request to change many certificates at once
+type batchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchOperation is one operation of a batch. It works like the request to the certificate's own route would
+type batchOperation struct {
+	Op          string       `json:"op"`
+	ID          string       `json:"id"`
+	Certificate *certificate `json:"certificate,omitempty"` // sent with create and update
+	IfMatch     string       `json:"ifMatch,omitempty"`     // the If-Match header of the operation
+	Force       bool         `json:"force,omitempty"`       // sent with delete
+	To          string       `json:"to,omitempty"`          // sent with transfer
+}
+
+// batchResult is the outcome of one operation of a batch
+type batchResult struct {
+	Index       int          `json:"index"`
+	Op          string       `json:"op"`
+	ID          string       `json:"id,omitempty"`
+	Status      int          `json:"status"`
+	ETag        string       `json:"etag,omitempty"`
+	Certificate *certificate `json:"certificate,omitempty"`
+	Error       *apiError    `json:"error,omitempty"`
+}
+
+// batchResponse is the outcome of a batch, with a result for every operation in the order they were sent
+type batchResponse struct {
+	Mode      string        `json:"mode"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []batchResult `json:"results"`
+}
+
+// withIfMatch returns a copy of the request whose If-Match header is the one sent with an operation of a batch
+func withIfMatch(r *http.Request, ifMatch string) *http.Request {
+	op := r.WithContext(r.Context())
+	op.Header = r.Header.Clone()
+	op.Header.Del("If-Match")
+	if ifMatch != "" {
+		op.Header.Set("If-Match", ifMatch)
+	}
+	return op
+}
+
+// runBatchOperation makes one operation of a batch on behalf of the user that sent the batch, and returns the change
+// and the status the operation's own route would have answered with
+func runBatchOperation(r *http.Request, certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore, i int, op batchOperation) (certChange, int, error) {
+	if err := validateBatchOperation(i, op); err != nil {
+		return certChange{}, 0, err
+	}
+	r = withIfMatch(r, op.IfMatch)
+	switch op.Op {
+	case batchCreate, batchUpdate:
+		cert := *op.Certificate
+		if err := prepareCert(&cert, op.ID); err != nil {
+			return certChange{}, 0, err
+		}
+		if op.Op == batchCreate {
+			change, err := addCert(r, certificates, users, hooks, revisions, cert)
+			return change, http.StatusCreated, err
+		}
+		change, err := replaceCert(r, certificates, hooks, revisions, cert)
+		return change, http.StatusOK, err
+	case batchDelete:
+		change, err := trashCert(r, certificates, users, transfers, hooks, revisions, op.ID, op.Force)
+		return change, http.StatusNoContent, err
+	default:
+		xfer := transfer{To: op.To, Status: transferRequested}
+		change, err := requestCertTransfer(r, certificates, users, transfers, hooks, revisions, op.ID, xfer)
+		return change, http.StatusOK, err
+	}
+}
+
+// batchFailed reports the operation that kept an atomic batch from being made
+func batchFailed(i int, op batchOperation, err error) error {
+	e := toAPIError(err)
+	name := strings.TrimSpace(op.Op + " " + op.ID)
+	return newAPIError(e.status, codeBatchFailed, fmt.Sprintf("Operation %d (%s) failed, so nothing was changed: %s", i, name, e.Message)).with("index", i).with("error", e)
+}
+
+// batchCerts creates, updates, deletes and transfers many certificates in one request. The operations of an atomic
+// batch are made together, and are all taken back as soon as one fails; a best-effort batch makes every operation
+// it can. Either way, the batch holds the lock of the stores until it is done
+func batchCerts(w http.ResponseWriter, r *http.Request) {
+	req := batchRequest{Mode: batchAtomic}
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateBatch(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := batchResponse{Mode: req.Mode, Results: make([]batchResult, len(req.Operations))}
+	var changes []certChange
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		for i, op := range req.Operations {
+			result := batchResult{Index: i, Op: op.Op, ID: op.ID}
+			change, status, err := runBatchOperation(r, certificates, users, transfers, hooks, revisions, i, op)
+			switch {
+			case err != nil && req.Mode == batchAtomic:
+				return batchFailed(i, op, err)
+			case err != nil:
+				result.Error = toAPIError(err)
+				result.Status = result.Error.status
+				response.Failed++
+			default:
+				result.ID, result.Status, result.ETag = change.cert.ID, status, change.etag
+				if status != http.StatusNoContent {
+					result.Certificate = &change.cert
+				}
+				changes = append(changes, change)
+				response.Succeeded++
+			}
+			response.Results[i] = result
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, change := range changes {
+		change.send()
+	}
+	json.NewEncoder(w).Encode(response) // Return a JSON with the result of every operation
+}
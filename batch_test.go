@@ -0,0 +1,211 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sendBatch sends a batch as user 10, and returns the response
+func sendBatch(body string) (int, batchResponse, apiError) {
+	req, _ := http.NewRequest("POST", "http://localhost:8080/certificates:batch", bytes.NewBufferString(body))
+	response := executeRequest(asUser(req, "10"))
+	var result batchResponse
+	var e apiError
+	json.Unmarshal(response.Body.Bytes(), &result)
+	json.Unmarshal(response.Body.Bytes(), &e)
+	return response.Code, result, e
+}
+
+// certExists checks whether certificate id can be read
+func certExists(id string) bool {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/certificates/"+id, nil)
+	return executeRequest(req).Code == http.StatusOK
+}
+
+// TestBatchAtomic makes a batch that creates, changes and transfers certificates, including a certificate it
+// changes more than once, and verifies the result of every operation
+func TestBatchAtomic(t *testing.T) {
+	withTestStore(func() {
+		code, result, _ := sendBatch(`{"operations":[
+			{"op":"create","id":"1","certificate":{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10"}},
+			{"op":"create","certificate":{"id":"2","title":"second cert","issuedAt":"29 MAR 2019","ownerId":"10"}},
+			{"op":"update","id":"1","ifMatch":"\"1\"","certificate":{"title":"renamed cert","issuedAt":"2019-03-29","ownerId":"10"}},
+			{"op":"transfer","id":"2","to":"test12@test.com"},
+			{"op":"delete","id":"1","ifMatch":"\"2\""}
+		]}`)
+		checkResponseCode(t, http.StatusOK, code)
+
+		expected := []struct {
+			id, etag string
+			status   int
+		}{
+			{"1", `"1"`, http.StatusCreated},
+			{"2", `"1"`, http.StatusCreated},
+			{"1", `"2"`, http.StatusOK},
+			{"2", `"2"`, http.StatusOK},
+			{"1", "", http.StatusNoContent},
+		}
+		if result.Mode != batchAtomic || result.Succeeded != len(expected) || result.Failed != 0 || len(result.Results) != len(expected) {
+			t.Fatalf("Expected %d operations to succeed. Got %+v", len(expected), result)
+		}
+		for i, r := range result.Results {
+			if r.Index != i || r.ID != expected[i].id || r.ETag != expected[i].etag || r.Status != expected[i].status || r.Error != nil {
+				t.Errorf("Operation %d: expected %+v. Got %+v", i, expected[i], r)
+			}
+		}
+		if cert := result.Results[3].Certificate; cert == nil || cert.Transfer.Status != transferRequested || cert.IssuedAt != "2019-03-29" {
+			t.Errorf("Expected certificate 2 to be transferred. Got %+v", cert)
+		}
+		if certExists("1") || !certExists("2") {
+			t.Errorf("Expected certificate 1 in the trash and certificate 2 to be kept")
+		}
+	})
+}
+
+// TestBatchAtomicFailure verifies that an atomic batch with an operation that fails changes nothing
+func TestBatchAtomicFailure(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/3", bytes.NewBuffer(cert3))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+		code, _, e := sendBatch(`{"mode":"atomic","operations":[
+			{"op":"create","id":"1","certificate":{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10"}},
+			{"op":"transfer","id":"1","to":"test12@test.com"},
+			{"op":"transfer","id":"3","to":"test12@test.com"}
+		]}`)
+		checkResponseCode(t, http.StatusForbidden, code)
+		if e.Code != codeBatchFailed || e.Message != "Operation 2 (transfer 3) failed, so nothing was changed: User 10 is not allowed to transfer certificate 3." {
+			t.Errorf("Expected the batch to fail on operation 2. Got %+v", e)
+		}
+		if failed, _ := e.Details["error"].(map[string]interface{}); failed["code"] != codeForbidden || e.Details["index"] != 2.0 {
+			t.Errorf("Expected the error of operation 2 in the details. Got %+v", e.Details)
+		}
+		if certExists("1") {
+			t.Errorf("Expected certificate 1 not to be created")
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/3/versions", nil)
+		var p struct {
+			Items []revision `json:"items"`
+		}
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &p)
+		if len(p.Items) != 1 {
+			t.Errorf("Expected certificate 3 to be left as it was. Got %d versions", len(p.Items))
+		}
+	})
+}
+
+// TestBatchAtomicSaveFailure makes the store fail to save an atomic batch, and verifies that the batch fails
+// and that none of its operations is kept
+func TestBatchAtomicSaveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certificates.db")
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range newTestUsers() {
+		s.PutUser(u)
+	}
+	s.Close()
+	s = openReadOnlyFileStore(t, path)
+	defer s.Close()
+
+	saved := db
+	defer func() { db = saved }()
+	db = newStore(s, s, s, s, s, newMemoryAuditLog())
+
+	code, _, e := sendBatch(`{"mode":"atomic","operations":[
+		{"op":"create","id":"1","certificate":{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10"}},
+		{"op":"create","id":"2","certificate":{"title":"second cert","issuedAt":"2019-03-29","ownerId":"10"}}
+	]}`)
+	checkResponseCode(t, http.StatusInternalServerError, code)
+	if e.Code != codeInternal {
+		t.Errorf("Expected an internal error. Got %+v", e)
+	}
+	if certExists("1") || certExists("2") {
+		t.Errorf("Expected no certificate to be created")
+	}
+	if entries, _ := db.auditTrail(); len(entries) != 0 {
+		t.Errorf("Expected nothing in the audit log. Got %d entries", len(entries))
+	}
+}
+
+// TestBatchBestEffort verifies that a best-effort batch makes the operations it can, and reports the others
+func TestBatchBestEffort(t *testing.T) {
+	withTestStore(func() {
+		code, result, _ := sendBatch(`{"mode":"bestEffort","operations":[
+			{"op":"create","id":"1","certificate":{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10"}},
+			{"op":"update","id":"2","certificate":{"title":"second cert","issuedAt":"2019-03-29","ownerId":"10"}},
+			{"op":"create","id":"1","certificate":{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10"}},
+			{"op":"rename","id":"1"},
+			{"op":"create","id":"4","certificate":{"id":"5","title":"fourth cert","issuedAt":"2019-03-29","ownerId":"10"}},
+			{"op":"transfer","id":"1","to":"test12@test.com","ifMatch":"\"7\""}
+		]}`)
+		checkResponseCode(t, http.StatusOK, code)
+
+		expected := []struct {
+			status int
+			code   string
+		}{
+			{http.StatusCreated, ""},
+			{http.StatusNotFound, codeCertNotFound},
+			{http.StatusConflict, codeCertExists},
+			{http.StatusUnprocessableEntity, codeValidationFailed},
+			{http.StatusUnprocessableEntity, codeCertIDMismatch},
+			{http.StatusPreconditionFailed, codePreconditionFailed},
+		}
+		if result.Succeeded != 1 || result.Failed != len(expected)-1 {
+			t.Errorf("Expected 1 operation to succeed. Got %+v", result)
+		}
+		for i, r := range result.Results {
+			got := ""
+			if r.Error != nil {
+				got = r.Error.Code
+			}
+			if r.Status != expected[i].status || got != expected[i].code {
+				t.Errorf("Operation %d: expected %d %s. Got %d %s", i, expected[i].status, expected[i].code, r.Status, got)
+			}
+		}
+		if !certExists("1") {
+			t.Errorf("Expected certificate 1 to be created")
+		}
+	})
+}
+
+// TestBatchInvalid verifies that batches that cannot be run at all are rejected
+func TestBatchInvalid(t *testing.T) {
+	withTestStore(func() {
+		tests := []struct {
+			body, field string
+		}{
+			{`{"operations":[]}`, "operations"},
+			{`{"mode":"sometimes","operations":[{"op":"delete","id":"1"}]}`, "mode"},
+		}
+		for _, test := range tests {
+			code, _, e := sendBatch(test.body)
+			checkResponseCode(t, http.StatusUnprocessableEntity, code)
+			if fields, _ := e.Details["fields"].(map[string]interface{}); e.Message != "Batch is invalid." || fields[test.field] == nil {
+				t.Errorf("%s: expected a problem with %s. Got %+v", test.body, test.field, e)
+			}
+		}
+
+		code, _, e := sendBatch(`{"operations":[{"op":"delete","id":"1","to":"test12@test.com","certificate":{}}]}`)
+		checkResponseCode(t, http.StatusUnprocessableEntity, code)
+		failed, _ := e.Details["error"].(map[string]interface{})
+		details, _ := failed["details"].(map[string]interface{})
+		if fields, _ := details["fields"].(map[string]interface{}); len(fields) != 2 || fields["to"] == nil || fields["certificate"] == nil {
+			t.Errorf("Expected problems with to and certificate. Got %+v", e)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// claimRequest is the optional body of a request to accept a transfer
+type claimRequest struct {
+	ClaimToken string `json:"claimToken"`
+}
+
+// newClaimToken returns a random token that lets whoever holds it claim a transfer to an address nobody has registered yet
+func newClaimToken() string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand never fails on the supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// hashClaimToken returns the form in which claim tokens are kept. Only the client that requested the transfer ever sees
+// the token itself
+func hashClaimToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// invite turns a new transfer to an address nobody has registered into an invitation, and returns its claim token
+func invite(xfer *transfer) string {
+	token := newClaimToken()
+	xfer.ClaimTokenHash = hashClaimToken(token)
+	return token
+}
+
+// claim completes the pending transfer of the certificate in favour of the user, who becomes its owner
+func claim(certificates CertificateStore, transfers TransferStore, cert certificate, claimant user, now time.Time) (transfer, error) {
+	xfer, err := resolveTransfer(&cert, transferAccepted, now)
+	if err != nil {
+		return xfer, err
+	}
+	xfer.ToUserID = claimant.ID
+	cert.OwnerID = claimant.ID
+	if err := transfers.PutTransfer(xfer); err != nil {
+		return xfer, err
+	}
+	return xfer, certificates.PutCert(cert)
+}
+
+// claimInvitations gives a newly registered user the certificates that were sent to the user's e-mail address
+// before the user existed, and returns the transfers it completed
+func claimInvitations(certificates CertificateStore, transfers TransferStore, u user, now time.Time) ([]transfer, error) {
+	var claimed []transfer
+	for _, cert := range pendingTransfersTo(certificates, u.Email) {
+		if cert.Transfer.ClaimTokenHash == "" {
+			continue
+		}
+		xfer, err := claim(certificates, transfers, cert, u, now)
+		if err != nil {
+			return claimed, err
+		}
+		claimed = append(claimed, xfer)
+	}
+	return claimed, nil
+}
+
+// claimTransfer lets the user that sent the request accept the pending transfer of a certificate by presenting its claim token.
+// The token stands in for the recipient's e-mail address, so the user doesn't need to be the recipient
+func claimTransfer(w http.ResponseWriter, r *http.Request, token string) {
+	certID := mux.Vars(r)["id"]
+
+	claimant, ok := currentUser(r)
+	if !ok {
+		writeError(w, newAPIError(http.StatusUnauthorized, codeUnauthenticated, "A transfer can only be claimed by an authenticated user."))
+		return
+	}
+
+	hash := hashClaimToken(token)
+	var xfer transfer
+	var messages []message
+	var deliveries []*delivery
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		cert, ok := liveCert(certificates, certID)
+		if !ok {
+			return newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist. Cannot claim transfer.").with("certId", certID)
+		}
+
+		// Tokens are compared by their hashes, so the comparison leaks nothing about the token itself
+		if cert.Transfer.ClaimTokenHash != hash {
+			for _, old := range transfers.ListTransfers() {
+				if old.CertID != certID || old.ClaimTokenHash != hash {
+					continue
+				}
+				if old.Status == transferExpired {
+					return newAPIError(http.StatusConflict, codeTransferExpired, "The transfer of certificate "+certID+" expired at "+old.ExpiresAt+".").with("certId", certID).with("expiresAt", old.ExpiresAt)
+				}
+				return newAPIError(http.StatusConflict, codeClaimTokenUsed, "Claim token has already been used. The transfer of certificate "+certID+" is "+old.Status+".").with("certId", certID).with("status", old.Status)
+			}
+			return newAPIError(http.StatusForbidden, codeClaimTokenInvalid, "Claim token is invalid for certificate "+certID+".").with("certId", certID)
+		}
+		if err := checkIfMatch(r, revisions, certID); err != nil {
+			return err
+		}
+
+		var err error
+		if xfer, err = claim(certificates, transfers, cert, claimant, time.Now()); err != nil {
+			return err
+		}
+		messages = transferMessages(users, cert, xfer)
+		deliveries = transferDeliveries(hooks, xfer)
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		notifications.send(messages...)
+		webhookDeliveries.send(deliveries...)
+		json.NewEncoder(w).Encode(xfer) // Return a JSON with the transfer as it ended
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withInvitation runs fn on a fresh store where certificate 1, owned by user 10, has been sent to new@test.com,
+// an address nobody has registered. fn receives the claim token of the invitation
+func withInvitation(t *testing.T, fn func(token string)) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		executeRequest(req)
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBufferString(`{"to":"new@test.com"}`))
+		response := executeRequest(asUser(req, "10"))
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var cert certificate
+		json.Unmarshal(response.Body.Bytes(), &cert)
+		if cert.Transfer.Status != transferRequested || cert.Transfer.ToUserID != "" || cert.Transfer.ClaimToken == "" {
+			t.Fatalf("Expected an invitation with a claim token. Got %v", cert.Transfer)
+		}
+
+		fn(cert.Transfer.ClaimToken)
+	})
+}
+
+// claimRequestFor returns a request to accept the transfer of certificate 1 with this claim token, sent by this user
+func claimRequestFor(token, userID string) *http.Request {
+	req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers/accept", bytes.NewBufferString(`{"claimToken":"`+token+`"}`))
+	return asUser(req, userID)
+}
+
+// checkOwner verifies that certificate 1 belongs to this user
+func checkOwner(t *testing.T, ownerID string) {
+	db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		if cert, _ := certificates.GetCert("1"); cert.OwnerID != ownerID {
+			t.Errorf("Expected certificate 1 to belong to user %s. Got %s", ownerID, cert.OwnerID)
+		}
+		return nil
+	})
+}
+
+// TestClaimTokenIsNeverShown verifies that the claim token is only sent back when the transfer is requested
+func TestClaimTokenIsNeverShown(t *testing.T) {
+	withInvitation(t, func(token string) {
+		for _, path := range []string{"/certificates/1", "/certificates", "/certificates/1/transfers"} {
+			req, _ := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+			if body := executeRequest(req).Body.String(); strings.Contains(body, token) || strings.Contains(body, hashClaimToken(token)) || strings.Contains(body, "claimToken") {
+				t.Errorf("%s shows the claim token: %s", path, body)
+			}
+		}
+	})
+}
+
+// TestClaimTransferWithToken claims an invitation with its token, and verifies that the token cannot be used again
+func TestClaimTransferWithToken(t *testing.T) {
+	withInvitation(t, func(token string) {
+		checkErrorResponse(t, executeRequest(claimRequestFor("not-the-token", "11")), http.StatusForbidden, codeClaimTokenInvalid, "Claim token is invalid for certificate 1.")
+		checkOwner(t, "10")
+
+		response := executeRequest(claimRequestFor(token, "11"))
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var xfer transfer
+		json.Unmarshal(response.Body.Bytes(), &xfer)
+		if xfer.Status != transferAccepted || xfer.To != "new@test.com" || xfer.ToUserID != "11" {
+			t.Errorf("Expected the transfer to be accepted by user 11. Got %v", xfer)
+		}
+		checkOwner(t, "11")
+
+		checkErrorResponse(t, executeRequest(claimRequestFor(token, "12")), http.StatusConflict, codeClaimTokenUsed, "Claim token has already been used. The transfer of certificate 1 is Accepted.")
+		checkOwner(t, "11")
+	})
+}
+
+// TestClaimTransferIfMatch verifies that claiming a transfer checks If-Match like accepting it does
+func TestClaimTransferIfMatch(t *testing.T) {
+	saved := requireIfMatch
+	defer func() { requireIfMatch = saved }()
+
+	withInvitation(t, func(token string) {
+		req := claimRequestFor(token, "11")
+		req.Header.Set("If-Match", `"1"`)
+		checkErrorResponse(t, executeRequest(req), http.StatusPreconditionFailed, codePreconditionFailed, "Certificate 1 has changed. Its ETag is now \"2\". Read it again before changing it.")
+		checkOwner(t, "10")
+
+		requireIfMatch = true
+		checkErrorResponse(t, executeRequest(claimRequestFor(token, "11")), http.StatusPreconditionRequired, codePreconditionRequired, "Certificate 1 can only be changed with an If-Match header. Read the certificate to get its ETag.")
+		checkOwner(t, "10")
+
+		req = claimRequestFor(token, "11")
+		req.Header.Set("If-Match", `"2"`)
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		checkOwner(t, "11")
+	})
+}
+
+// TestClaimExpiredTransfer verifies that a claim token stops working once its transfer expires, before and after the sweep
+func TestClaimExpiredTransfer(t *testing.T) {
+	withInvitation(t, func(token string) {
+		expireTransferOf("1")
+		checkResponseCode(t, http.StatusConflict, executeRequest(claimRequestFor(token, "11")).Code)
+
+		db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			_, err := expireTransfers(certificates, transfers, time.Now())
+			return err
+		})
+		response := executeRequest(claimRequestFor(token, "11"))
+		checkResponseCode(t, http.StatusConflict, response.Code)
+		var e apiError
+		json.Unmarshal(response.Body.Bytes(), &e)
+		if e.Code != codeTransferExpired {
+			t.Errorf("Expected %s. Got %s", codeTransferExpired, e.Code)
+		}
+		checkOwner(t, "10")
+	})
+}
+
+// TestClaimTransferOnRegistration registers the invited address, and verifies that the new user gets the certificate
+func TestClaimTransferOnRegistration(t *testing.T) {
+	withInvitation(t, func(token string) {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/users/20", bytes.NewBufferString(`{"email":"new@test.com","name":"New User"}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		checkOwner(t, "20")
+
+		checkErrorResponse(t, executeRequest(claimRequestFor(token, "11")), http.StatusConflict, codeClaimTokenUsed, "Claim token has already been used. The transfer of certificate 1 is Accepted.")
+	})
+}
+
+// TestAcceptInvitationWithoutToken verifies that an invitation cannot be accepted without its token
+func TestAcceptInvitationWithoutToken(t *testing.T) {
+	withInvitation(t, func(token string) {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers/accept", nil)
+		checkResponseCode(t, http.StatusForbidden, executeRequest(asUser(req, "11")).Code)
+		checkOwner(t, "10")
+	})
+}
+
+// TestInvitationCannotBeTakenByEmail verifies that a user cannot take an invitation by changing their e-mail address to the
+// invited one and accepting the transfer without its token
+func TestInvitationCannotBeTakenByEmail(t *testing.T) {
+	withInvitation(t, func(token string) {
+		req, _ := http.NewRequest("PUT", "http://localhost:8080/users/11", bytes.NewBufferString(`{"email":"new@test.com","name":"Test User 11"}`))
+		checkErrorResponse(t, executeRequest(asUser(req, "11")), http.StatusConflict, codeEmailInUse, "E-mail address new@test.com has pending invitations. Cannot update user.")
+
+		// Even a user that has the invited address, such as one imported with it, needs the token
+		db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			return users.PutUser(user{"11", "new@test.com", "Test User 11", ""})
+		})
+		req, _ = http.NewRequest("PUT", "http://localhost:8080/certificates/1/transfers", nil)
+		checkErrorResponse(t, executeRequest(asUser(req, "11")), http.StatusForbidden, codeClaimTokenInvalid, "Transfer of certificate 1 is an invitation. Send its claim token to accept it.")
+		checkOwner(t, "10")
+
+		checkResponseCode(t, http.StatusOK, executeRequest(claimRequestFor(token, "11")).Code)
+		checkOwner(t, "11")
+		if incoming := listTransfers(t, "/users/11/transfers?direction=incoming", "11"); len(incoming) != 1 || incoming[0].ToUserID != "11" {
+			t.Errorf("Expected the claimed transfer to be incoming to user 11. Got %v", incoming)
+		}
+	})
+}
+
+// TestClaimTokenSurvivesReopen verifies that the file store keeps the hash of a claim token without writing it with the transfer
+func TestClaimTokenSurvivesReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certificates.db")
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xfer := transfer{ID: "t1", CertID: "1", To: "new@test.com", Status: transferRequested, ClaimTokenHash: hashClaimToken("token")}
+	s.PutTransfer(xfer)
+	s.PutCert(certificate{ID: "1", OwnerID: "10", Transfer: xfer})
+	s.Close()
+
+	reopened, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got, _ := reopened.GetTransfer("t1"); got.ClaimTokenHash != xfer.ClaimTokenHash {
+		t.Errorf("Expected the transfer's claim token hash to be kept. Got %q", got.ClaimTokenHash)
+	}
+	if got, _ := reopened.GetCert("1"); got.Transfer.ClaimTokenHash != xfer.ClaimTokenHash {
+		t.Errorf("Expected the pending transfer's claim token hash to be kept. Got %q", got.Transfer.ClaimTokenHash)
+	}
+}
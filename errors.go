@@ -0,0 +1,103 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Error codes returned to clients. Clients should act on the code and never on the message, which may change
+const (
+	codeInvalidParameter          = "INVALID_PARAMETER"
+	codeMalformedBody             = "MALFORMED_BODY"
+	codeBodyTooLarge              = "BODY_TOO_LARGE"
+	codeValidationFailed          = "VALIDATION_FAILED"
+	codeUnauthenticated           = "UNAUTHENTICATED"
+	codeForbidden                 = "FORBIDDEN"
+	codeRouteNotFound             = "ROUTE_NOT_FOUND"
+	codeMethodNotAllowed          = "METHOD_NOT_ALLOWED"
+	codeInternal                  = "INTERNAL"
+	codeCertNotFound              = "CERT_NOT_FOUND"
+	codeCertExists                = "CERT_EXISTS"
+	codeCertIDMismatch            = "CERT_ID_MISMATCH"
+	codeCertNotDeleted            = "CERT_NOT_DELETED"
+	codeVersionNotFound           = "VERSION_NOT_FOUND"
+	codePreconditionFailed        = "PRECONDITION_FAILED"
+	codePreconditionRequired      = "PRECONDITION_REQUIRED"
+	codeUnsupportedMediaType      = "UNSUPPORTED_MEDIA_TYPE"
+	codePatchFailed               = "PATCH_FAILED"
+	codeBatchFailed               = "BATCH_FAILED"
+	codeImportFailed              = "IMPORT_FAILED"
+	codeUserNotFound              = "USER_NOT_FOUND"
+	codeUserExists                = "USER_EXISTS"
+	codeUserInvalid               = "USER_INVALID"
+	codeUserIDMismatch            = "USER_ID_MISMATCH"
+	codeEmailInUse                = "EMAIL_IN_USE"
+	codeUserOwnsCertificates      = "USER_OWNS_CERTIFICATES"
+	codeUserHasPendingTransfers   = "USER_HAS_PENDING_TRANSFERS"
+	codeTransferInProgress        = "TRANSFER_IN_PROGRESS"
+	codeTransferExists            = "TRANSFER_EXISTS"
+	codeTransferTargetInvalid     = "TRANSFER_TARGET_INVALID"
+	codeNoTransferRequested       = "NO_TRANSFER_REQUESTED"
+	codeTransferExpired           = "TRANSFER_EXPIRED"
+	codeInvalidTransferTransition = "INVALID_TRANSFER_TRANSITION"
+	codeClaimTokenInvalid         = "CLAIM_TOKEN_INVALID"
+	codeClaimTokenUsed            = "CLAIM_TOKEN_USED"
+	codeWebhookNotFound           = "WEBHOOK_NOT_FOUND"
+)
+
+// apiError is the JSON object sent back to the client when a request fails
+type apiError struct {
+	status  int
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// newAPIError returns an error with this status, code and message, and no details
+func newAPIError(status int, code, message string) *apiError {
+	return &apiError{status: status, Code: code, Message: message}
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// with adds a detail to the error, and returns the error so that calls can be chained
+func (e *apiError) with(key string, value interface{}) *apiError {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+	e.Details[key] = value
+	return e
+}
+
+// writeError reports an error back to the client
+func writeError(w http.ResponseWriter, err error) {
+	e := toAPIError(err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// toAPIError returns the error as it is sent to the client. Errors that aren't an apiError are internal errors.
+// They are logged, and sent without their text, which may tell the client how the server is set up, e.g. where its files are
+func toAPIError(err error) *apiError {
+	if e, ok := err.(*apiError); ok {
+		return e
+	}
+	log.Printf("internal error: %v", err)
+	return newAPIError(http.StatusInternalServerError, codeInternal, "Internal error.")
+}
+
+// routeNotFound reports a request to a path that no route matches
+func routeNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, newAPIError(http.StatusNotFound, codeRouteNotFound, "No route matches "+r.URL.Path+".").with("path", r.URL.Path))
+}
+
+// methodNotAllowed reports a request with a method that the route doesn't support
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method "+r.Method+" is not allowed on "+r.URL.Path+".").with("method", r.Method))
+}
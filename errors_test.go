@@ -0,0 +1,47 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestErrorDetails verifies that an error carries its details, and is sent as JSON
+func TestErrorDetails(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/certificates/404", nil)
+	response := executeRequest(req)
+
+	if contentType := response.Header().Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+		t.Errorf("Expected a JSON content type. Got %s", contentType)
+	}
+	expected := `{"code":"CERT_NOT_FOUND","message":"Certificate ID 404 doesn't exist.","details":{"certId":"404"}}`
+	if pass, _ := IsEqualJSON(response.Body.String(), expected); !pass {
+		t.Errorf("\nExpected %s\nGot\t %s", expected, response.Body.String())
+	}
+}
+
+// TestUnknownRouteAndMethod verifies that requests no route can serve are answered with JSON errors as well
+func TestUnknownRouteAndMethod(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/certificate", nil)
+	checkErrorResponse(t, executeRequest(req), http.StatusNotFound, codeRouteNotFound, "No route matches /certificate.")
+
+	req, _ = http.NewRequest("PATCH", "http://localhost:8080/users/10/certificates", nil)
+	checkErrorResponse(t, executeRequest(req), http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method PATCH is not allowed on /users/10/certificates.")
+}
+
+// TestInternalError verifies that errors that aren't API errors are reported as internal errors, without their text
+func TestInternalError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeError(recorder, errors.New("open /var/lib/certs/certificates.json: disk full"))
+
+	var e apiError
+	json.Unmarshal(recorder.Body.Bytes(), &e)
+	checkResponseCode(t, http.StatusInternalServerError, recorder.Code)
+	if expected := (apiError{Code: codeInternal, Message: "Internal error."}); !reflect.DeepEqual(e, expected) {
+		t.Errorf("\nExpected %v\nGot\t %v", expected, e)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requireIfMatch makes clients send If-Match with every change to a certificate, so that no change is made
+// to a certificate the client hasn't seen
+var requireIfMatch = false
+
+// certETag returns the entity tag of the certificate with this id, which is its version
+func certETag(revisions RevisionStore, certID string) string {
+	return versionETag(lastVersion(revisions, certID))
+}
+
+// versionETag returns the entity tag of a version of a certificate
+func versionETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// matchETag checks whether the list of entity tags in an If-Match or If-None-Match header holds etag.
+// Weak tags only match with weak comparison, which is what If-None-Match uses
+func matchETag(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch verifies that the client changes the version of the certificate it has seen. Without an If-Match
+// header the change is made anyway, unless requireIfMatch is set
+func checkIfMatch(r *http.Request, revisions RevisionStore, certID string) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if requireIfMatch {
+			return newAPIError(http.StatusPreconditionRequired, codePreconditionRequired, "Certificate "+certID+" can only be changed with an If-Match header. Read the certificate to get its ETag.").with("certId", certID)
+		}
+		return nil
+	}
+	if etag := certETag(revisions, certID); !matchETag(header, etag, false) {
+		return newAPIError(http.StatusPreconditionFailed, codePreconditionFailed, "Certificate "+certID+" has changed. Its ETag is now "+etag+". Read it again before changing it.").with("certId", certID).with("etag", etag)
+	}
+	return nil
+}
+
+// notModified answers a GET whose If-None-Match header holds the entity tag of the resource with 304,
+// and returns whether it did
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !matchETag(header, etag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
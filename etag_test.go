@@ -0,0 +1,104 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+// TestETags verifies that a certificate's ETag changes with every change to it, that If-None-Match answers 304
+// while it is unchanged, and that a change based on an old ETag is rejected
+func TestETags(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		created := response.Header().Get("ETag")
+		if created != `"1"` {
+			t.Errorf("Expected the new certificate to have ETag \"1\". Got %q", created)
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+		req.Header.Set("If-None-Match", `"7", W/`+created)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusNotModified, response.Code)
+		if response.Body.Len() != 0 || response.Header().Get("ETag") != created {
+			t.Errorf("Expected an empty 304 with the ETag. Got %q and %s", response.Header().Get("ETag"), response.Body.String())
+		}
+
+		req, _ = http.NewRequest("PUT", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"renamed cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		req.Header.Set("If-Match", created)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		updated := response.Header().Get("ETag")
+		if updated != `"2"` {
+			t.Errorf("Expected the updated certificate to have ETag \"2\". Got %q", updated)
+		}
+
+		// A second client that read the certificate before the update cannot overwrite it
+		req, _ = http.NewRequest("PUT", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"stale cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		req.Header.Set("If-Match", created)
+		checkErrorResponse(t, executeRequest(req), http.StatusPreconditionFailed, codePreconditionFailed, `Certificate 1 has changed. Its ETag is now "2". Read it again before changing it.`)
+		for _, path := range []string{"/certificates/1/transfers", "/certificates/1/transfers/cancel"} {
+			req, _ = http.NewRequest("POST", "http://localhost:8080"+path, bytes.NewBufferString(`{"to":"test12@test.com"}`))
+			req.Header.Set("If-Match", created)
+			checkResponseCode(t, http.StatusPreconditionFailed, executeRequest(req).Code)
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+		req.Header.Set("If-None-Match", created)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if response.Header().Get("ETag") != updated {
+			t.Errorf("Expected ETag %s. Got %q", updated, response.Header().Get("ETag"))
+		}
+
+		req, _ = http.NewRequest("DELETE", "http://localhost:8080/certificates/1", nil)
+		req.Header.Set("If-Match", "*")
+		checkResponseCode(t, http.StatusNoContent, executeRequest(req).Code)
+	})
+}
+
+// TestRequireIfMatch verifies that changes without If-Match are rejected when it is required, and that reads aren't
+func TestRequireIfMatch(t *testing.T) {
+	saved := requireIfMatch
+	defer func() { requireIfMatch = saved }()
+
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+		requireIfMatch = true
+		req, _ = http.NewRequest("DELETE", "http://localhost:8080/certificates/1", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusPreconditionRequired, codePreconditionRequired, "Certificate 1 can only be changed with an If-Match header. Read the certificate to get its ETag.")
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBufferString(`{"to":"test12@test.com"}`))
+		req.Header.Set("If-Match", `"1"`)
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	})
+}
+
+// TestMatchETag verifies the comparison of entity tags
+func TestMatchETag(t *testing.T) {
+	tests := []struct {
+		header string
+		weak   bool
+		match  bool
+	}{
+		{`"3"`, false, true},
+		{`"1", "3"`, false, true},
+		{`*`, false, true},
+		{`"4"`, false, false},
+		{`W/"3"`, false, false},
+		{`W/"3"`, true, true},
+		{`3`, true, false},
+	}
+	for _, test := range tests {
+		if got := matchETag(test.header, `"3"`, test.weak); got != test.match {
+			t.Errorf("%s (weak: %t): expected %t. Got %t", test.header, test.weak, test.match, got)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The formats data can be exported and imported in
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// The content types of the formats
+const (
+	csvType    = "text/csv"
+	ndjsonType = "application/x-ndjson"
+)
+
+// The types of records
+const (
+	recordUser        = "user"
+	recordCertificate = "certificate"
+	recordTransfer    = "transfer"
+)
+
+// dataRecord is a user, a certificate or a transfer as it is exported and imported: a line of NDJSON, or a row of CSV
+type dataRecord struct {
+	Type        string       `json:"type"`
+	User        *user        `json:"user,omitempty"`
+	Certificate *certificate `json:"certificate,omitempty"`
+	Transfer    *transfer    `json:"transfer,omitempty"`
+}
+
+// csvColumns are the columns of CSV exports. Each row fills in the columns of its type, and leaves the others empty
+var csvColumns = []string{
+	"type", "id", "email", "name", "role", "title", "issuedAt", "year", "ownerId", "note", "createdAt", "updatedAt",
+	"certId", "fromUserId", "toUserId", "to", "status", "requestedAt", "expiresAt",
+}
+
+// fields returns the CSV columns of the record by name
+func (rec dataRecord) fields() map[string]string {
+	f := map[string]string{"type": rec.Type}
+	switch {
+	case rec.User != nil:
+		u := rec.User
+		f["id"], f["email"], f["name"], f["role"] = u.ID, u.Email, u.Name, u.Role
+	case rec.Certificate != nil:
+		c := rec.Certificate
+		f["id"], f["title"], f["issuedAt"], f["ownerId"], f["note"] = c.ID, c.Title, c.IssuedAt, c.OwnerID, c.Note
+		f["year"], f["createdAt"], f["updatedAt"] = strconv.Itoa(c.Year), c.CreatedAt, c.UpdatedAt
+	case rec.Transfer != nil:
+		x := rec.Transfer
+		f["id"], f["certId"], f["fromUserId"], f["toUserId"], f["to"] = x.ID, x.CertID, x.FromUserID, x.ToUserID, x.To
+		f["status"], f["requestedAt"], f["expiresAt"] = x.Status, x.RequestedAt, x.ExpiresAt
+	}
+	return f
+}
+
+// parseFormat reads the format query parameter. An empty parameter is the default format
+func parseFormat(r *http.Request, defaultFormat string) (string, error) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		return defaultFormat, nil
+	case formatCSV, formatNDJSON:
+		return format, nil
+	default:
+		return "", newAPIError(http.StatusBadRequest, codeInvalidParameter, "Format "+format+" is invalid. It must be csv or ndjson.").with("parameter", "format")
+	}
+}
+
+// exportRecords writes every user, every certificate that isn't in the trash and every pending transfer with write,
+// each sorted by id, and stops at the first record write fails on. Transfers are exported on their own, so certificates
+// are exported without theirs
+func exportRecords(certificates CertificateStore, users UserStore, transfers TransferStore, write func(dataRecord) error) error {
+	list := users.ListUsers()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	for i := range list {
+		if err := write(dataRecord{Type: recordUser, User: &list[i]}); err != nil {
+			return err
+		}
+	}
+
+	certs := certificates.ListCerts()
+	sort.Slice(certs, func(i, j int) bool { return certs[i].ID < certs[j].ID })
+	for _, cert := range certs {
+		if cert.deleted() {
+			continue
+		}
+		cert.Transfer = transfer{}
+		if err := write(dataRecord{Type: recordCertificate, Certificate: &cert}); err != nil {
+			return err
+		}
+	}
+
+	pending := transfers.ListTransfers()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	now := time.Now()
+	for _, xfer := range pending {
+		if xfer.state(now) != transferRequested {
+			continue
+		}
+		if err := write(dataRecord{Type: recordTransfer, Transfer: &xfer}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordWriter returns a function that encodes a record in the format and writes it to w at once, and a function
+// that writes out what is left once the last record is written
+func recordWriter(w io.Writer, format string) (func(dataRecord) error, func() error) {
+	if format == formatNDJSON {
+		encoder := json.NewEncoder(w)
+		return func(rec dataRecord) error { return encoder.Encode(rec) }, func() error { return nil }
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write(csvColumns)
+	row := make([]string, len(csvColumns))
+	write := func(rec dataRecord) error {
+		f := rec.fields()
+		for i, column := range csvColumns {
+			row[i] = f[column]
+		}
+		return writer.Write(row)
+	}
+	flush := func() error {
+		writer.Flush()
+		return writer.Error()
+	}
+	return write, flush
+}
+
+// exportData writes all users, certificates and pending transfers as CSV or as NDJSON, one record per row or line.
+// Every record is written as soon as it is encoded, so the export is never held in memory as a whole
+func exportData(w http.ResponseWriter, r *http.Request) {
+	format, err := parseFormat(r, formatNDJSON)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	started := false
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		if err := authorize(r, actionExport, target{}); err != nil {
+			return err
+		}
+		started = true
+		w.Header().Set("Content-Disposition", `attachment; filename="export.`+format+`"`)
+		if format == formatNDJSON {
+			w.Header().Set("Content-Type", ndjsonType)
+		} else {
+			w.Header().Set("Content-Type", csvType+"; charset=utf-8")
+		}
+		write, flush := recordWriter(w, format)
+		if err := exportRecords(certificates, users, transfers, write); err != nil {
+			return err
+		}
+		return flush()
+	})
+	// Once the export has started, its status has been sent, and an error can only cut it short
+	if err != nil && started {
+		log.Printf("export cut short: %v", err)
+	} else if err != nil {
+		writeError(w, err)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// withExportData runs fn on a fresh store with certificates 1 and 3, a pending transfer of certificate 1,
+// and certificate 2 in the trash
+func withExportData(t *testing.T, fn func()) {
+	withTestStore(func() {
+		for id, cert := range map[string][]byte{"1": cert1, "2": cert2, "3": cert3} {
+			req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/"+id, bytes.NewBuffer(cert))
+			checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		}
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBufferString(`{"to":"test12@test.com"}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		req, _ = http.NewRequest("DELETE", "http://localhost:8080/certificates/2", nil)
+		checkResponseCode(t, http.StatusNoContent, executeRequest(req).Code)
+		fn()
+	})
+}
+
+// TestExportNDJSON exports the store as NDJSON, and verifies that it holds every user, the certificates that aren't
+// in the trash, without their transfers, and the pending transfer
+func TestExportNDJSON(t *testing.T) {
+	withExportData(t, func() {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/export", nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if contentType := response.Header().Get("Content-Type"); contentType != ndjsonType {
+			t.Errorf("Expected %s. Got %s", ndjsonType, contentType)
+		}
+
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(response.Body.String()), "\n") {
+			var rec dataRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("Line %s: %v", line, err)
+			}
+			got = append(got, rec.Type+" "+recordID(rec))
+			if rec.Certificate != nil && rec.Certificate.Transfer != (transfer{}) {
+				t.Errorf("Expected certificates without their transfers. Got %s", line)
+			}
+			if rec.Transfer != nil && (rec.Transfer.CertID != "1" || rec.Transfer.Status != transferRequested) {
+				t.Errorf("Expected the pending transfer of certificate 1. Got %s", line)
+			}
+		}
+		expected := "user 1,user 10,user 11,user 12,certificate 1,certificate 3,transfer"
+		if !strings.HasPrefix(strings.Join(got, ","), expected) || len(got) != 7 {
+			t.Errorf("Expected %s. Got %s", expected, strings.Join(got, ","))
+		}
+	})
+}
+
+// TestExportCSV exports the store as CSV, and verifies the header and the row of a certificate
+func TestExportCSV(t *testing.T) {
+	withExportData(t, func() {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/export?format=csv", nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if contentType := response.Header().Get("Content-Type"); contentType != "text/csv; charset=utf-8" {
+			t.Errorf("Expected CSV. Got %s", contentType)
+		}
+
+		rows, err := csv.NewReader(response.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 8 || strings.Join(rows[0], ",") != strings.Join(csvColumns, ",") {
+			t.Fatalf("Expected a header and 7 rows. Got %v", rows)
+		}
+		row := make(map[string]string)
+		for i, column := range rows[6] {
+			row[rows[0][i]] = column
+		}
+		if row["type"] != recordCertificate || row["id"] != "3" || row["issuedAt"] != "2019-03-29" || row["year"] != "2019" || row["ownerId"] != "11" || row["email"] != "" {
+			t.Errorf("Expected the row of certificate 3. Got %v", row)
+		}
+	})
+}
+
+// TestExportErrors verifies that exports in unknown formats are rejected
+func TestExportErrors(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/export?format=xlsx", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusBadRequest, codeInvalidParameter, "Format xlsx is invalid. It must be csv or ndjson.")
+	})
+}
@@ -0,0 +1,418 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The ways an import can treat records whose id is already taken
+const (
+	importInsert = "insert" // the records are rejected
+	importUpsert = "upsert" // the records replace what has their id
+)
+
+// importError is a record of an import that cannot be imported, with the line or row it was read from
+type importError struct {
+	Row   int       `json:"row"`
+	Type  string    `json:"type,omitempty"`
+	ID    string    `json:"id,omitempty"`
+	Error *apiError `json:"error"`
+}
+
+// importReport is the outcome of an import
+type importReport struct {
+	DryRun  bool          `json:"dryRun"`
+	Mode    string        `json:"mode"`
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Failed  int           `json:"failed"`
+	Errors  []importError `json:"errors,omitempty"`
+}
+
+// importedRecord is a record read from an import, or the reason it couldn't be read
+type importedRecord struct {
+	row int
+	rec dataRecord
+	err error
+}
+
+// readImportBody reads the body of an import, which may be larger than other request bodies
+func readImportBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, newAPIError(http.StatusBadRequest, codeMalformedBody, "Request body is empty.")
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return nil, newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("Request body is larger than %d bytes.", maxImportBytes)).with("limit", maxImportBytes)
+	case err != nil:
+		return nil, newAPIError(http.StatusBadRequest, codeMalformedBody, "Request body cannot be read: "+err.Error()+".")
+	case len(bytes.TrimSpace(data)) == 0:
+		return nil, newAPIError(http.StatusBadRequest, codeMalformedBody, "Request body is empty.")
+	}
+	return data, nil
+}
+
+// readNDJSON reads a record from every line that isn't blank
+func readNDJSON(data []byte) []importedRecord {
+	var records []importedRecord
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		item := importedRecord{row: i + 1}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&item.rec); err != nil {
+			item.err = newAPIError(http.StatusBadRequest, codeMalformedBody, "Line is not valid JSON: "+err.Error()+".")
+		}
+		records = append(records, item)
+	}
+	return records
+}
+
+// recordFromFields makes a record of the CSV columns of a row. The times the server sets are left out
+func recordFromFields(f map[string]string) (dataRecord, error) {
+	rec := dataRecord{Type: f["type"]}
+	switch rec.Type {
+	case recordUser:
+		rec.User = &user{ID: f["id"], Email: f["email"], Name: f["name"], Role: f["role"]}
+	case recordCertificate:
+		rec.Certificate = &certificate{ID: f["id"], Title: f["title"], IssuedAt: f["issuedAt"], OwnerID: f["ownerId"], Note: f["note"]}
+		if year := f["year"]; year != "" {
+			var err error
+			if rec.Certificate.Year, err = strconv.Atoi(year); err != nil {
+				return rec, fieldErrors{"year": "must be a number"}.err("Certificate " + f["id"])
+			}
+		}
+	case recordTransfer:
+		rec.Transfer = &transfer{
+			ID: f["id"], CertID: f["certId"], FromUserID: f["fromUserId"], ToUserID: f["toUserId"], To: f["to"],
+			Status: f["status"], RequestedAt: f["requestedAt"], ExpiresAt: f["expiresAt"],
+		}
+	}
+	return rec, nil
+}
+
+// readCSV reads a record from every row after the header. The header names the columns, in any order, and may leave
+// out the ones the records don't use
+func readCSV(data []byte) ([]importedRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeMalformedBody, "CSV header cannot be read: "+err.Error()+".")
+	}
+	known := make(map[string]bool)
+	for _, column := range csvColumns {
+		known[column] = true
+	}
+	for _, column := range header {
+		if !known[column] {
+			return nil, newAPIError(http.StatusBadRequest, codeMalformedBody, "CSV column "+column+" is unknown. The columns are "+strings.Join(csvColumns, ", ")+".").with("column", column)
+		}
+	}
+	if len(header) == 0 || header[0] != "type" {
+		return nil, newAPIError(http.StatusBadRequest, codeMalformedBody, "CSV header must start with the type column.")
+	}
+
+	var records []importedRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		line, _ := reader.FieldPos(0)
+		item := importedRecord{row: line}
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, newAPIError(http.StatusBadRequest, codeMalformedBody, fmt.Sprintf("CSV row %d cannot be read: %v.", line, err)).with("row", line)
+		}
+		if err != nil {
+			item.err = newAPIError(http.StatusBadRequest, codeMalformedBody, fmt.Sprintf("Row has %d columns instead of %d.", len(row), len(header)))
+		} else {
+			f := make(map[string]string)
+			for i, column := range header {
+				f[column] = row[i]
+			}
+			item.rec, item.err = recordFromFields(f)
+		}
+		records = append(records, item)
+	}
+}
+
+// recordID returns the id of the user, certificate or transfer the record holds
+func recordID(rec dataRecord) string {
+	switch {
+	case rec.User != nil:
+		return rec.User.ID
+	case rec.Certificate != nil:
+		return rec.Certificate.ID
+	case rec.Transfer != nil:
+		return rec.Transfer.ID
+	}
+	return ""
+}
+
+// recordRank orders the records of an import: users come first, so that the certificates that follow can belong to them,
+// and transfers come last, so that the certificates and the recipients they name are there
+func recordRank(rec dataRecord) int {
+	switch rec.Type {
+	case recordUser:
+		return 0
+	case recordCertificate:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// validateImportedTransfer checks a pending transfer read from an import. Unlike a transfer request, it names its
+// certificate and carries its id and its times
+func validateImportedTransfer(xfer transfer) error {
+	f := make(fieldErrors)
+	f.required("id", xfer.ID, maxIDLength)
+	f.required("certId", xfer.CertID, maxIDLength)
+	validateTransferFields(f, "", xfer)
+	if xfer.Status == "" {
+		f["status"] = "is required"
+	}
+	for field, value := range map[string]string{"requestedAt": xfer.RequestedAt, "expiresAt": xfer.ExpiresAt} {
+		if _, err := time.Parse(time.RFC3339, value); value != "" && err != nil {
+			f[field] = "must be an RFC 3339 time"
+		}
+	}
+	return f.err("Transfer " + xfer.ID)
+}
+
+// importTransfer stages a pending transfer of an import again, with its id and its times. The certificate must still
+// belong to the user the transfer is from, and the recipient must be registered, since the claim tokens of invitations
+// are never exported. It returns whether the transfer was created, and what to send once the import is saved
+func importTransfer(r *http.Request, certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore, xfer transfer, mode string) (bool, certChange, error) {
+	if err := validateImportedTransfer(xfer); err != nil {
+		return false, certChange{}, err
+	}
+	cert, ok := liveCert(certificates, xfer.CertID)
+	if !ok {
+		return false, certChange{}, newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+xfer.CertID+" doesn't exist. Cannot import transfer.").with("certId", xfer.CertID)
+	}
+	if err := authorize(r, actionCreateTransfer, target{cert: &cert}); err != nil {
+		return false, certChange{}, err
+	}
+	if xfer.FromUserID != "" && xfer.FromUserID != cert.OwnerID {
+		return false, certChange{}, fieldErrors{"fromUserId": "must be the owner of certificate " + cert.ID}.err("Transfer " + xfer.ID)
+	}
+	recipient, registered := userByEmail(users, xfer.To)
+	if !registered {
+		return false, certChange{}, newAPIError(http.StatusUnprocessableEntity, codeTransferTargetInvalid, "Target "+xfer.To+" isn't registered. Invitations cannot be imported, since their claim tokens are never exported.").with("to", xfer.To)
+	}
+	if xfer.ToUserID != "" && xfer.ToUserID != recipient.ID {
+		return false, certChange{}, fieldErrors{"toUserId": "must be the user registered with " + xfer.To}.err("Transfer " + xfer.ID)
+	}
+
+	// The pending transfer of the certificate is only replaced by the one it was exported as
+	now := time.Now()
+	created := true
+	switch current, exists := transfers.GetTransfer(xfer.ID); {
+	case cert.Transfer.pending() && (cert.Transfer.ID != xfer.ID || mode != importUpsert):
+		return false, certChange{}, newAPIError(http.StatusConflict, codeTransferInProgress, "Certificate "+cert.ID+" is already being transferred to "+cert.Transfer.To+".").with("certId", cert.ID).with("to", cert.Transfer.To)
+	case cert.Transfer.pending():
+		created = false
+	case exists:
+		return false, certChange{}, newAPIError(http.StatusConflict, codeTransferExists, "Transfer ID "+xfer.ID+" already exists. Its status is "+current.state(now)+".").with("id", xfer.ID)
+	}
+	if xfer.state(now) == transferExpired {
+		return false, certChange{}, newAPIError(http.StatusConflict, codeTransferExpired, "The transfer of certificate "+cert.ID+" expired at "+xfer.ExpiresAt+".").with("certId", cert.ID).with("expiresAt", xfer.ExpiresAt)
+	}
+
+	// A transfer that lapsed but hasn't been swept yet is recorded as Expired before it is replaced
+	var change certChange
+	if cert.Transfer.Status == transferRequested && !cert.Transfer.pending() {
+		lapsed, err := resolveTransfer(&cert, transferExpired, now)
+		if err != nil {
+			return false, certChange{}, err
+		}
+		if err := transfers.PutTransfer(lapsed); err != nil {
+			return false, certChange{}, err
+		}
+		change.messages = transferMessages(users, cert, lapsed)
+		change.deliveries = transferDeliveries(hooks, lapsed)
+	}
+
+	staged := requestTransfer(xfer, cert, recipient, now)
+	staged.ID = xfer.ID
+	if xfer.RequestedAt != "" {
+		staged.RequestedAt, staged.ExpiresAt = xfer.RequestedAt, xfer.ExpiresAt
+	}
+	cert.Transfer = staged
+	if err := transfers.PutTransfer(staged); err != nil {
+		return false, certChange{}, err
+	}
+	if err := saveCert(certificates, &cert); err != nil {
+		return false, certChange{}, err
+	}
+	if created {
+		change.messages = append(change.messages, transferMessages(users, cert, staged)...)
+		change.deliveries = append(change.deliveries, transferDeliveries(hooks, staged)...)
+	}
+	change.cert, change.etag = cert, certETag(revisions, cert.ID)
+	return created, change, nil
+}
+
+// importRecords adds or replaces the users, the certificates and the pending transfers of an import on behalf of the user that sent it.
+// Every record is tried, and the report tells which ones failed. It returns what to send once the import is saved
+func importRecords(r *http.Request, certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore, records []importedRecord, mode string) (importReport, certChange) {
+	ordered := make([]importedRecord, len(records))
+	copy(ordered, records)
+	sort.SliceStable(ordered, func(i, j int) bool { return recordRank(ordered[i].rec) < recordRank(ordered[j].rec) })
+
+	r = withIfMatch(r, "")
+	var report importReport
+	var sent certChange
+	for _, item := range ordered {
+		rec := item.rec
+		created, err := true, item.err
+		switch {
+		case err != nil:
+		case rec.Type == recordTransfer && rec.Transfer != nil:
+			var change certChange
+			created, change, err = importTransfer(r, certificates, users, transfers, hooks, revisions, *rec.Transfer, mode)
+			sent.messages = append(sent.messages, change.messages...)
+			sent.deliveries = append(sent.deliveries, change.deliveries...)
+		case rec.Type == recordUser && rec.User != nil:
+			u := *rec.User
+			if err = validateUser(u); err != nil {
+				break
+			}
+			if _, exists := users.GetUser(u.ID); exists && mode == importUpsert {
+				created, err = false, replaceUser(r, certificates, users, u)
+				break
+			}
+			var messages []message
+			var deliveries []*delivery
+			if messages, deliveries, err = addUser(r, certificates, users, transfers, hooks, u); err == nil {
+				sent.messages = append(sent.messages, messages...)
+				sent.deliveries = append(sent.deliveries, deliveries...)
+			}
+		case rec.Type == recordCertificate && rec.Certificate != nil:
+			cert := *rec.Certificate
+			if err = prepareCert(&cert, cert.ID); err != nil {
+				break
+			}
+			var change certChange
+			if _, exists := liveCert(certificates, cert.ID); exists && mode == importUpsert {
+				created = false
+				change, err = replaceCert(r, certificates, hooks, revisions, cert)
+			} else {
+				change, err = addCert(r, certificates, users, hooks, revisions, cert)
+			}
+			sent.messages = append(sent.messages, change.messages...)
+			sent.deliveries = append(sent.deliveries, change.deliveries...)
+		default:
+			err = fieldErrors{"type": "must be user, certificate or transfer, and match what the record holds"}.err("Record")
+		}
+
+		switch {
+		case err != nil:
+			report.Failed++
+			report.Errors = append(report.Errors, importError{Row: item.row, Type: rec.Type, ID: recordID(rec), Error: toAPIError(err)})
+		case created:
+			report.Created++
+		default:
+			report.Updated++
+		}
+	}
+	sort.Slice(report.Errors, func(i, j int) bool { return report.Errors[i].Row < report.Errors[j].Row })
+	return report, sent
+}
+
+// errDryRun takes back an import that was only tried
+var errDryRun = errors.New("dry run")
+
+// importData adds users, certificates and pending transfers from CSV or NDJSON in the format exportData writes. The
+// import is made in one update, which is taken back unless every record can be imported. A dry run is always taken back
+func importData(w http.ResponseWriter, r *http.Request) {
+	format, err := parseFormat(r, "")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if format == "" {
+		switch contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType {
+		case csvType:
+			format = formatCSV
+		case ndjsonType, "application/ndjson":
+			format = formatNDJSON
+		default:
+			writeError(w, newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Content type "+contentType+" is not supported. Send "+csvType+" or "+ndjsonType+", or pass format=csv or format=ndjson.").with("allowed", []string{csvType, ndjsonType}))
+			return
+		}
+	}
+
+	mode := importInsert
+	if s := r.URL.Query().Get("mode"); s != "" {
+		if s != importInsert && s != importUpsert {
+			writeError(w, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Mode "+s+" is invalid. It must be insert or upsert.").with("parameter", "mode"))
+			return
+		}
+		mode = s
+	}
+	dryRun := false
+	if s := r.URL.Query().Get("dryRun"); s != "" {
+		if dryRun, err = strconv.ParseBool(s); err != nil {
+			writeError(w, newAPIError(http.StatusBadRequest, codeInvalidParameter, "DryRun "+s+" is invalid. It must be true or false.").with("parameter", "dryRun"))
+			return
+		}
+	}
+
+	data, err := readImportBody(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var records []importedRecord
+	if format == formatCSV {
+		if records, err = readCSV(data); err != nil {
+			writeError(w, err)
+			return
+		}
+	} else {
+		records = readNDJSON(data)
+	}
+
+	var report importReport
+	var sent certChange
+	err = db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		if err := authorize(r, actionImport, target{}); err != nil {
+			return err
+		}
+		report, sent = importRecords(r, certificates, users, transfers, hooks, revisions, records, mode)
+		switch {
+		case dryRun:
+			return errDryRun
+		case report.Failed > 0:
+			return newAPIError(http.StatusUnprocessableEntity, codeImportFailed, fmt.Sprintf("%d of the %d records cannot be imported, so nothing was imported.", report.Failed, len(records))).with("errors", report.Errors)
+		}
+		return nil
+	})
+	if err != nil && err != errDryRun {
+		writeError(w, err)
+		return
+	}
+	report.DryRun, report.Mode = dryRun, mode
+	if !dryRun {
+		sent.send()
+	}
+	json.NewEncoder(w).Encode(report) // Return a JSON with what was imported, or would be
+}
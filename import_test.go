@@ -0,0 +1,237 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// sendImport sends an import as the admin, and returns the response
+func sendImport(query, contentType, body string) (int, importReport, apiError) {
+	req, _ := http.NewRequest("POST", "http://localhost:8080/import"+query, bytes.NewBufferString(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	response := executeRequest(req)
+	var report importReport
+	var e apiError
+	json.Unmarshal(response.Body.Bytes(), &report)
+	json.Unmarshal(response.Body.Bytes(), &e)
+	return response.Code, report, e
+}
+
+// transferOf returns the transfer certificate id holds in the store
+func transferOf(id string) transfer {
+	var xfer transfer
+	db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		cert, _ := certificates.GetCert(id)
+		xfer = cert.Transfer
+		return nil
+	})
+	return xfer
+}
+
+// TestImportRoundTrip exports the store in both formats, and verifies that importing the exports into a fresh store
+// brings back the users, the certificates and the pending transfer
+func TestImportRoundTrip(t *testing.T) {
+	for _, format := range []string{formatCSV, formatNDJSON} {
+		var exported string
+		var pending transfer
+		withExportData(t, func() {
+			req, _ := http.NewRequest("GET", "http://localhost:8080/export?format="+format, nil)
+			exported = executeRequest(req).Body.String()
+			pending = transferOf("1")
+		})
+
+		withTestStore(func() {
+			code, report, e := sendImport("?format="+format+"&mode=upsert", "", exported)
+			checkResponseCode(t, http.StatusOK, code)
+			if report.Created != 3 || report.Updated != 4 || report.Failed != 0 || report.DryRun {
+				t.Errorf("%s: expected 2 certificates and the transfer to be created, and 4 users to be updated. Got %+v %+v", format, report, e)
+			}
+			if !certExists("1") || certExists("2") || !certExists("3") {
+				t.Errorf("%s: expected certificates 1 and 3", format)
+			}
+			xfer := transferOf("1")
+			if xfer.ID != pending.ID || xfer.Status != transferRequested || xfer.ToUserID != "12" || xfer.FromUserID != "10" || xfer.ExpiresAt != pending.ExpiresAt {
+				t.Errorf("%s: expected the transfer of certificate 1 to be pending as it was exported. Got %+v", format, xfer)
+			}
+
+			// Importing the export again only updates what it holds
+			code, report, e = sendImport("?format="+format+"&mode=upsert", "", exported)
+			checkResponseCode(t, http.StatusOK, code)
+			if report.Created != 0 || report.Updated != 7 {
+				t.Errorf("%s: expected every record to be updated. Got %+v %+v", format, report, e)
+			}
+		})
+	}
+}
+
+// TestImportTransferErrors verifies that a pending transfer is only imported from the owner of its certificate to
+// a registered user, and while the certificate isn't being transferred already
+func TestImportTransferErrors(t *testing.T) {
+	withTestStore(func() {
+		body := strings.Join([]string{
+			`{"type":"certificate","certificate":{"id":"1","title":"first cert","issuedAt":"2019-03-29","ownerId":"10"}}`,
+			`{"type":"certificate","certificate":{"id":"3","title":"third cert","issuedAt":"2019-03-29","ownerId":"10"}}`,
+			`{"type":"transfer","transfer":{"id":"t1","certId":"1","fromUserId":"10","to":"new@test.com","status":"Requested"}}`,
+			`{"type":"transfer","transfer":{"id":"t2","certId":"1","fromUserId":"11","to":"test12@test.com","status":"Requested"}}`,
+			`{"type":"transfer","transfer":{"id":"t3","certId":"9","fromUserId":"10","to":"test12@test.com","status":"Requested"}}`,
+			`{"type":"transfer","transfer":{"id":"t4","certId":"3","to":"test12@test.com","status":"Requested","requestedAt":"2019-03-29T10:00:00Z","expiresAt":"2019-04-05T10:00:00Z"}}`,
+			`{"type":"transfer","transfer":{"id":"t5","certId":"1","to":"test12@test.com","status":"Requested"}}`,
+			`{"type":"transfer","transfer":{"id":"t6","certId":"1","to":"test11@test.com","status":"Requested"}}`,
+			`{"type":"transfer","transfer":{"id":"t7","certId":"3","to":"test12@test.com","status":"Accepted"}}`,
+		}, "\n")
+		code, _, e := sendImport("?format=ndjson", "", body)
+		checkResponseCode(t, http.StatusUnprocessableEntity, code)
+		var failed []importError
+		data, _ := json.Marshal(e.Details["errors"])
+		json.Unmarshal(data, &failed)
+		expected := []struct {
+			row  int
+			code string
+		}{
+			{3, codeTransferTargetInvalid},
+			{4, codeValidationFailed},
+			{5, codeCertNotFound},
+			{6, codeTransferExpired},
+			{8, codeTransferInProgress},
+			{9, codeValidationFailed},
+		}
+		if len(failed) != len(expected) {
+			t.Fatalf("Expected %d errors. Got %+v", len(expected), failed)
+		}
+		for i, f := range failed {
+			if f.Row != expected[i].row || f.Error == nil || f.Error.Code != expected[i].code {
+				t.Errorf("Error %d: expected row %d %s. Got %+v", i, expected[i].row, expected[i].code, f)
+			}
+		}
+		if certExists("1") {
+			t.Errorf("Expected certificate 1 not to be created")
+		}
+	})
+}
+
+// TestImportWithoutIDs verifies that a record without an id is imported once, under the id it is given
+func TestImportWithoutIDs(t *testing.T) {
+	withTestStore(func() {
+		body := `{"type":"certificate","certificate":{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10"}}`
+		code, report, e := sendImport("?format=ndjson", "", body)
+		checkResponseCode(t, http.StatusOK, code)
+		if report.Created != 1 {
+			t.Errorf("Expected the certificate to be created. Got %+v %+v", report, e)
+		}
+		db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			if certs := certificates.ListCerts(); len(certs) != 1 || len(revisions.ListRevisions(certs[0].ID)) != 1 {
+				t.Errorf("Expected one certificate with one revision. Got %+v", certs)
+			}
+			return nil
+		})
+	})
+}
+
+// TestImportNormalizesDates verifies that imported certificates are validated and normalized like the ones that are
+// sent to their own routes
+func TestImportNormalizesDates(t *testing.T) {
+	withTestStore(func() {
+		body := "type,id,title,issuedAt,ownerId\ncertificate,1,first cert,29 MAR 2019,10\n"
+		code, report, _ := sendImport("", "text/csv", body)
+		checkResponseCode(t, http.StatusOK, code)
+		if report.Created != 1 || report.Mode != importInsert {
+			t.Errorf("Expected certificate 1 to be created. Got %+v", report)
+		}
+
+		req, _ := http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+		var cert certificate
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &cert)
+		if cert.IssuedAt != "2019-03-29" || cert.Year != 2019 || cert.CreatedAt == "" {
+			t.Errorf("Expected certificate 1 to be issued on 2019-03-29. Got %+v", cert)
+		}
+	})
+}
+
+// TestImportDryRun verifies that a dry run reports what would be imported without importing it
+func TestImportDryRun(t *testing.T) {
+	withTestStore(func() {
+		body := `{"type":"certificate","certificate":{"id":"1","title":"first cert","issuedAt":"2019-03-29","ownerId":"10"}}`
+		code, report, _ := sendImport("?dryRun=true", "application/x-ndjson", body)
+		checkResponseCode(t, http.StatusOK, code)
+		if !report.DryRun || report.Created != 1 {
+			t.Errorf("Expected certificate 1 to be created in the dry run. Got %+v", report)
+		}
+		if certExists("1") {
+			t.Errorf("Expected certificate 1 not to be created")
+		}
+	})
+}
+
+// TestImportFailure verifies that an import with records that cannot be imported reports each of them by row, and
+// imports nothing
+func TestImportFailure(t *testing.T) {
+	withTestStore(func() {
+		body := strings.Join([]string{
+			`{"type":"certificate","certificate":{"id":"1","title":"first cert","issuedAt":"2019-03-29","ownerId":"10"}}`,
+			`{"type":"user","user":{"id":"10","email":"test10@test.com","name":"Test User 10"}}`,
+			``,
+			`{"type":"certificate","certificate":{"id":"2","title":"second cert","issuedAt":"someday","ownerId":"10"}}`,
+			`{"type":"certificate"`,
+			`{"type":"coupon","certificate":{"id":"3"}}`,
+		}, "\n")
+		code, _, e := sendImport("?format=ndjson", "", body)
+		checkResponseCode(t, http.StatusUnprocessableEntity, code)
+		if e.Code != codeImportFailed || e.Message != "4 of the 5 records cannot be imported, so nothing was imported." {
+			t.Errorf("Expected 4 records to fail. Got %+v", e)
+		}
+		var failed []importError
+		data, _ := json.Marshal(e.Details["errors"])
+		json.Unmarshal(data, &failed)
+		expected := []struct {
+			row  int
+			code string
+		}{
+			{2, codeUserExists},
+			{4, codeValidationFailed},
+			{5, codeMalformedBody},
+			{6, codeValidationFailed},
+		}
+		if len(failed) != len(expected) {
+			t.Fatalf("Expected %d errors. Got %+v", len(expected), failed)
+		}
+		for i, f := range failed {
+			if f.Row != expected[i].row || f.Error == nil || f.Error.Code != expected[i].code {
+				t.Errorf("Error %d: expected row %d %s. Got %+v", i, expected[i].row, expected[i].code, f)
+			}
+		}
+		if certExists("1") {
+			t.Errorf("Expected certificate 1 not to be created")
+		}
+	})
+}
+
+// TestImportErrors verifies that imports that cannot be read at all are rejected
+func TestImportErrors(t *testing.T) {
+	withTestStore(func() {
+		tests := []struct {
+			query, contentType, body string
+			status                   int
+			code, message            string
+		}{
+			{"", "application/json", "{}", http.StatusUnsupportedMediaType, codeUnsupportedMediaType, ""},
+			{"?format=xml", "", "{}", http.StatusBadRequest, codeInvalidParameter, "Format xml is invalid. It must be csv or ndjson."},
+			{"?format=csv&mode=merge", "", "type\n", http.StatusBadRequest, codeInvalidParameter, "Mode merge is invalid. It must be insert or upsert."},
+			{"?format=csv&dryRun=maybe", "", "type\n", http.StatusBadRequest, codeInvalidParameter, "DryRun maybe is invalid. It must be true or false."},
+			{"?format=csv", "", "  ", http.StatusBadRequest, codeMalformedBody, "Request body is empty."},
+			{"?format=csv", "", "id,type\n", http.StatusBadRequest, codeMalformedBody, "CSV header must start with the type column."},
+			{"?format=csv", "", "type,colour\n", http.StatusBadRequest, codeMalformedBody, ""},
+		}
+		for _, test := range tests {
+			code, _, e := sendImport(test.query, test.contentType, test.body)
+			if code != test.status || e.Code != test.code || (test.message != "" && e.Message != test.message) {
+				t.Errorf("%s %q: expected %d %s %s. Got %d %+v", test.query, test.body, test.status, test.code, test.message, code, e)
+			}
+		}
+	})
+}
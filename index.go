@@ -0,0 +1,182 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// certIndex wraps a certificates store and keeps the certificates that are waiting to be transferred keyed by the
+// e-mail address of their recipient, so that a recipient's pending transfers are found without scanning every certificate
+type certIndex struct {
+	CertificateStore
+	pendingTo map[string]map[string]bool // IDs of the certificates with a pending transfer, keyed by the recipient
+}
+
+// newCertIndex indexes the certificates already in the store
+func newCertIndex(certs CertificateStore) *certIndex {
+	c := &certIndex{CertificateStore: certs, pendingTo: make(map[string]map[string]bool)}
+	for _, cert := range certs.ListCerts() {
+		c.add(cert)
+	}
+	return c
+}
+
+// add indexes the certificate if it is waiting to be transferred. Transfers that lapsed stay in the index until they
+// are swept, so lookups still check that the transfer is pending
+func (c *certIndex) add(cert certificate) {
+	if cert.Transfer.Status != transferRequested {
+		return
+	}
+	if c.pendingTo[cert.Transfer.To] == nil {
+		c.pendingTo[cert.Transfer.To] = make(map[string]bool)
+	}
+	c.pendingTo[cert.Transfer.To][cert.ID] = true
+}
+
+// remove drops the certificate with this id from the index
+func (c *certIndex) remove(id string) {
+	cert, ok := c.CertificateStore.GetCert(id)
+	if !ok || cert.Transfer.Status != transferRequested {
+		return
+	}
+	delete(c.pendingTo[cert.Transfer.To], id)
+	if len(c.pendingTo[cert.Transfer.To]) == 0 {
+		delete(c.pendingTo, cert.Transfer.To)
+	}
+}
+
+// reindex indexes the certificate with this id as it is now held by the store, whether or not the last change succeeded
+func (c *certIndex) reindex(id string) {
+	if cert, ok := c.CertificateStore.GetCert(id); ok {
+		c.add(cert)
+	}
+}
+
+// PutCert adds or replaces the certificate and updates the index
+func (c *certIndex) PutCert(cert certificate) error {
+	c.remove(cert.ID)
+	defer c.reindex(cert.ID)
+	return c.CertificateStore.PutCert(cert)
+}
+
+// DeleteCert removes the certificate and updates the index
+func (c *certIndex) DeleteCert(id string) error {
+	c.remove(id)
+	defer c.reindex(id)
+	return c.CertificateStore.DeleteCert(id)
+}
+
+// userIndex wraps a users store and keeps the ID of every user keyed by the user's e-mail address
+type userIndex struct {
+	UserStore
+	byEmail map[string]string
+}
+
+// newUserIndex indexes the users already in the store
+func newUserIndex(users UserStore) *userIndex {
+	idx := &userIndex{UserStore: users, byEmail: make(map[string]string)}
+	for _, u := range users.ListUsers() {
+		idx.byEmail[u.Email] = u.ID
+	}
+	return idx
+}
+
+// remove drops the user with this id from the index
+func (idx *userIndex) remove(id string) {
+	if u, ok := idx.UserStore.GetUser(id); ok && idx.byEmail[u.Email] == id {
+		delete(idx.byEmail, u.Email)
+	}
+}
+
+// reindex indexes the user with this id as it is now held by the store, whether or not the last change succeeded
+func (idx *userIndex) reindex(id string) {
+	if u, ok := idx.UserStore.GetUser(id); ok {
+		idx.byEmail[u.Email] = u.ID
+	}
+}
+
+// PutUser adds or replaces the user and updates the index
+func (idx *userIndex) PutUser(u user) error {
+	idx.remove(u.ID)
+	defer idx.reindex(u.ID)
+	return idx.UserStore.PutUser(u)
+}
+
+// DeleteUser removes the user and updates the index
+func (idx *userIndex) DeleteUser(id string) error {
+	idx.remove(id)
+	defer idx.reindex(id)
+	return idx.UserStore.DeleteUser(id)
+}
+
+// userByEmail returns the user with this e-mail address. It uses the store's index when the store has one
+func userByEmail(users UserStore, email string) (user, bool) {
+	if idx, ok := users.(*userIndex); ok {
+		id, ok := idx.byEmail[email]
+		if !ok {
+			return user{}, false
+		}
+		return idx.GetUser(id)
+	}
+
+	for _, u := range users.ListUsers() {
+		if u.Email == email {
+			return u, true
+		}
+	}
+	return user{}, false
+}
+
+// pendingTransfersTo returns the certificates that are waiting to be transferred to this e-mail address.
+// It uses the store's index when the store has one
+func pendingTransfersTo(certificates CertificateStore, email string) []certificate {
+	var certs []certificate
+	if idx, ok := certificates.(*certIndex); ok {
+		for id := range idx.pendingTo[email] {
+			if cert, ok := idx.GetCert(id); ok && cert.Transfer.pending() {
+				certs = append(certs, cert)
+			}
+		}
+		return certs
+	}
+
+	for _, cert := range certificates.ListCerts() {
+		if cert.Transfer.pending() && cert.Transfer.To == email {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// listPendingTransfers lists the certificates that are waiting to be transferred to the user with this id,
+// one page at a time
+func listPendingTransfers(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+
+	paging, err := parsePageRequest(r, certSortFields...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var certs []certificate
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		u, ok := users.GetUser(userID)
+		if !ok {
+			return newAPIError(http.StatusNotFound, codeUserNotFound, "User ID "+userID+" is invalid. Cannot list pending transfers.").with("userId", userID)
+		}
+		if err := authorize(r, actionListUserTransfers, target{userID: userID}); err != nil {
+			return err
+		}
+		certs = pendingTransfersTo(certificates, u.Email)
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(paging.paginate(certPageItems(certs, paging.sortBy))) // Return a JSON with the certificates waiting for the user
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// pendingIDs returns the sorted IDs of the certificates waiting to be transferred to this e-mail address
+func pendingIDs(certificates CertificateStore, email string) []string {
+	ids := []string{}
+	for _, cert := range pendingTransfersTo(certificates, email) {
+		ids = append(ids, cert.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// TestCertIndexFollowsChanges changes certificates in an indexed store, and verifies that the index always gives
+// the same answer as a scan of the underlying store
+func TestCertIndexFollowsChanges(t *testing.T) {
+	pendingTo := func(id, email string) certificate {
+		return certificate{ID: id, Transfer: transfer{To: email, Status: transferRequested}}
+	}
+	certs := make(certsMap)
+	certs.PutCert(pendingTo("1", "a@test.com"))
+	idx := newCertIndex(certs)
+
+	steps := []struct {
+		put    certificate
+		delete string
+	}{
+		{put: pendingTo("2", "a@test.com")},
+		{put: pendingTo("3", "b@test.com")},
+		{put: pendingTo("1", "b@test.com")},
+		{put: certificate{ID: "2"}},
+		{delete: "3"},
+		{delete: "4"},
+	}
+	for i, step := range steps {
+		if step.delete != "" {
+			idx.DeleteCert(step.delete)
+		} else {
+			idx.PutCert(step.put)
+		}
+		for _, email := range []string{"a@test.com", "b@test.com"} {
+			if indexed, scanned := pendingIDs(idx, email), pendingIDs(certs, email); !reflect.DeepEqual(indexed, scanned) {
+				t.Errorf("Step %d, %s: the index gives %v, but the store holds %v", i, email, indexed, scanned)
+			}
+		}
+	}
+	if len(idx.pendingTo["a@test.com"]) != 0 {
+		t.Errorf("Expected no empty entries to be left in the index. Got %v", idx.pendingTo)
+	}
+}
+
+// TestUserIndexFollowsChanges changes the e-mail address of a user and deletes another, and verifies the lookups by e-mail
+func TestUserIndexFollowsChanges(t *testing.T) {
+	idx := newUserIndex(newTestUsers())
+
+	idx.PutUser(user{"10", "new10@test.com", "Test User 10", ""})
+	idx.DeleteUser("11")
+
+	for email, expected := range map[string]string{"new10@test.com": "10", "test10@test.com": "", "test11@test.com": "", "test12@test.com": "12"} {
+		u, ok := userByEmail(idx, email)
+		if ok != (expected != "") || u.ID != expected {
+			t.Errorf("%s: expected user %q. Got %q", email, expected, u.ID)
+		}
+	}
+}
+
+// TestListPendingTransfers requests transfers to users 11 and 12, and verifies what each of them finds in their inbox
+func TestListPendingTransfers(t *testing.T) {
+	withTestStore(func() {
+		for _, id := range []string{"1", "2", "3"} {
+			req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/"+id, bytes.NewBufferString(`{"title":"cert `+id+`","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+			executeRequest(req)
+		}
+		for id, to := range map[string]string{"1": "test12@test.com", "2": "test11@test.com", "3": "test12@test.com"} {
+			req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/"+id+"/transfers", bytes.NewBufferString(`{"to":"`+to+`"}`))
+			executeRequest(req)
+		}
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/3/transfers/reject", nil)
+		executeRequest(asUser(req, "12"))
+
+		for userID, expected := range map[string][]string{"12": {"1"}, "11": {"2"}, "10": {}} {
+			req, _ := http.NewRequest("GET", "http://localhost:8080/users/"+userID+"/transfers/pending", nil)
+			response := executeRequest(asUser(req, userID))
+			checkResponseCode(t, http.StatusOK, response.Code)
+
+			var listed struct {
+				Items []certificate `json:"items"`
+			}
+			json.Unmarshal(response.Body.Bytes(), &listed)
+			ids := []string{}
+			for _, cert := range listed.Items {
+				ids = append(ids, cert.ID)
+			}
+			if !reflect.DeepEqual(ids, expected) {
+				t.Errorf("User %s: expected certificates %v. Got %v", userID, expected, ids)
+			}
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/users/99/transfers/pending", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusNotFound, codeUserNotFound, "User ID 99 is invalid. Cannot list pending transfers.")
+	})
+}
@@ -2,18 +2,24 @@
 
 /* This is a RESTful API used to handle certificates creation and update
 * You can run it by calling:
-* go run main.go
+* go run .
+* To keep the certificates and users in a file on disk instead of in memory, run:
+* go run . -store=file -data=certificates.db -audit-log=audit.log
+* Stop it with SIGINT or SIGTERM: it finishes the requests in progress, sends the queued e-mails and webhook events, and
+  closes the store before it exits
 * You can run the unit tests by calling:
 * go test -v
+* To also check the handlers for data races under parallel load, run:
+* go test -race -v
 *
 * The following actions are supported:
 * Create a certificate with ID CertID by sending a POST request to [website]/certificates/[CertID] with the following body:
 {
     "id": string,
     "title": string,
-    "createdAt": string,
+    "issuedAt": string,
     "ownerId": string,
-    "year": number,
+    "year": (number),
     "note": string,
     "transfer": {"to":"","status":""}
 }
@@ -21,126 +27,557 @@
 {
     "id": (string),
     "title": (string),
-    "createdAt": (string),
+    "issuedAt": (string),
     "ownerId": (string),
     "year": (number),
     "note": (string),
     "transfer": {"to":"","status":""}
 }
-* Delete a certificate with ID CertID by sending a DELETE request to [website]/certificates/[CertID] with an empty body
+* issuedAt is a date such as 2019-03-29 or 29 MAR 2019, and is returned as 2019-03-29. The year may be left out, and must
+  otherwise be the year of issuedAt. Certificates are returned with the RFC 3339 times the server created and last
+  changed them in createdAt and updatedAt, which are ignored in request bodies
+* The ownerId of a certificate is set on creation, and cannot be changed afterwards except through the admin reassign route.
+  Its transfer is managed by the server: it cannot be set on creation or changed by an update. An admin may reassign a certificate by sending a POST request to [website]/certificates/[CertID]/owner with the body
+  {"ownerId": string, "reason": string}. The reason is recorded in the audit log
+* Change some fields of a certificate by sending a PATCH request to [website]/certificates/[CertID] with a JSON Merge Patch
+  (Content-Type: application/merge-patch+json) or a JSON Patch (Content-Type: application/json-patch+json). The id, ownerId,
+  transfer, createdAt and updatedAt fields cannot be patched
+* Create, update, delete and transfer many certificates at once by sending a POST request to [website]/certificates:batch with
+  the body {"mode": "atomic"|"bestEffort", "operations": [{"op": "create"|"update"|"delete"|"transfer", "id": string, ...}]}.
+  An atomic batch is made whole or not at all; a best-effort batch makes what it can. Every operation gets its own result
+* The certificate ID in the URL is authoritative. The id field of the body may be omitted, and a body whose id differs
+  from the URL is rejected with CERT_ID_MISMATCH
+* Create a certificate with a new ID by sending a POST request to [website]/certificates with the same body. If the body
+  has no id, a UUID is generated. The response has status 201 and a Location header pointing to the new certificate
+* Delete a certificate with ID CertID by sending a DELETE request to [website]/certificates/[CertID] with an empty body.
+  The certificate is moved to the trash. A certificate that is being transferred is only deleted with force=true, which cancels the transfer
+* List the deleted certificates by sending a GET request to [website]/trash, and restore one by sending a POST request to
+  [website]/certificates/[CertID]/restore. Deleted certificates are purged after the duration given with -trash-retention
+  (30 days by default, 0 to keep them)
+* Read a certificate with ID CertID by sending a GET request to [website]/certificates/[CertID]. Pass an RFC 3339 time in asOf
+  to read the certificate as it was at that time
+* Every change to a certificate adds an immutable revision of it. List the revisions by sending a GET request to
+  [website]/certificates/[CertID]/versions, read version N at [website]/certificates/[CertID]/versions/[N], and list the fields
+  that changed since the version before at [website]/certificates/[CertID]/versions/[N]/diff, or since version M with from=M
+* Certificates are returned with their version as an ETag. A GET with a matching If-None-Match is answered with 304. PUT, DELETE,
+  restore and transfer requests that carry an If-Match that doesn't match are rejected with 412. Run with -require-if-match to reject
+  those that carry none with 428
+* List all certificates by sending a GET request to [website]/certificates. The list can be filtered with the
+  ownerId, year and transferStatus query parameters, e.g. [website]/certificates?ownerId=10&transferStatus=Requested.
+  transferStatus=none lists the certificates that aren't being transferred
+* Create a user with ID UserID by sending a POST request to [website]/users/[UserID] with the following body:
+{
+    "id": string,
+    "email": string,
+    "name": string,
+    "role": "admin" | "auditor" | "" (string, optional)
+}
+* Read, update or delete the user with ID UserID by sending a GET, PUT or DELETE request to [website]/users/[UserID].
+  A PUT takes the same body as a POST. A user that owns certificates, even deleted ones, or has pending incoming transfers cannot be deleted
+* List all users by sending a GET request to [website]/users
 * List all certificates owned by user UserID by sending a GET request to [website]/users/[CertID]/certificates  with an empty body
 * Transfer certificate with ID CertID to a different user by sending a POST request to [website]/certificates/[CertID]/transfers with the following body:
 {
     "to": [User's e-mail address] (string),
     "status": "Requested"
 }
-* Accept a transfer of certificate with ID CertID by sending a PUT request to [website]/certificates/[CertID]/transfers  with an empty body
+* Accept a transfer of certificate with ID CertID by sending a PUT request to [website]/certificates/[CertID]/transfers  with an empty body,
+  or a POST request to [website]/certificates/[CertID]/transfers/accept
+* Reject a transfer by sending a POST request to [website]/certificates/[CertID]/transfers/reject, or cancel it by sending a POST
+  request to [website]/certificates/[CertID]/transfers/cancel, with an empty body
+*
+* A transfer starts as Requested, and then moves to exactly one of Accepted, Rejected, Cancelled or Expired. Closing a transfer
+* returns it in its final state and frees the certificate for a new transfer. Pending transfers expire after the duration given
+* with -transfer-ttl (7 days by default, 0 to never expire)
+* A transfer to an e-mail address nobody has registered is an invitation. Its response holds a claimToken, shown only once.
+  Registering a user with that address, or accepting the transfer with the body {"claimToken": string}, gives the certificate
+  to the new user or to the user that sent the token. A token can be used only once, and not after the transfer expires
+* Transfer events are e-mailed to the recipient and the owner in the background, with retries. Run with -notify=log to write
+  the e-mails to standard error (or to the file given with -notify-log), or with -notify=smtp to send them through the server
+  given with -smtp-addr, from the address given with -smtp-from, as the user in SMTP_USERNAME and SMTP_PASSWORD
+* List the transfers of certificate CertID, oldest first, by sending a GET request to [website]/certificates/[CertID]/transfers.
+  Every transfer is kept once it is over, with the users involved, its final status and its times
+* List the transfers sent or received by user UserID by sending a GET request to [website]/users/[UserID]/transfers.
+  Pass direction=incoming or direction=outgoing to list only one of them
+* List the certificates waiting to be transferred to user UserID by sending a GET request to [website]/users/[UserID]/transfers/pending
+*
+* Subscribe a URL to certificate and transfer events by sending a POST request to [website]/webhooks with the following body:
+{
+    "url": string,
+    "events": ["certificate.created" | "certificate.updated" | "certificate.deleted" | "certificate.restored" |
+               "certificate.purged" | "transfer.requested" | "transfer.accepted" | "transfer.rejected" |
+               "transfer.cancelled" | "transfer.expired"]
+}
+  The response has status 201 and holds the webhook's secret, shown only once. Every event is POSTed to the URL as
+  {"id": string, "event": string, "occurredAt": string, "data": {...}}, where data is the certificate or the transfer.
+  Deliveries carry X-Webhook-Timestamp and X-Webhook-Signature headers; the signature is sha256= and the hex HMAC-SHA256,
+  keyed with the secret, of the timestamp, a dot and the body. A delivery that isn't answered with a 2xx status is retried
+  up to 6 times with a doubling delay, starting at a second, and is then dead. Deliveries to loopback, link-local, private
+  and other internal addresses fail, unless their network is given with -webhook-allow, e.g. -webhook-allow=10.0.0.0/8
+* List, read or delete webhooks by sending a GET request to [website]/webhooks, or a GET or DELETE request to [website]/webhooks/[WebhookID]
+* List the deliveries of webhook WebhookID, with every attempt made, by sending a GET request to [website]/webhooks/[WebhookID]/deliveries.
+  Pass status=pending, status=succeeded or status=dead; the dead deliveries are the dead-letter list. Only the last 1000
+  deliveries of every webhook are kept, in memory
+*
+* Every change to a certificate, user, transfer or webhook is recorded in an append-only audit log, with the user that made it,
+  the ID of the request (sent back in the X-Request-ID header), the time, and the resource before and after the change.
+  Every entry is chained to the one before it by its SHA-256 hash. The file store appends the log to the file given with -audit-log
+* List the audit log by sending a GET request to [website]/audit, filtered with the certId, userId and since query parameters
+* Check that no entry of the audit log was changed or removed by sending a GET request to [website]/audit/verify
+*
+* Export all users, certificates and pending transfers by sending a GET request to [website]/export?format=csv or format=ndjson
+* Import users, certificates and pending transfers from an export by sending a POST request to [website]/import. Pass mode=insert or mode=upsert,
+  and dryRun=true to only check the import. An import is made whole or not at all, and reports the rows that failed
+*
+* Every request must identify its user, either with an API key in an X-API-Key header, or with a JWT in an
+* Authorization: Bearer header. API keys are mapped to user IDs in the JSON file given with -api-keys. Bearer tokens
+* must carry the user ID in their sub claim and an exp claim, and be signed with HS256 using the secret in the
+* JWT_HMAC_SECRET environment variable, or with RS256 using the RSA public key in the PEM file given with -jwt-rsa-key.
+* Requests with missing or invalid credentials are rejected with status 401. Run with -auth=false to turn authentication off
+* A new store has no users, and only admins may create them. Set the ADMIN_API_KEY environment variable to let requests that
+* carry that key act as the admin given with -admin-id (admin by default), who is created, with the e-mail address given with
+* -admin-email, if the store doesn't have it
+*
+* Authenticated users are only allowed what their role permits, and are rejected with status 403 otherwise. The owner of a
+* certificate may read, update, delete and transfer it. The recipient of a pending transfer may read the certificate and accept
+* or reject the transfer; nobody else may accept or reject it. The owner may cancel it. Users may read, update and delete their own user, and list their own certificates.
+* Admins may do anything else, and are the only ones who may create users, change roles or manage webhooks. Auditors may read everything.
+*
+* Creating or updating a certificate returns the certificate. Deleting a certificate or a user returns an empty response with status 204.
+* All listings return one page at a time, as {"items": [...], "nextCursor": string}. Pass limit (1-1000, default 50) to set the
+* page size, and pass the nextCursor of a page as the cursor query parameter to get the next one. nextCursor is omitted on the last page.
+* Certificate listings can be sorted with sort=id|issuedAt|createdAt|updatedAt|year|title (default id) and order=asc|desc (default asc).
+*
+* Failed requests are answered with a JSON error object: {"code": string, "message": string, "details": {...}}.
+* Clients should act on the code (e.g. CERT_NOT_FOUND, USER_INVALID, TRANSFER_IN_PROGRESS), and not on the message.
+* The status is 400, 401, 403, 404, 409 or 422, depending on the kind of failure.
+*
+* Request bodies must be a single JSON object of at most 1 MB with no unknown fields. Their fields are validated, and
+* problems are reported with VALIDATION_FAILED and a message per field in details.fields
 */
 
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type transfer struct {
-	To     string `json:"to"` /* email address of the recepient */
-	Status string `json:"status"`
+	ID          string `json:"id,omitempty"`          /* set by the server, as are the certificate and the users involved */
+	CertID      string `json:"certId,omitempty"`
+	FromUserID  string `json:"fromUserId,omitempty"`
+	ToUserID    string `json:"toUserId,omitempty"`
+	To          string `json:"to"`                    /* email address of the recepient */
+	Status      string `json:"status"`                /* "Requested" while pending, then "Accepted", "Rejected", "Cancelled" or "Expired" */
+	RequestedAt string `json:"requestedAt,omitempty"` /* RFC 3339 times, set by the server */
+	ExpiresAt   string `json:"expiresAt,omitempty"`
+	ResolvedAt  string `json:"resolvedAt,omitempty"`
+
+	ClaimToken     string `json:"claimToken,omitempty"` /* returned once, when a transfer to an unregistered address is requested */
+	ClaimTokenHash string `json:"-"`                    /* kept instead of the token, and never sent to clients */
 }
 
 type certificate struct {
 	ID        string   `json:"id"`
 	Title     string   `json:"title"`
-	CreatedAt string   `json:"createdAt"`
+	IssuedAt  string   `json:"issuedAt"`  // the date the certificate was issued, written in dateLayout
+	CreatedAt string   `json:"createdAt"` // set by the server
+	UpdatedAt string   `json:"updatedAt"` // set by the server
 	OwnerID   string   `json:"ownerId"`
 	Year      int      `json:"year"`
 	Note      string   `json:"note"`
 	Transfer  transfer `json:"transfer"`
+	DeletedAt string   `json:"deletedAt,omitempty"` // set while the certificate is in the trash
 }
 
 type user struct {
 	ID    string `json:"id"`
 	Email string `json:"email"`
 	Name  string `json:"name"`
+	Role  string `json:"role,omitempty"` /* "admin", "auditor", or empty for a regular user */
 }
 
 type certsMap map[string]certificate
 type usersMap map[string]user
+type transfersMap map[string]transfer
 
-// certificates holds all the existing certificates, mapped by the certificate's Id
-var certificates certsMap
+// db holds all the existing certificates, mapped by the certificate's Id, and all the currently defined users
+var db *store
 
-// users holds all the currently defined users
-var users usersMap
+// newID returns a random (version 4) UUID for a certificate the client didn't name
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand never fails on the supported platforms
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// decodeCert populates cert with the received payload and validates it. The certificate ID in the path is
+// authoritative: the body may omit the ID, but it cannot name a different certificate. When the path holds no ID,
+// the body's ID is used, and a new one is generated if the body has none either
+func decodeCert(w http.ResponseWriter, r *http.Request, cert *certificate) error {
+	if err := decodeBody(w, r, cert); err != nil {
+		return err
+	}
+	return prepareCert(cert, mux.Vars(r)["id"])
+}
+
+// prepareCert settles the ID of a certificate received for the certificate ID certID, as decodeCert does, validates it
+// and normalizes its dates. An empty certID stands for a request that didn't name the certificate
+func prepareCert(cert *certificate, certID string) error {
+	switch {
+	case certID == "" && cert.ID == "":
+		cert.ID = newID()
+	case certID == "":
+	case cert.ID != "" && cert.ID != certID:
+		return newAPIError(http.StatusUnprocessableEntity, codeCertIDMismatch, "Certificate ID "+cert.ID+" doesn't match the requested certificate ID "+certID+".").with("certId", certID).with("bodyId", cert.ID)
+	default:
+		cert.ID = certID
+	}
+	if err := validateCert(*cert); err != nil {
+		return err
+	}
+	normalizeDates(cert)
+	return nil
+}
+
+// certChange is a change made to a certificate in the stores, with what is left to do once the change is saved
+type certChange struct {
+	cert       certificate
+	etag       string
+	messages   []message
+	deliveries []*delivery
+}
+
+// send lets the users and the webhooks know of a change that has been saved
+func (c certChange) send() {
+	notifications.send(c.messages...)
+	webhookDeliveries.send(c.deliveries...)
+}
 
 // CreateCert creates a certificate and adds it to the certificates array
 func createCert(w http.ResponseWriter, r *http.Request) {
 	var cert certificate
+	if err := decodeCert(w, r, &cert); err != nil {
+		writeError(w, err)
+		return
+	}
 
-	_ = json.NewDecoder(r.Body).Decode(&cert) // Populate cert with the received payload
+	var change certChange
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var err error
+		change, err = addCert(r, certificates, users, hooks, revisions, cert)
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	change.send()
+	w.Header().Set("ETag", change.etag)
 
-	if _, ok := (certificates[cert.ID]); ok {
-		http.Error(w, "Certificate ID "+cert.ID+" already exists. Cannot create certificate.", http.StatusBadRequest)
-	} else if _, ok := users[cert.OwnerID]; !ok {
-		http.Error(w, "User ID "+cert.OwnerID+" is invalid. Cannot create certificate.", http.StatusBadRequest)
-	} else {
-		certificates[cert.ID] = cert            // add the newly-created certificate to the certificates map
-		json.NewEncoder(w).Encode(certificates) // Return a JSON with the current certificates
+	// A client that didn't name the certificate learns where it was created
+	if _, inPath := mux.Vars(r)["id"]; !inPath {
+		w.Header().Set("Location", "/certificates/"+url.PathEscape(change.cert.ID))
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(change.cert) // Return a JSON with the new certificate
+}
+
+// addCert adds a new, validated certificate to the stores on behalf of the user that sent the request
+func addCert(r *http.Request, certificates CertificateStore, users UserStore, hooks WebhookStore, revisions RevisionStore, cert certificate) (certChange, error) {
+	// A transfer is only ever requested through the transfer routes
+	if cert.Transfer != (transfer{}) {
+		return certChange{}, fieldErrors{"transfer": "cannot be set. Use the transfer routes instead"}.err("Certificate " + cert.ID)
+	}
+	if err := authorize(r, actionCreateCert, target{cert: &cert}); err != nil {
+		return certChange{}, err
+	}
+	if existing, ok := certificates.GetCert(cert.ID); ok {
+		if existing.deleted() {
+			return certChange{}, newAPIError(http.StatusConflict, codeCertExists, "Certificate ID "+cert.ID+" is in the trash. Restore it, or create the certificate with another ID.").with("certId", cert.ID).with("deletedAt", existing.DeletedAt)
+		}
+		return certChange{}, newAPIError(http.StatusConflict, codeCertExists, "Certificate ID "+cert.ID+" already exists. Cannot create certificate.").with("certId", cert.ID)
+	}
+	if _, ok := users.GetUser(cert.OwnerID); !ok {
+		return certChange{}, newAPIError(http.StatusUnprocessableEntity, codeUserInvalid, "User ID "+cert.OwnerID+" is invalid. Cannot create certificate.").with("userId", cert.OwnerID)
 	}
+	// add the newly-created certificate to the certificates store
+	if err := saveCert(certificates, &cert); err != nil {
+		return certChange{}, err
+	}
+	return certChange{cert: cert, etag: certETag(revisions, cert.ID), deliveries: newDeliveries(hooks, eventCertCreated, cert)}, nil
 }
 
 // updateCert updates an existing certificate
 func updateCert(w http.ResponseWriter, r *http.Request) {
 	var cert certificate
-	_ = json.NewDecoder(r.Body).Decode(&cert) // Populate cert with the received payload
+	if err := decodeCert(w, r, &cert); err != nil {
+		writeError(w, err)
+		return
+	}
 
-	if _, ok := (certificates[cert.ID]); !ok {
-		http.Error(w, "Certificate ID "+cert.ID+" doesn't exist. Cannot update certificate.", http.StatusBadRequest)
-	} else if _, ok := users[cert.OwnerID]; !ok {
-		http.Error(w, "User ID "+cert.OwnerID+" is invalid. Cannot update certificate.", http.StatusBadRequest)
+	var change certChange
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var err error
+		change, err = replaceCert(r, certificates, hooks, revisions, cert)
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
 	} else {
-		certificates[cert.ID] = cert            // add the newly-created certificate to the certificates map
-		json.NewEncoder(w).Encode(certificates) // Return a JSON with the current certificates
+		change.send()
+		w.Header().Set("ETag", change.etag)
+		json.NewEncoder(w).Encode(change.cert) // Return a JSON with the updated certificate
+	}
+}
+
+// replaceCert replaces an existing certificate in the stores with a validated one, on behalf of the user that sent
+// the request
+func replaceCert(r *http.Request, certificates CertificateStore, hooks WebhookStore, revisions RevisionStore, cert certificate) (certChange, error) {
+	current, ok := liveCert(certificates, cert.ID)
+	if !ok {
+		return certChange{}, newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+cert.ID+" doesn't exist. Cannot update certificate.").with("certId", cert.ID)
 	}
+	if err := authorize(r, actionUpdateCert, target{cert: &current}); err != nil {
+		return certChange{}, err
+	}
+	if err := checkIfMatch(r, revisions, cert.ID); err != nil {
+		return certChange{}, err
+	}
+	if err := keepServerFields(current, &cert); err != nil {
+		return certChange{}, err
+	}
+	// replace the certificate in the certificates store
+	if err := saveCert(certificates, &cert); err != nil {
+		return certChange{}, err
+	}
+	return certChange{cert: cert, etag: certETag(revisions, cert.ID), deliveries: newDeliveries(hooks, eventCertUpdated, cert)}, nil
 }
 
-// deleteCert deletes a existing certificate from the certificates map
+// deleteCert moves an existing certificate to the trash. A certificate that is being transferred is only deleted
+// when the force query parameter is true, and its transfer is then cancelled
 func deleteCert(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	certID := params["id"]
 
-	if _, ok := (certificates[certID]); !ok {
-		http.Error(w, "Certificate ID "+certID+" doesn't exist. Cannot delete certificate.", http.StatusBadRequest)
+	force := false
+	if s := r.URL.Query().Get("force"); s != "" {
+		var err error
+		if force, err = strconv.ParseBool(s); err != nil {
+			writeError(w, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Force "+s+" is invalid. It must be true or false.").with("parameter", "force"))
+			return
+		}
+	}
+
+	var change certChange
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var err error
+		change, err = trashCert(r, certificates, users, transfers, hooks, revisions, certID, force)
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
 	} else {
-		delete(certificates, certID) // remove the certificate from the certificates map
+		change.send()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
 
-		var cert certificate
-		_ = json.NewDecoder(r.Body).Decode(&cert) // Populate cert with the received payload
-		json.NewEncoder(w).Encode(certificates)   // Return a JSON with the current certificates
+// trashCert moves a certificate to the trash on behalf of the user that sent the request, cancelling its transfer
+// when force is set
+func trashCert(r *http.Request, certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore, certID string, force bool) (certChange, error) {
+	cert, ok := liveCert(certificates, certID)
+	if !ok {
+		return certChange{}, newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist. Cannot delete certificate.").with("certId", certID)
+	}
+	if err := authorize(r, actionDeleteCert, target{cert: &cert}); err != nil {
+		return certChange{}, err
 	}
+	if err := checkIfMatch(r, revisions, certID); err != nil {
+		return certChange{}, err
+	}
+
+	var change certChange
+	now := time.Now()
+	if cert.Transfer.state(now) == transferRequested {
+		if !force {
+			return certChange{}, newAPIError(http.StatusConflict, codeTransferInProgress, "Certificate "+certID+" is being transferred to "+cert.Transfer.To+". Cancel the transfer, or pass force=true, to delete it.").with("certId", certID).with("to", cert.Transfer.To)
+		}
+		xfer, err := resolveTransfer(&cert, transferCancelled, now)
+		if err != nil {
+			return certChange{}, err
+		}
+		if err := transfers.PutTransfer(xfer); err != nil {
+			return certChange{}, err
+		}
+		change.messages = transferMessages(users, cert, xfer)
+		change.deliveries = transferDeliveries(hooks, xfer)
+	}
+
+	// The certificate is kept in the trash until it is restored or purged
+	cert.DeletedAt = now.UTC().Format(time.RFC3339Nano)
+	if err := saveCert(certificates, &cert); err != nil {
+		return certChange{}, err
+	}
+	change.cert = cert
+	change.deliveries = append(change.deliveries, newDeliveries(hooks, eventCertDeleted, cert)...)
+	return change, nil
 }
 
-// listCerts lists all certificates held by the user with this id
+// listCerts lists all certificates held by the user with this id, one page at a time
 func listCerts(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userID := params["id"]
 
-	if _, ok := (users[userID]); !ok {
-		http.Error(w, "User ID "+userID+" is invalid. Cannot list certificates.", http.StatusBadRequest)
+	paging, err := parsePageRequest(r, certSortFields...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Collect the certificates held by the user from the certificates store
+	var certs []certificate
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		if _, ok := users.GetUser(userID); !ok {
+			return newAPIError(http.StatusNotFound, codeUserNotFound, "User ID "+userID+" is invalid. Cannot list certificates.").with("userId", userID)
+		}
+		if err := authorize(r, actionListUserCerts, target{userID: userID}); err != nil {
+			return err
+		}
+		for _, cert := range certificates.ListCerts() {
+			if cert.OwnerID == userID && !cert.deleted() {
+				certs = append(certs, cert)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
 	} else {
-		// Copy the certificates held by the user from the certificates map into a new map
-		certs := make(certsMap)
-		for i := range certificates {
-			if certificates[i].OwnerID == userID {
-				certs[i] = certificates[i]
+		json.NewEncoder(w).Encode(paging.paginate(certPageItems(certs, paging.sortBy))) // Return a JSON with the user's certificates
+	}
+}
+
+// getCert returns the certificate with this id
+func getCert(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("asOf") != "" {
+		getCertAsOf(w, r)
+		return
+	}
+	certID := mux.Vars(r)["id"]
+
+	var cert certificate
+	var etag string
+	err := db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var ok bool
+		if cert, ok = liveCert(certificates, certID); !ok {
+			return newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist.").with("certId", certID)
+		}
+		etag = certETag(revisions, certID)
+		return authorize(r, actionReadCert, target{cert: &cert})
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if !notModified(w, r, etag) {
+		json.NewEncoder(w).Encode(cert) // Return a JSON with the certificate
+	}
+}
+
+// certSortFields are the fields certificate listings can be sorted by. The first one is the default
+var certSortFields = []string{"id", "issuedAt", "createdAt", "updatedAt", "year", "title"}
+
+// certFilter selects certificates by owner, year and transfer status. An empty field matches every certificate
+type certFilter struct {
+	ownerID        string
+	year           int
+	transferStatus string // "none" matches certificates that aren't being transferred, "Expired" the ones whose transfer lapsed
+}
+
+// parseCertFilter reads the ownerId, year and transferStatus query parameters
+func parseCertFilter(r *http.Request) (certFilter, error) {
+	query := r.URL.Query()
+	f := certFilter{ownerID: query.Get("ownerId"), transferStatus: query.Get("transferStatus")}
+
+	if year := query.Get("year"); year != "" {
+		var err error
+		if f.year, err = strconv.Atoi(year); err != nil {
+			return f, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Year "+year+" is invalid. Cannot list certificates.").with("parameter", "year")
+		}
+	}
+	return f, nil
+}
+
+// matches checks whether the certificate passes the filter
+func (f certFilter) matches(cert certificate) bool {
+	if cert.deleted() {
+		return false
+	}
+	if f.ownerID != "" && cert.OwnerID != f.ownerID {
+		return false
+	}
+	if f.year != 0 && cert.Year != f.year {
+		return false
+	}
+	switch f.transferStatus {
+	case "":
+		return true
+	case "none":
+		return !cert.Transfer.pending()
+	default:
+		return cert.Transfer.state(time.Now()) == f.transferStatus
+	}
+}
+
+// listAllCerts lists all certificates that pass the filter given in the query parameters, one page at a time
+func listAllCerts(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseCertFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	paging, err := parsePageRequest(r, certSortFields...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var certs []certificate
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		for _, cert := range certificates.ListCerts() {
+			// Only the certificates the user may read are listed
+			if filter.matches(cert) && mayRead(r, cert) {
+				certs = append(certs, cert)
 			}
 		}
-		json.NewEncoder(w).Encode(certs) // Return a JSON with the user's certificates
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+	json.NewEncoder(w).Encode(paging.paginate(certPageItems(certs, paging.sortBy))) // Return a JSON with the matching certificates
 }
 
 //createTransfer creates a certificate transfer action
@@ -148,79 +585,275 @@ func createTransfer(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	certID := params["id"]
 
-	// Workaround that allows us to assign a transfer to an existing certificate in the certificates map
-	cert := certificates[certID]
-	// Make sure that the certificate is not in the process of being transferred
-	if cert.Transfer != (transfer{}) {
-		http.Error(w, "Certificate "+certID+" is already being transferred to "+cert.Transfer.To+".", http.StatusBadRequest)
+	var xfer transfer
+	if err := decodeBody(w, r, &xfer); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateTransfer(xfer); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var change certChange
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var err error
+		change, err = requestCertTransfer(r, certificates, users, transfers, hooks, revisions, certID, xfer)
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
 	} else {
-		_ = json.NewDecoder(r.Body).Decode(&cert.Transfer)
+		change.send()
+		w.Header().Set("ETag", change.etag)
+		json.NewEncoder(w).Encode(change.cert) // Return a JSON with the updated certificate
+	}
+}
 
-		targetIsValid := false
-		for i := range users {
-			if users[i].Email == cert.Transfer.To {
-				targetIsValid = true
-				break
-			}
-		}
+// requestCertTransfer starts a validated transfer of a certificate on behalf of the user that sent the request.
+// The certificate returned holds the claim token of a transfer to an address nobody has registered
+func requestCertTransfer(r *http.Request, certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore, certID string, xfer transfer) (certChange, error) {
+	cert, ok := liveCert(certificates, certID)
+	if !ok {
+		return certChange{}, newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist. Cannot create transfer.").with("certId", certID)
+	}
+	if err := authorize(r, actionCreateTransfer, target{cert: &cert}); err != nil {
+		return certChange{}, err
+	}
+	if err := checkIfMatch(r, revisions, certID); err != nil {
+		return certChange{}, err
+	}
+	// Make sure that the certificate is not in the process of being transferred
+	if cert.Transfer.pending() {
+		return certChange{}, newAPIError(http.StatusConflict, codeTransferInProgress, "Certificate "+certID+" is already being transferred to "+cert.Transfer.To+".").with("certId", certID).with("to", cert.Transfer.To)
+	}
+
+	// A transfer to an address nobody has registered yet is an invitation, which is claimed with a token
+	recipient, registered := userByEmail(users, xfer.To)
 
-		if targetIsValid {
-			// Update the certificates map only if the target user is valid
-			certificates[certID] = cert
-			json.NewEncoder(w).Encode(cert) // Return a JSON with the updated certificate
-		} else {
-			http.Error(w, "Target "+cert.Transfer.To+" isn't valid.", http.StatusBadRequest)
+	// A transfer that lapsed but hasn't been swept yet is recorded as Expired before it is replaced
+	var change certChange
+	now := time.Now()
+	if cert.Transfer.Status == transferRequested {
+		lapsed, err := resolveTransfer(&cert, transferExpired, now)
+		if err != nil {
+			return certChange{}, err
 		}
+		if err := transfers.PutTransfer(lapsed); err != nil {
+			return certChange{}, err
+		}
+		change.messages = transferMessages(users, cert, lapsed)
+		change.deliveries = transferDeliveries(hooks, lapsed)
 	}
+
+	cert.Transfer = requestTransfer(xfer, cert, recipient, now)
+	token := ""
+	if !registered {
+		token = invite(&cert.Transfer)
+	}
+	if err := transfers.PutTransfer(cert.Transfer); err != nil {
+		return certChange{}, err
+	}
+	if err := saveCert(certificates, &cert); err != nil {
+		return certChange{}, err
+	}
+	change.etag = certETag(revisions, certID)
+	change.deliveries = append(change.deliveries, transferDeliveries(hooks, cert.Transfer)...)
+	cert.Transfer.ClaimToken = token // sent back once, and never kept
+	change.messages = append(change.messages, transferMessages(users, cert, cert.Transfer)...)
+	change.cert = cert
+	return change, nil
 }
 
 //acceptTransfer accepts a trasfer of certificate
 func acceptTransfer(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	certID := params["id"]
-
-	if _, ok := (certificates[certID]); !ok {
-		http.Error(w, "Certificate ID "+certID+" doesn't exist. Cannot accept transfer.", http.StatusBadRequest)
-	} else {
-		// Workaround that allows us to assign a transfer to an existing certificate in the certificates map
-		cert := certificates[certID]
-
-		// Make sure that the transfer request is still active
-		if cert.Transfer.Status != "Requested" {
-			http.Error(w, "No transfer has been requested for certificate "+certID+".", http.StatusBadRequest)
-		} else {
-			for i := range users {
-				if users[i].Email == cert.Transfer.To {
-					// Update the certificate's owner
-					cert.OwnerID = users[i].ID
-					// Clear the transfer object, as the transfer is complete
-					cert.Transfer = (transfer{})
-					// Update the global certificates struct
-					certificates[certID] = cert
-				}
-			}
+	// The body is optional, and only carries the claim token of a transfer to an address nobody had registered
+	var req claimRequest
+	if r.ContentLength != 0 {
+		if err := decodeBody(w, r, &req); err != nil {
+			writeError(w, err)
+			return
 		}
 	}
-}
+	if req.ClaimToken != "" {
+		claimTransfer(w, r, req.ClaimToken)
+		return
+	}
 
-// handleRequests handles all HTTP requests
-func handleRequests() {
+	// The whole check-and-transfer sequence runs in a single update, so two concurrent accepts
+	// (or an accept racing a new transfer request) can never both act on the same transfer
+	closeTransfer(w, r, "accept", actionAcceptTransfer, transferAccepted)
+}
 
+// newRouter registers all the supported routes
+func newRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
+	router.NotFoundHandler = http.HandlerFunc(routeNotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	router.Use(requestIDMiddleware, auth.middleware)
 
+	router.HandleFunc("/certificates", listAllCerts).Methods("GET")
+	router.HandleFunc("/certificates", createCert).Methods("POST")
+	router.HandleFunc("/certificates:batch", batchCerts).Methods("POST")
 	router.HandleFunc("/certificates/{id}", createCert).Methods("POST")
+	router.HandleFunc("/certificates/{id}", getCert).Methods("GET")
 	router.HandleFunc("/certificates/{id}", updateCert).Methods("PUT")
+	router.HandleFunc("/certificates/{id}", patchCert).Methods("PATCH")
 	router.HandleFunc("/certificates/{id}", deleteCert).Methods("DELETE")
-
+	router.HandleFunc("/certificates/{id}/restore", restoreCert).Methods("POST")
+	router.HandleFunc("/certificates/{id}/owner", reassignOwner).Methods("POST")
+	router.HandleFunc("/trash", listTrash).Methods("GET")
+	router.HandleFunc("/certificates/{id}/versions", listVersions).Methods("GET")
+	router.HandleFunc("/certificates/{id}/versions/{version}", getVersion).Methods("GET")
+	router.HandleFunc("/certificates/{id}/versions/{version}/diff", diffVersions).Methods("GET")
+
+	router.HandleFunc("/users", listUsers).Methods("GET")
+	router.HandleFunc("/users/{id}", createUser).Methods("POST")
+	router.HandleFunc("/users/{id}", getUser).Methods("GET")
+	router.HandleFunc("/users/{id}", updateUser).Methods("PUT")
+	router.HandleFunc("/users/{id}", deleteUser).Methods("DELETE")
 	router.HandleFunc("/users/{id}/certificates", listCerts).Methods("GET")
+	router.HandleFunc("/users/{id}/transfers", listUserTransfers).Methods("GET")
+	router.HandleFunc("/users/{id}/transfers/pending", listPendingTransfers).Methods("GET")
 
+	router.HandleFunc("/certificates/{id}/transfers", listCertTransfers).Methods("GET")
 	router.HandleFunc("/certificates/{id}/transfers", createTransfer).Methods("POST")
 	router.HandleFunc("/certificates/{id}/transfers", acceptTransfer).Methods("PUT")
+	router.HandleFunc("/certificates/{id}/transfers/accept", acceptTransfer).Methods("POST")
+	router.HandleFunc("/certificates/{id}/transfers/reject", rejectTransfer).Methods("POST")
+	router.HandleFunc("/certificates/{id}/transfers/cancel", cancelTransfer).Methods("POST")
+
+	router.HandleFunc("/webhooks", listWebhooks).Methods("GET")
+	router.HandleFunc("/webhooks", createWebhook).Methods("POST")
+	router.HandleFunc("/webhooks/{id}", getWebhook).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", deleteWebhook).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id}/deliveries", listDeliveries).Methods("GET")
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	router.HandleFunc("/export", exportData).Methods("GET")
+	router.HandleFunc("/import", importData).Methods("POST")
+
+	router.HandleFunc("/audit", listAudit).Methods("GET")
+	router.HandleFunc("/audit/verify", verifyAudit).Methods("GET")
+
+	return router
+}
+
+// handleRequests handles all HTTP requests until the server is sent SIGINT or SIGTERM. It then stops accepting
+// requests, and returns once the requests in progress are answered
+func handleRequests() {
+	server := &http.Server{Addr: ":8080", Handler: newRouter()}
+	stopped := make(chan bool)
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("cannot stop the server cleanly: %v", err)
+		}
+		close(stopped)
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
 
 func main() {
-	certificates = make(certsMap) // Initialise the certificates map
+	storeKind := flag.String("store", "memory", "where to keep certificates and users: memory or file")
+	storePath := flag.String("data", "certificates.db", "path of the database file used by the file store")
+	auditPath := flag.String("audit-log", "audit.log", "path of the audit log kept by the file store")
+	authEnabled := flag.Bool("auth", true, "require every request to carry an API key or a bearer token")
+	apiKeysPath := flag.String("api-keys", "", "JSON file that maps API keys to user IDs")
+	rsaKeyPath := flag.String("jwt-rsa-key", "", "PEM file with the RSA public key RS256 bearer tokens are signed with")
+	adminID := flag.String("admin-id", "admin", "ID of the admin that the API key in ADMIN_API_KEY belongs to, created if it doesn't exist")
+	adminEmail := flag.String("admin-email", "admin@localhost", "e-mail address the admin given with -admin-id is created with")
+	flag.BoolVar(&requireIfMatch, "require-if-match", requireIfMatch, "reject changes to certificates that don't carry an If-Match header")
+	flag.DurationVar(&trashRetention, "trash-retention", trashRetention, "how long a deleted certificate stays in the trash before it is purged, or 0 to keep it")
+	flag.DurationVar(&transferTTL, "transfer-ttl", transferTTL, "how long a transfer may stay pending before it expires, or 0 to never expire")
+	notifyKind := flag.String("notify", "none", "how to e-mail transfer events: none, log or smtp")
+	notifyLogPath := flag.String("notify-log", "", "file the log notifier appends e-mails to, or standard error if empty")
+	smtpAddr := flag.String("smtp-addr", "localhost:25", "host:port of the SMTP server the smtp notifier sends e-mails through")
+	smtpFrom := flag.String("smtp-from", "certificates@localhost", "address the smtp notifier sends e-mails from")
+	webhookAllow := flag.String("webhook-allow", "", "comma-separated networks, such as 10.0.0.0/8, that webhooks may be delivered to although they are internal")
+	flag.Parse()
+
+	// Initialise the authenticator. The HS256 secret is read from the environment, so that it doesn't show up in the process list
+	auth = newAuthenticator(*authEnabled)
+	if secret := os.Getenv("JWT_HMAC_SECRET"); secret != "" {
+		auth.hmacKey = []byte(secret)
+	}
+	if *apiKeysPath != "" {
+		if err := auth.loadAPIKeys(*apiKeysPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *rsaKeyPath != "" {
+		if err := auth.loadRSAKey(*rsaKeyPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Initialise the notifier. The SMTP credentials are read from the environment, like the HS256 secret
+	var notifier Notifier
+	switch *notifyKind {
+	case "none":
+	case "log":
+		w := io.Writer(os.Stderr)
+		if *notifyLogPath != "" {
+			f, err := os.OpenFile(*notifyLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		notifier = newLogNotifier(w)
+	case "smtp":
+		n, err := newSMTPNotifier(*smtpAddr, *smtpFrom, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifier = n
+	default:
+		log.Fatalf("unknown notifier %q", *notifyKind)
+	}
+	if notifier != nil {
+		notifications = newDispatcher(notifier, 2, 1000, 5, time.Second)
+	}
+	allowed, err := parseNetworks(*webhookAllow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhookDeliveries = newWebhookDispatcher(newWebhookClient(10*time.Second, allowed), 4, 1000, 6, time.Second)
+
+	certificates, users, transfers, hooks, revisions, err := openStore(*storeKind, *storePath) // Initialise the certificates, users, transfers, webhooks and revisions stores
+	if err != nil {
+		log.Fatal(err)
+	}
+	audit := newMemoryAuditLog()
+	if *storeKind == "file" {
+		if audit, err = openAuditLog(*auditPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	db = newStore(certificates, users, transfers, hooks, revisions, audit)
+
+	// Let the admin in. The key is read from the environment, like the HS256 secret
+	if key := os.Getenv("ADMIN_API_KEY"); key != "" {
+		if err := auth.bootstrapAdmin(key, user{ID: *adminID, Email: *adminEmail, Name: "Administrator"}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go sweepTransfers(time.Minute)
+	go sweepTrash(time.Hour)
 	handleRequests()
+
+	// The server has stopped: deliver what is still queued, and close the store and the audit log
+	notifications.close()
+	webhookDeliveries.close()
+	if err := db.close(); err != nil {
+		log.Print(err)
+	}
 }
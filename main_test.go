@@ -8,16 +8,15 @@ import (
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"regexp"
 	"testing"
-
-	"github.com/gorilla/mux"
 )
 
 var (
-	cert1        = []byte(`{"id":"1","title":"first cert","createdAt":"29 MAR 2019","ownerId":"10","year":2019,"note":"This is the first certificate","transfer":{"to":"","status":""}}`)
-	cert1Updated = []byte(`{"id":"1","title":"Updated cert","createdAt":"29 MAR 2019","ownerId":"10","year":2019,"note":"This is the updated first certificate","transfer":{"to":"","status":""}}`)
-	cert2        = []byte(`{"id":"2","title":"second cert","createdAt":"29 MAR 2019","ownerId":"10","year":2019,"note":"This is the second certificate","transfer":{"to":"","status":""}}`)
-	cert3        = []byte(`{"id":"3","title":"second cert","createdAt":"29 MAR 2019","ownerId":"11","year":2019,"note":"This is the third certificate","transfer":{"to":"","status":""}}`)
+	cert1        = []byte(`{"id":"1","title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"This is the first certificate","transfer":{"to":"","status":""}}`)
+	cert1Updated = []byte(`{"id":"1","title":"Updated cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"This is the updated first certificate","transfer":{"to":"","status":""}}`)
+	cert2        = []byte(`{"id":"2","title":"second cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"This is the second certificate","transfer":{"to":"","status":""}}`)
+	cert3        = []byte(`{"id":"3","title":"second cert","issuedAt":"2019-03-29","ownerId":"11","year":2019,"note":"This is the third certificate","transfer":{"to":"","status":""}}`)
 )
 
 // IsEqualJSON performs a deep comparison on two JSONs, and returns an error if not equal
@@ -40,25 +39,93 @@ func IsEqualJSON(s1, s2 string) (bool, error) {
 	return reflect.DeepEqual(o1, o2), nil
 }
 
-//executeRequest executes the right method, according to the path string
-func executeRequest(req *http.Request) *httptest.ResponseRecorder {
-	recorder := httptest.NewRecorder()
-	router := mux.NewRouter().StrictSlash(true)
+// withoutServerTimes removes the times the server sets on certificates from a JSON document, so that it can be
+// compared with the certificates that were sent
+func withoutServerTimes(s string) string {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(s), &doc); err != nil {
+		return s
+	}
+	var strip func(v interface{})
+	strip = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			delete(v, "createdAt")
+			delete(v, "updatedAt")
+			for _, member := range v {
+				strip(member)
+			}
+		case []interface{}:
+			for _, item := range v {
+				strip(item)
+			}
+		}
+	}
+	strip(doc)
+	return string(mustMarshal(doc))
+}
+
+// newTestUsers returns the users every test starts with. User 1 is an admin
+func newTestUsers() usersMap {
+	users := make(usersMap)
+	users["1"] = user{"1", "admin@test.com", "Test Admin", "admin"}
+	users["10"] = user{"10", "test10@test.com", "Test User 10", ""}
+	users["11"] = user{"11", "test11@test.com", "Test User 11", ""}
+	users["12"] = user{"12", "test12@test.com", "Test User 12", ""}
+	return users
+}
+
+// testAPIKey returns the API key of a test user
+func testAPIKey(userID string) string {
+	return "test-key-" + userID
+}
 
-	router.HandleFunc("/certificates/{id}", createCert).Methods("POST")
-	router.HandleFunc("/certificates/{id}", updateCert).Methods("PUT")
-	router.HandleFunc("/certificates/{id}", deleteCert).Methods("DELETE")
+// asUser makes the request authenticate as the user with this id
+func asUser(req *http.Request, userID string) *http.Request {
+	req.Header.Set("X-API-Key", testAPIKey(userID))
+	return req
+}
 
-	router.HandleFunc("/users/{id}/certificates", listCerts).Methods("GET")
+//executeRequest executes the right method, according to the path string. Requests without credentials are sent as the admin, user 1
+func executeRequest(req *http.Request) *httptest.ResponseRecorder {
+	if req.Header.Get("X-API-Key") == "" && req.Header.Get("Authorization") == "" {
+		asUser(req, "1")
+	}
+	return executeRawRequest(req)
+}
 
-	router.HandleFunc("/certificates/{id}/transfers", createTransfer).Methods("POST")
-	router.HandleFunc("/certificates/{id}/transfers", acceptTransfer).Methods("PUT")
+// executeRawRequest executes the request with whatever credentials it carries
+func executeRawRequest(req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	router := newRouter()
 
 	router.ServeHTTP(recorder, req)
 
 	return recorder
 }
 
+// withTestStore replaces the global store with a fresh one holding the test users while fn runs
+func withTestStore(fn func()) {
+	saved := db
+	defer func() { db = saved }()
+
+	db = newStore(make(certsMap), newTestUsers(), make(transfersMap), make(webhooksMap), make(revisionsMap), newMemoryAuditLog())
+
+	fn()
+}
+
+// checkErrorResponse verifies that the response is a JSON error with the expected status, code and message
+func checkErrorResponse(t *testing.T, response *httptest.ResponseRecorder, status int, code, message string) {
+	checkResponseCode(t, status, response.Code)
+
+	var e apiError
+	if err := json.Unmarshal(response.Body.Bytes(), &e); err != nil {
+		t.Errorf("\nExpected a JSON error\nGot\t %s", response.Body.String())
+	} else if e.Code != code || e.Message != message {
+		t.Errorf("\nExpected %s: %s\nGot\t %s: %s", code, message, e.Code, e.Message)
+	}
+}
+
 // checkResponseCode verifies that the expected responce code has been received
 func checkResponseCode(t *testing.T, expected, actual int) {
 	if expected != actual {
@@ -69,17 +136,12 @@ func checkResponseCode(t *testing.T, expected, actual int) {
 // TestCreateCertInvalidUser tries to create a certificate for a non-existing user. Verifies that it receives an error JSON
 func TestCreateCertInvalidUser(t *testing.T) {
 
-	cert := []byte(`{"id":"1","title":"Invalid User cert","createdAt":"29 MAR 2019","ownerId":"100","year":2019,"note":"This is a certificate created for an invalid user","transfer":{"to":"","status":""}}`)
+	cert := []byte(`{"id":"1","title":"Invalid User cert","issuedAt":"2019-03-29","ownerId":"100","year":2019,"note":"This is a certificate created for an invalid user","transfer":{"to":"","status":""}}`)
 
 	req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert))
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-
-	expected := "User ID 100 is invalid. Cannot create certificate.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
+	checkErrorResponse(t, response, http.StatusUnprocessableEntity, codeUserInvalid, "User ID 100 is invalid. Cannot create certificate.")
 }
 
 //TestCreate1stCert creates a certificate and checks the returned JSON to verify that it's been added to the certificates map
@@ -90,9 +152,9 @@ func TestCreate1stCert(t *testing.T) {
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
-	expected := `{"1":` + string(cert1) + `}`
+	expected := string(cert1)
 	body := response.Body.String()
-	pass, err := IsEqualJSON(body, expected)
+	pass, err := IsEqualJSON(withoutServerTimes(body), expected)
 
 	if !pass {
 		t.Errorf("\nExpected %s\nGot\t %s", expected, body)
@@ -107,9 +169,9 @@ func TestUpdateCert(t *testing.T) {
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
-	expected := `{"1":` + string(cert1Updated) + `}`
+	expected := string(cert1Updated)
 	body := response.Body.String()
-	pass, err := IsEqualJSON(body, expected)
+	pass, err := IsEqualJSON(withoutServerTimes(body), expected)
 
 	if !pass {
 		t.Errorf("\nExpected %s\nGot\t %s", expected, body)
@@ -119,32 +181,23 @@ func TestUpdateCert(t *testing.T) {
 
 //TestUpdateCertInvalidID requests an update of a certificate with a non-existing ID. It then verifies that the update request has failed
 func TestUpdateCertInvalidID(t *testing.T) {
-	updatedCertInvalidID := []byte(`{"id":"11","title":"Updated cert","createdAt":"29 MAR 2019","ownerId":"10","year":2019,"note":"This is the updated first certificate","transfer":{"to":"","status":""}}`)
+	updatedCertInvalidID := []byte(`{"id":"11","title":"Updated cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"This is the updated first certificate","transfer":{"to":"","status":""}}`)
 
 	req, _ := http.NewRequest("PUT", "http://localhost:8080/certificates/11", bytes.NewBuffer(updatedCertInvalidID))
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-
-	expected := "Certificate ID 11 doesn't exist. Cannot update certificate.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
+	checkErrorResponse(t, response, http.StatusNotFound, codeCertNotFound, "Certificate ID 11 doesn't exist. Cannot update certificate.")
 }
 
-//TestUpdateCertInvalidUserID requests an update of certificate 1 with a non-existing user ID. It then verifies that the update request has failed
+//TestUpdateCertInvalidUserID requests an update of certificate 1 with a different owner. It then verifies that the update request has failed,
+//since owners only change through transfers
 func TestUpdateCertInvalidUserID(t *testing.T) {
-	updatedCertInvalidUserID := []byte(`{"id":"1","title":"Updated cert","createdAt":"29 MAR 2019","ownerId":"100","year":2019,"note":"This is the updated first certificate","transfer":{"to":"","status":""}}`)
+	updatedCertInvalidUserID := []byte(`{"id":"1","title":"Updated cert","issuedAt":"2019-03-29","ownerId":"100","year":2019,"note":"This is the updated first certificate","transfer":{"to":"","status":""}}`)
 
 	req, _ := http.NewRequest("PUT", "http://localhost:8080/certificates/1", bytes.NewBuffer(updatedCertInvalidUserID))
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-
-	expected := "User ID 100 is invalid. Cannot update certificate.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
+	checkErrorResponse(t, response, http.StatusUnprocessableEntity, codeValidationFailed, "Update of certificate 1 is invalid.")
 }
 
 //TestCreate2ndCert is called after TestCreateCert. It creates a second certificate and verifies that it's been added to the certificates map
@@ -155,9 +208,12 @@ func TestCreate2ndCert(t *testing.T) {
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
-	expected := `{"1":` + string(cert1Updated) + `,"2":` + string(cert2) + `}`
+	req, _ = http.NewRequest("GET", "http://localhost:8080/certificates", nil)
+	response = executeRequest(req)
+
+	expected := `{"items":[` + string(cert1Updated) + `,` + string(cert2) + `]}`
 	body := response.Body.String()
-	pass, err := IsEqualJSON(body, expected)
+	pass, err := IsEqualJSON(withoutServerTimes(body), expected)
 
 	if !pass {
 		t.Errorf("\nExpected %s\nGot\t %s", expected, body)
@@ -168,17 +224,12 @@ func TestCreate2ndCert(t *testing.T) {
 //TestCreateCertWithExistingID creates a certificate with an ID that's already been used. Verifies that the certificate hasn't been added to the map
 func TestCreateCertWithExistingID(t *testing.T) {
 
-	cert := []byte(`{"id":"1","title":"Existing ID cert","createdAt":"29 MAR 2019","ownerId":"10","year":2019,"note":"This certificate reuses an existing ID","transfer":{"to":"","status":""}}`)
+	cert := []byte(`{"id":"1","title":"Existing ID cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"This certificate reuses an existing ID","transfer":{"to":"","status":""}}`)
 
 	req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert))
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-
-	expected := "Certificate ID 1 already exists. Cannot create certificate.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
+	checkErrorResponse(t, response, http.StatusConflict, codeCertExists, "Certificate ID 1 already exists. Cannot create certificate.")
 }
 
 //TestDeleteCertInvalidID tries to delete a certificate with a non-existing ID. It then verifies that the delete request has failed
@@ -186,12 +237,7 @@ func TestDeleteCertInvalidID(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", "http://localhost:8080/certificates/11", nil)
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-
-	expected := "Certificate ID 11 doesn't exist. Cannot delete certificate.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
+	checkErrorResponse(t, response, http.StatusNotFound, codeCertNotFound, "Certificate ID 11 doesn't exist. Cannot delete certificate.")
 }
 
 //TestDelete2ndCert send a delete request for the second certificate, and then verifies that it's been deleted from the certificates map
@@ -200,11 +246,14 @@ func TestDelete2ndCert(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", "http://localhost:8080/certificates/2", bytes.NewBuffer(cert2))
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusOK, response.Code)
+	checkResponseCode(t, http.StatusNoContent, response.Code)
 
-	expected := `{"1":` + string(cert1Updated) + `}`
+	req, _ = http.NewRequest("GET", "http://localhost:8080/certificates", nil)
+	response = executeRequest(req)
+
+	expected := `{"items":[` + string(cert1Updated) + `]}`
 	body := response.Body.String()
-	pass, err := IsEqualJSON(body, expected)
+	pass, err := IsEqualJSON(withoutServerTimes(body), expected)
 
 	if !pass {
 		t.Errorf("\nExpected %s\nGot\t %s", expected, body)
@@ -217,11 +266,7 @@ func TestListCertsInvalidUser(t *testing.T) {
 	req, _ := http.NewRequest("GET", "http://localhost:8080/users/100/certificates", nil)
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-	expected := "User ID 100 is invalid. Cannot list certificates.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
+	checkErrorResponse(t, response, http.StatusNotFound, codeUserNotFound, "User ID 100 is invalid. Cannot list certificates.")
 }
 
 //TestListCertsEmptyList requests a list of certificates for a user with no certificates and verifies that it receives an empty list
@@ -231,7 +276,7 @@ func TestListCertsEmptyList(t *testing.T) {
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
-	expected := "{}\n"
+	expected := "{\"items\":[]}\n"
 	if body := response.Body.String(); body != expected {
 		t.Errorf("\nExpected %s\nGot\t %s", expected, body)
 	}
@@ -240,8 +285,8 @@ func TestListCertsEmptyList(t *testing.T) {
 //TestListCertsUser10 requests a list of certificates owned by user 10 and verifies that it receives only the relevant certificates
 func TestListCertsUser10(t *testing.T) {
 
-	// First, add the deleted certificate 2
-	req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/2", bytes.NewBuffer(cert2))
+	// First, restore the deleted certificate 2 from the trash
+	req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/2/restore", nil)
 	executeRequest(req)
 
 	// Now add certificate 3, which is owned by a different user
@@ -255,9 +300,9 @@ func TestListCertsUser10(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, response.Code)
 
 	// Verify that the returned JSON contains only the first two certificates
-	expected := `{"1":` + string(cert1Updated) + `,"2":` + string(cert2) + `}`
+	expected := `{"items":[` + string(cert1Updated) + `,` + string(cert2) + `]}`
 	body := response.Body.String()
-	pass, err := IsEqualJSON(body, expected)
+	pass, err := IsEqualJSON(withoutServerTimes(body), expected)
 
 	if !pass {
 		t.Errorf("\nExpected %s\nGot\t %s", expected, body)
@@ -274,9 +319,18 @@ func TestCreateTransfer(t *testing.T) {
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
-	expected := `{"id":"1","title":"Updated cert","createdAt":"29 MAR 2019","ownerId":"10","year":2019,"note":"This is the updated first certificate","transfer":{"to":"test12@test.com","status":"Requested"}}`
-	body := response.Body.String()
-	pass, err := IsEqualJSON(body, expected)
+	// The server gives the transfer an ID, and stamps it with the time it was requested and the time it expires
+	var cert certificate
+	json.Unmarshal(response.Body.Bytes(), &cert)
+	if cert.Transfer.ID == "" || cert.Transfer.RequestedAt == "" || cert.Transfer.ExpiresAt <= cert.Transfer.RequestedAt {
+		t.Errorf("Expected the transfer to be stamped. Got %v", cert.Transfer)
+	}
+	cert.Transfer.ID, cert.Transfer.RequestedAt, cert.Transfer.ExpiresAt = "", "", ""
+	stamped, _ := json.Marshal(cert)
+
+	expected := `{"id":"1","title":"Updated cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"This is the updated first certificate","transfer":{"certId":"1","fromUserId":"10","toUserId":"12","to":"test12@test.com","status":"Requested"}}`
+	body := string(stamped)
+	pass, err := IsEqualJSON(withoutServerTimes(body), expected)
 
 	if !pass {
 		t.Errorf("\nExpected %s\nGot\t %s", expected, body)
@@ -291,27 +345,7 @@ func TestCreateTransferOnExistingTransfer(t *testing.T) {
 	req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBuffer(xfer))
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-
-	expected := "Certificate 1 is already being transferred to test12@test.com.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
-}
-
-//TestCreateTransferToInvalidUser requests to create a transfer of certificate 1 to a non-existing e-mail, and then verifies it receives an error
-func TestCreateTransferToInvalidUser(t *testing.T) {
-	xfer := []byte(`{"to": "test100@test.com","status": "Requested"}`)
-
-	req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/2/transfers", bytes.NewBuffer(xfer))
-	response := executeRequest(req)
-
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-
-	expected := "Target test100@test.com isn't valid.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
+	checkErrorResponse(t, response, http.StatusConflict, codeTransferInProgress, "Certificate 1 is already being transferred to test12@test.com.")
 }
 
 //TestAcceptNonExistingTransfer requests to accept a transfer that hasn't been created, and then verifies it receives an error
@@ -319,12 +353,7 @@ func TestAcceptNonExistingTransfer(t *testing.T) {
 	req, _ := http.NewRequest("PUT", "http://localhost:8080/certificates/2/transfers", nil)
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-
-	expected := "No transfer has been requested for certificate 2.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
+	checkErrorResponse(t, response, http.StatusConflict, codeNoTransferRequested, "No transfer has been requested for certificate 2.")
 }
 
 //TestAcceptTransferInvalidCert requests to accept a transfer tfor an invalid certificate ID, and then verifies it receives an error
@@ -332,28 +361,23 @@ func TestAcceptTransferInvalidCert(t *testing.T) {
 	req, _ := http.NewRequest("PUT", "http://localhost:8080/certificates/4/transfers", nil)
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusBadRequest, response.Code)
-
-	expected := "Certificate ID 4 doesn't exist. Cannot accept transfer.\n"
-	if body := response.Body.String(); body != expected {
-		t.Errorf("\nExpected %sGot\t %s", expected, body)
-	}
+	checkErrorResponse(t, response, http.StatusNotFound, codeCertNotFound, "Certificate ID 4 doesn't exist. Cannot accept transfer.")
 }
 
 //TestAcceptTransfer accepts the transfer of certificate 1 and then lists the certificates owned by user 12 to verify that the trtansfer has been completed
 func TestAcceptTransfer(t *testing.T) {
 	req, _ := http.NewRequest("PUT", "http://localhost:8080/certificates/1/transfers", nil)
-	response := executeRequest(req)
+	response := executeRequest(asUser(req, "12"))
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
 	req, _ = http.NewRequest("GET", "http://localhost:8080/users/12/certificates", nil)
 	response = executeRequest(req)
 
-	cert1Xferred := []byte(`{"id":"1","title":"Updated cert","createdAt":"29 MAR 2019","ownerId":"12","year":2019,"note":"This is the updated first certificate","transfer":{"to":"","status":""}}`)
-	expected := `{"1":` + string(cert1Xferred) + `}`
+	cert1Xferred := []byte(`{"id":"1","title":"Updated cert","issuedAt":"2019-03-29","ownerId":"12","year":2019,"note":"This is the updated first certificate","transfer":{"to":"","status":""}}`)
+	expected := `{"items":[` + string(cert1Xferred) + `]}`
 	body := response.Body.String()
-	pass, err := IsEqualJSON(body, expected)
+	pass, err := IsEqualJSON(withoutServerTimes(body), expected)
 
 	if !pass {
 		t.Errorf("\nExpected %s\nGot\t %s", expected, body)
@@ -361,15 +385,133 @@ func TestAcceptTransfer(t *testing.T) {
 	}
 }
 
+// TestGetCert reads an existing certificate, and verifies that reading an unknown certificate returns 404
+func TestGetCert(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		executeRequest(req)
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if pass, _ := IsEqualJSON(withoutServerTimes(response.Body.String()), string(cert1)); !pass {
+			t.Errorf("\nExpected %s\nGot\t %s", cert1, response.Body.String())
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/4", nil)
+		response = executeRequest(req)
+		checkErrorResponse(t, response, http.StatusNotFound, codeCertNotFound, "Certificate ID 4 doesn't exist.")
+	})
+}
+
+// TestListAllCerts lists all certificates with and without filters
+func TestListAllCerts(t *testing.T) {
+	withTestStore(func() {
+		cert4 := []byte(`{"id":"4","title":"fourth cert","issuedAt":"2018-01-01","ownerId":"10","year":2018,"note":"This is the fourth certificate","transfer":{"to":"","status":""}}`)
+		for id, cert := range map[string][]byte{"1": cert1, "3": cert3, "4": cert4} {
+			req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/"+id, bytes.NewBuffer(cert))
+			executeRequest(req)
+		}
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBuffer([]byte(`{"to":"test12@test.com","status":"Requested"}`)))
+		response := executeRequest(req)
+		cert1Requested := response.Body.String()
+
+		tests := []struct {
+			query, expected string
+		}{
+			{"", `{"items":[` + cert1Requested + `,` + string(cert3) + `,` + string(cert4) + `]}`},
+			{"?ownerId=10", `{"items":[` + cert1Requested + `,` + string(cert4) + `]}`},
+			{"?year=2019", `{"items":[` + cert1Requested + `,` + string(cert3) + `]}`},
+			{"?ownerId=10&year=2018", `{"items":[` + string(cert4) + `]}`},
+			{"?transferStatus=Requested", `{"items":[` + cert1Requested + `]}`},
+			{"?transferStatus=none", `{"items":[` + string(cert3) + `,` + string(cert4) + `]}`},
+			{"?ownerId=12", `{"items":[]}`},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest("GET", "http://localhost:8080/certificates"+test.query, nil)
+			response := executeRequest(req)
+			checkResponseCode(t, http.StatusOK, response.Code)
+			if pass, _ := IsEqualJSON(withoutServerTimes(response.Body.String()), withoutServerTimes(test.expected)); !pass {
+				t.Errorf("%s:\nExpected %s\nGot\t %s", test.query, test.expected, response.Body.String())
+			}
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates?year=last", nil)
+		response = executeRequest(req)
+		checkErrorResponse(t, response, http.StatusBadRequest, codeInvalidParameter, "Year last is invalid. Cannot list certificates.")
+	})
+}
+
+// TestPathIDIsAuthoritative verifies that a body cannot name a different certificate than the path, and that the body may omit the ID
+func TestPathIDIsAuthoritative(t *testing.T) {
+	withTestStore(func() {
+		for _, id := range []string{"1", "2"} {
+			req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/"+id, bytes.NewBufferString(`{"title":"cert `+id+`","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+			checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		}
+
+		req, _ := http.NewRequest("PUT", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"id":"2","title":"hijacked","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		checkErrorResponse(t, executeRequest(req), http.StatusUnprocessableEntity, codeCertIDMismatch, "Certificate ID 2 doesn't match the requested certificate ID 1.")
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/3", bytes.NewBufferString(`{"id":"4","title":"cert 4","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		checkErrorResponse(t, executeRequest(req), http.StatusUnprocessableEntity, codeCertIDMismatch, "Certificate ID 4 doesn't match the requested certificate ID 3.")
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/2", nil)
+		var cert certificate
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &cert)
+		if cert.ID != "2" || cert.Title != "cert 2" {
+			t.Errorf("Expected certificate 2 to be left alone. Got %v", cert)
+		}
+	})
+}
+
+// TestCreateCertWithGeneratedID creates certificates without naming them, and verifies that each gets a new UUID
+func TestCreateCertWithGeneratedID(t *testing.T) {
+	withTestStore(func() {
+		uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+		seen := make(map[string]bool)
+
+		for i := 0; i < 3; i++ {
+			req, _ := http.NewRequest("POST", "http://localhost:8080/certificates", bytes.NewBufferString(`{"title":"unnamed cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+			response := executeRequest(req)
+			checkResponseCode(t, http.StatusCreated, response.Code)
+
+			var cert certificate
+			json.Unmarshal(response.Body.Bytes(), &cert)
+			if !uuid.MatchString(cert.ID) || seen[cert.ID] {
+				t.Errorf("Expected a new UUID. Got %q", cert.ID)
+			}
+			seen[cert.ID] = true
+			if location := response.Header().Get("Location"); location != "/certificates/"+cert.ID {
+				t.Errorf("Expected the certificate's location. Got %q", location)
+			}
+
+			req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/"+cert.ID, nil)
+			checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		}
+
+		// A client may still choose the ID in the body
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates", bytes.NewBuffer(cert1))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+		if location := response.Header().Get("Location"); location != "/certificates/1" {
+			t.Errorf("Expected the location of certificate 1. Got %q", location)
+		}
+	})
+}
+
 func TestMain(m *testing.M) {
-	certificates = make(certsMap) // Initialise the certificates map
-	users = make(usersMap)        // Initiatialise the users map
+	certificates := make(certsMap) // Initialise the certificates map
 
 	/* Create some test users data */
-	users = make(usersMap) // Initiatialise the users map
-	users["10"] = user{"10", "test10@test.com", "Test User 10"}
-	users["11"] = user{"11", "test11@test.com", "Test User 11"}
-	users["12"] = user{"12", "test12@test.com", "Test User 12"}
+	users := newTestUsers() // Initiatialise the users map
+
+	db = newStore(certificates, users, make(transfersMap), make(webhooksMap), make(revisionsMap), newMemoryAuditLog())
+
+	auth = newAuthenticator(true)
+	for id := range users {
+		auth.addAPIKey(testAPIKey(id), id)
+	}
 
 	// run tests
 	os.Exit(m.Run())
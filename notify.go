@@ -0,0 +1,298 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// message is an e-mail, with a plain-text and an HTML version of its body
+type message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+}
+
+// Notifier is implemented by every way of delivering e-mails. Notify may fail, in which case the message is retried
+type Notifier interface {
+	Notify(m message) error
+}
+
+// smtpNotifier sends e-mails through an SMTP server
+type smtpNotifier struct {
+	addr string // host:port of the server
+	from string
+	auth smtp.Auth // nil when the server doesn't require authentication
+}
+
+// newSMTPNotifier returns a notifier that sends e-mails from this address through the server at addr.
+// A username turns on PLAIN authentication
+func newSMTPNotifier(addr, from, username, password string) (*smtpNotifier, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %s: %v", addr, err)
+	}
+	n := &smtpNotifier{addr: addr, from: from}
+	if username != "" {
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n, nil
+}
+
+// Notify sends the message as a multipart/alternative e-mail
+func (n *smtpNotifier) Notify(m message) error {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=%s\r\n\r\n",
+		n.from, m.To, mime.QEncoding.Encode("utf-8", m.Subject), parts.Boundary())
+	for _, part := range []struct{ contentType, content string }{{"text/plain", m.Text}, {"text/html", m.HTML}} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType + "; charset=utf-8"}})
+		if err != nil {
+			return err
+		}
+		io.WriteString(w, part.content)
+	}
+	if err := parts.Close(); err != nil {
+		return err
+	}
+	return smtp.SendMail(n.addr, n.auth, n.from, []string{m.To}, body.Bytes())
+}
+
+// logNotifier writes every e-mail as a line of JSON instead of sending it. It is meant for development and tests
+type logNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newLogNotifier returns a notifier that writes e-mails to w
+func newLogNotifier(w io.Writer) *logNotifier {
+	return &logNotifier{w: w}
+}
+
+// Notify writes the message
+func (n *logNotifier) Notify(m message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err = n.w.Write(append(data, '\n'))
+	return err
+}
+
+// dispatcher delivers e-mails in the background, so that handlers never wait for a notifier.
+// A message that fails is retried with an increasing delay, and dropped after the last attempt
+type dispatcher struct {
+	notifier Notifier
+	attempts int
+	backoff  time.Duration // delay before the first retry. It doubles after every attempt
+
+	mu       sync.Mutex
+	queue    chan message
+	closed   bool
+	wg       sync.WaitGroup // workers
+	inflight sync.WaitGroup // messages that are neither delivered nor dropped
+}
+
+// notifications delivers the e-mails sent on transfer events. It is nil when notifications are turned off
+var notifications *dispatcher
+
+// newDispatcher starts workers that deliver up to queueSize queued messages through the notifier
+func newDispatcher(notifier Notifier, workers, queueSize, attempts int, backoff time.Duration) *dispatcher {
+	d := &dispatcher{notifier: notifier, attempts: attempts, backoff: backoff, queue: make(chan message, queueSize)}
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	return d
+}
+
+// work makes the first attempt of queued messages until the dispatcher is closed
+func (d *dispatcher) work() {
+	defer d.wg.Done()
+	for m := range d.queue {
+		d.attempt(m, 1)
+	}
+}
+
+// attempt makes the nth attempt at delivering the message, and schedules the next one if it failed,
+// so that a retry never holds up a worker while it waits
+func (d *dispatcher) attempt(m message, n int) {
+	err := d.notifier.Notify(m)
+	if err != nil && n < d.attempts {
+		time.AfterFunc(d.backoff<<uint(n-1), func() { d.attempt(m, n+1) })
+		return
+	}
+	if err != nil {
+		log.Printf("cannot notify %s of %q after %d attempts: %v", m.To, m.Subject, n, err)
+	}
+	d.inflight.Done()
+}
+
+// send queues the messages. It never blocks: when the queue is full, the message is dropped
+func (d *dispatcher) send(messages ...message) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range messages {
+		if d.closed {
+			return
+		}
+		d.inflight.Add(1)
+		select {
+		case d.queue <- m:
+		default:
+			log.Printf("notification queue is full. Dropping %q to %s", m.Subject, m.To)
+			d.inflight.Done()
+		}
+	}
+}
+
+// close stops accepting messages, and waits until the queued ones are delivered or dropped
+func (d *dispatcher) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+	d.inflight.Wait()
+}
+
+// transferTemplate holds the subject and the bodies of the e-mail sent on a transfer event
+type transferTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// newTransferTemplate parses the templates of an e-mail. They are executed with a transferNotice
+func newTransferTemplate(subject, text, html string) transferTemplate {
+	return transferTemplate{
+		subject: texttemplate.Must(texttemplate.New("subject").Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New("text").Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New("html").Parse(html)),
+	}
+}
+
+// transferTemplates holds the e-mail sent on every transfer event, keyed by the status the transfer moved to
+var transferTemplates = map[string]transferTemplate{
+	transferRequested: newTransferTemplate(
+		`{{.Owner}} wants to transfer "{{.Cert.Title}}" to you`,
+		"{{.Owner}} wants to transfer the certificate \"{{.Cert.Title}}\" ({{.Cert.ID}}) to you.\n"+
+			"{{if .ClaimToken}}To claim it, register with this address, or accept the transfer with the claim token {{.ClaimToken}}\n"+
+			"{{else}}Accept or reject the transfer of certificate {{.Cert.ID}}.\n{{end}}"+
+			"{{if .Transfer.ExpiresAt}}The transfer expires at {{.Transfer.ExpiresAt}}.\n{{end}}",
+		`<p>{{.Owner}} wants to transfer the certificate <b>{{.Cert.Title}}</b> ({{.Cert.ID}}) to you.</p>`+
+			`{{if .ClaimToken}}<p>To claim it, register with this address, or accept the transfer with the claim token <code>{{.ClaimToken}}</code></p>`+
+			`{{else}}<p>Accept or reject the transfer of certificate {{.Cert.ID}}.</p>{{end}}`+
+			`{{if .Transfer.ExpiresAt}}<p>The transfer expires at {{.Transfer.ExpiresAt}}.</p>{{end}}`),
+	transferAccepted: newTransferTemplate(
+		`"{{.Cert.Title}}" was transferred to {{.Transfer.To}}`,
+		"{{.Transfer.To}} accepted the transfer of the certificate \"{{.Cert.Title}}\" ({{.Cert.ID}}), and now owns it.\n",
+		`<p>{{.Transfer.To}} accepted the transfer of the certificate <b>{{.Cert.Title}}</b> ({{.Cert.ID}}), and now owns it.</p>`),
+	transferRejected: newTransferTemplate(
+		`{{.Transfer.To}} rejected "{{.Cert.Title}}"`,
+		"{{.Transfer.To}} rejected the transfer of the certificate \"{{.Cert.Title}}\" ({{.Cert.ID}}). You still own it.\n",
+		`<p>{{.Transfer.To}} rejected the transfer of the certificate <b>{{.Cert.Title}}</b> ({{.Cert.ID}}). You still own it.</p>`),
+	transferCancelled: newTransferTemplate(
+		`The transfer of "{{.Cert.Title}}" was cancelled`,
+		"{{.Owner}} cancelled the transfer of the certificate \"{{.Cert.Title}}\" ({{.Cert.ID}}) to you.\n",
+		`<p>{{.Owner}} cancelled the transfer of the certificate <b>{{.Cert.Title}}</b> ({{.Cert.ID}}) to you.</p>`),
+	transferExpired: newTransferTemplate(
+		`The transfer of "{{.Cert.Title}}" expired`,
+		"The transfer of the certificate \"{{.Cert.Title}}\" ({{.Cert.ID}}) to {{.Transfer.To}} expired at {{.Transfer.ExpiresAt}}.\n",
+		`<p>The transfer of the certificate <b>{{.Cert.Title}}</b> ({{.Cert.ID}}) to {{.Transfer.To}} expired at {{.Transfer.ExpiresAt}}.</p>`),
+}
+
+// transferNotice is what the templates of a transfer e-mail are executed with
+type transferNotice struct {
+	Cert       certificate
+	Transfer   transfer
+	Owner      string // name, or e-mail address, of the user that requested the transfer
+	ClaimToken string // set only on the invitation to an address nobody has registered
+}
+
+// transferMessages renders the e-mails sent when the transfer of the certificate moves to its current status.
+// The owner hears about answers and expiries, and the recipient about requests, cancellations and expiries.
+// A template that fails is logged, and never fails the change that is being notified
+func transferMessages(users UserStore, cert certificate, xfer transfer) []message {
+	tmpl, ok := transferTemplates[xfer.Status]
+	if !ok {
+		return nil
+	}
+
+	notice := transferNotice{Cert: cert, Transfer: xfer, Owner: xfer.FromUserID, ClaimToken: xfer.ClaimToken}
+	var to []string
+	owner, known := users.GetUser(xfer.FromUserID)
+	if known {
+		notice.Owner = owner.Email
+		if owner.Name != "" {
+			notice.Owner = owner.Name
+		}
+	}
+	switch xfer.Status {
+	case transferRequested, transferCancelled:
+		to = append(to, xfer.To)
+	case transferAccepted, transferRejected:
+		if known {
+			to = append(to, owner.Email)
+		}
+	case transferExpired:
+		to = append(to, xfer.To)
+		if known {
+			to = append(to, owner.Email)
+		}
+	}
+
+	var subject, text, html bytes.Buffer
+	err := tmpl.subject.Execute(&subject, notice)
+	if err == nil {
+		err = tmpl.text.Execute(&text, notice)
+	}
+	if err == nil {
+		err = tmpl.html.Execute(&html, notice)
+	}
+	if err != nil {
+		log.Printf("cannot render the %s e-mail of transfer %s: %v", xfer.Status, xfer.ID, err)
+		return nil
+	}
+
+	messages := make([]message, 0, len(to))
+	for _, addr := range to {
+		messages = append(messages, message{To: addr, Subject: subject.String(), Text: text.String(), HTML: html.String()})
+	}
+	return messages
+}
+
+// closedTransferMessages renders the e-mails of transfers that ended, whose certificates are looked up in the store
+func closedTransferMessages(certificates CertificateStore, users UserStore, xfers []transfer) []message {
+	var messages []message
+	for _, xfer := range xfers {
+		if cert, ok := certificates.GetCert(xfer.CertID); ok {
+			messages = append(messages, transferMessages(users, cert, xfer)...)
+		}
+	}
+	return messages
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withNotifications runs fn with a dispatcher that logs e-mails, and returns the e-mails that were sent
+func withNotifications(fn func()) []message {
+	var buf bytes.Buffer
+	saved := notifications
+	notifications = newDispatcher(newLogNotifier(&buf), 1, 100, 3, time.Millisecond)
+	fn()
+	notifications.close()
+	notifications = saved
+
+	var messages []message
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var m message
+		decoder.Decode(&m)
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// flakyNotifier fails the first failures calls, and records the messages it delivers after that
+type flakyNotifier struct {
+	mu        sync.Mutex
+	failures  int
+	calls     int
+	delivered []message
+}
+
+func (n *flakyNotifier) Notify(m message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls++
+	if n.calls <= n.failures {
+		return errors.New("server unavailable")
+	}
+	n.delivered = append(n.delivered, m)
+	return nil
+}
+
+// TestDispatcherRetries verifies that a message is retried until it is delivered, and dropped after the last attempt
+func TestDispatcherRetries(t *testing.T) {
+	tests := []struct {
+		failures, calls, delivered int
+	}{
+		{0, 1, 1},
+		{2, 3, 1},
+		{5, 3, 0},
+	}
+	for _, test := range tests {
+		n := &flakyNotifier{failures: test.failures}
+		d := newDispatcher(n, 1, 10, 3, time.Millisecond)
+		d.send(message{To: "test12@test.com", Subject: "hello"})
+		d.close()
+
+		if n.calls != test.calls || len(n.delivered) != test.delivered {
+			t.Errorf("%d failures: expected %d calls and %d deliveries. Got %d and %d", test.failures, test.calls, test.delivered, n.calls, len(n.delivered))
+		}
+	}
+}
+
+// TestDispatcherRetryDoesNotBlock fails a message on the only worker, and verifies that the next message is delivered
+// while the first one waits for its retry
+func TestDispatcherRetryDoesNotBlock(t *testing.T) {
+	n := &flakyNotifier{failures: 1}
+	d := newDispatcher(n, 1, 10, 2, time.Second)
+	d.send(message{To: "a@test.com"}, message{To: "b@test.com"})
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for {
+		n.mu.Lock()
+		delivered := len(n.delivered)
+		n.mu.Unlock()
+		if delivered == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the second message to be delivered while the first one waits to be retried")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.close()
+	if len(n.delivered) != 2 {
+		t.Errorf("Expected both messages to be delivered. Got %v", n.delivered)
+	}
+}
+
+// TestDispatcherNeverBlocks fills the queue of a dispatcher that has no workers, and verifies that sending still returns
+func TestDispatcherNeverBlocks(t *testing.T) {
+	d := newDispatcher(&flakyNotifier{}, 0, 1, 1, time.Millisecond)
+	done := make(chan bool)
+	go func() {
+		d.send(message{To: "a@test.com"}, message{To: "b@test.com"}, message{To: "c@test.com"})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("send blocked on a full queue")
+	}
+	d.wg.Add(1)
+	go d.work() // so that the queued message is delivered, and close returns
+	d.close()
+	d.send(message{To: "d@test.com"}) // sending after close is ignored
+}
+
+// TestTransferNotifications runs transfers through their events, and verifies who is e-mailed about what
+func TestTransferNotifications(t *testing.T) {
+	messages := withNotifications(func() {
+		withTestStore(func() {
+			steps := []struct {
+				method, path, body, userID string
+			}{
+				{"POST", "/certificates/1", `{"title":"<b>first</b> cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`, "10"},
+				{"POST", "/certificates/1/transfers", `{"to":"test12@test.com"}`, "10"},
+				{"POST", "/certificates/1/transfers/reject", ``, "12"},
+				{"POST", "/certificates/1/transfers", `{"to":"test11@test.com"}`, "10"},
+				{"POST", "/certificates/1/transfers/cancel", ``, "10"},
+				{"POST", "/certificates/1/transfers", `{"to":"test12@test.com"}`, "10"},
+				{"POST", "/certificates/1/transfers/accept", ``, "12"},
+			}
+			for _, step := range steps {
+				req, _ := http.NewRequest(step.method, "http://localhost:8080"+step.path, bytes.NewBufferString(step.body))
+				checkResponseCode(t, http.StatusOK, executeRequest(asUser(req, step.userID)).Code)
+			}
+		})
+	})
+
+	expected := []struct{ to, subject string }{
+		{"test12@test.com", `Test User 10 wants to transfer "<b>first</b> cert" to you`},
+		{"test10@test.com", `test12@test.com rejected "<b>first</b> cert"`},
+		{"test11@test.com", `Test User 10 wants to transfer "<b>first</b> cert" to you`},
+		{"test11@test.com", `The transfer of "<b>first</b> cert" was cancelled`},
+		{"test12@test.com", `Test User 10 wants to transfer "<b>first</b> cert" to you`},
+		{"test10@test.com", `"<b>first</b> cert" was transferred to test12@test.com`},
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d e-mails. Got %v", len(expected), messages)
+	}
+	for i, m := range messages {
+		if m.To != expected[i].to || m.Subject != expected[i].subject {
+			t.Errorf("E-mail %d: expected %q to %s. Got %q to %s", i, expected[i].subject, expected[i].to, m.Subject, m.To)
+		}
+		if !strings.Contains(m.Text, "<b>first</b> cert") || !strings.Contains(m.HTML, "&lt;b&gt;first&lt;/b&gt; cert") {
+			t.Errorf("E-mail %d: expected the title as is in the text and escaped in the HTML. Got %q and %q", i, m.Text, m.HTML)
+		}
+	}
+}
+
+// TestInvitationNotification verifies that the claim token of an invitation is e-mailed to the invited address,
+// and that the owner hears when the invitation expires
+func TestInvitationNotification(t *testing.T) {
+	var token string
+	messages := withNotifications(func() {
+		withInvitation(t, func(claimToken string) {
+			token = claimToken
+			expireTransferOf("1")
+
+			// Sweep once, as sweepTransfers does on every tick
+			var messages []message
+			db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+				expired, err := expireTransfers(certificates, transfers, time.Now())
+				messages = closedTransferMessages(certificates, users, expired)
+				return err
+			})
+			notifications.send(messages...)
+		})
+	})
+
+	if len(messages) != 3 {
+		t.Fatalf("Expected an invitation and two expiry e-mails. Got %v", messages)
+	}
+	if messages[0].To != "new@test.com" || !strings.Contains(messages[0].Text, token) || !strings.Contains(messages[0].HTML, token) {
+		t.Errorf("Expected the invitation to carry the claim token. Got %v", messages[0])
+	}
+	recipients := map[string]bool{messages[1].To: true, messages[2].To: true}
+	if !recipients["new@test.com"] || !recipients["test10@test.com"] || !strings.Contains(messages[1].Subject, "expired") {
+		t.Errorf("Expected the owner and the invited address to hear about the expiry. Got %v", messages[1:])
+	}
+}
+
+// TestSMTPNotifier sends an e-mail to a minimal SMTP server, and verifies the envelope and the MIME parts it receives
+func TestSMTPNotifier(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var rcpt, data string
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(command, "RCPT TO:"):
+				rcpt = strings.TrimSpace(line[len("RCPT TO:"):])
+				reply("250 OK")
+			case command == "DATA":
+				reply("354 Go ahead")
+				var body strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					body.WriteString(line)
+				}
+				data = body.String()
+				reply("250 OK")
+			case command == "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	n, err := newSMTPNotifier(listener.Addr().String(), "certificates@test.com", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := message{To: "test12@test.com", Subject: "A certificate for you", Text: "plain body", HTML: "<p>html body</p>"}
+	if err := n.Notify(m); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if rcpt != "<test12@test.com>" {
+		t.Errorf("Expected the e-mail to be sent to test12@test.com. Got %s", rcpt)
+	}
+	for _, part := range []string{"Subject: A certificate for you", "multipart/alternative", "text/plain", "plain body", "text/html", "<p>html body</p>"} {
+		if !strings.Contains(data, part) {
+			t.Errorf("Expected the e-mail to hold %q. Got %s", part, data)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// reassignRequest is the body of a request to give a certificate to another user outside the transfer workflow
+type reassignRequest struct {
+	OwnerID string `json:"ownerId"`
+	Reason  string `json:"reason"`
+}
+
+// keepServerFields checks that an update of a certificate leaves its owner and its transfer as they are, and carries
+// over what the client cannot see of the transfer. An update that leaves the transfer out keeps it
+func keepServerFields(current certificate, cert *certificate) error {
+	f := make(fieldErrors)
+	if cert.OwnerID != current.OwnerID {
+		f["ownerId"] = immutableFields["ownerId"]
+	}
+	if cert.Transfer != (transfer{}) && string(mustMarshal(cert.Transfer)) != string(mustMarshal(current.Transfer)) {
+		f["transfer"] = immutableFields["transfer"]
+	}
+	if err := f.err("Update of certificate " + current.ID); err != nil {
+		return err
+	}
+	cert.Transfer = current.Transfer
+	return nil
+}
+
+// reassignOwner gives a certificate to another user without a transfer. Only admins may do so, and the reason
+// they give is recorded in the audit log
+func reassignOwner(w http.ResponseWriter, r *http.Request) {
+	certID := mux.Vars(r)["id"]
+
+	var req reassignRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateReassign(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var cert certificate
+	var etag string
+	var deliveries []*delivery
+	err := db.updateFor(r, req.Reason, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var ok bool
+		if cert, ok = liveCert(certificates, certID); !ok {
+			return newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist. Cannot reassign certificate.").with("certId", certID)
+		}
+		if err := authorize(r, actionReassignCert, target{cert: &cert}); err != nil {
+			return err
+		}
+		if err := checkIfMatch(r, revisions, certID); err != nil {
+			return err
+		}
+		if cert.Transfer.pending() {
+			return newAPIError(http.StatusConflict, codeTransferInProgress, "Certificate "+certID+" is being transferred to "+cert.Transfer.To+". Cancel the transfer before reassigning it.").with("certId", certID).with("to", cert.Transfer.To)
+		}
+		if _, ok := users.GetUser(req.OwnerID); !ok {
+			return newAPIError(http.StatusUnprocessableEntity, codeUserInvalid, "User ID "+req.OwnerID+" is invalid. Cannot reassign certificate.").with("userId", req.OwnerID)
+		}
+		if req.OwnerID == cert.OwnerID {
+			return fieldErrors{"ownerId": "already owns the certificate"}.err("Reassignment of certificate " + certID)
+		}
+
+		cert.OwnerID = req.OwnerID
+		if err := saveCert(certificates, &cert); err != nil {
+			return err
+		}
+		etag = certETag(revisions, certID)
+		deliveries = newDeliveries(hooks, eventCertUpdated, cert)
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		webhookDeliveries.send(deliveries...)
+		w.Header().Set("ETag", etag)
+		json.NewEncoder(w).Encode(cert) // Return a JSON with the reassigned certificate
+	}
+}
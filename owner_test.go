@@ -0,0 +1,94 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+// TestUpdateCannotChangeOwnership verifies that an update cannot change the owner or fake a transfer,
+// and that an update that leaves the transfer out keeps it
+func TestUpdateCannotChangeOwnership(t *testing.T) {
+	withPendingTransfer(func() {
+		tests := []struct {
+			body, field string
+		}{
+			{`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"11","year":2019}`, "ownerId"},
+			{`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"transfer":{"to":"test11@test.com","status":"Requested"}}`, "transfer"},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest("PUT", "http://localhost:8080/certificates/1", bytes.NewBufferString(test.body))
+			response := executeRequest(req)
+			checkErrorResponse(t, response, http.StatusUnprocessableEntity, codeValidationFailed, "Update of certificate 1 is invalid.")
+			if !bytes.Contains(response.Body.Bytes(), []byte(`"`+test.field+`"`)) {
+				t.Errorf("Expected a problem with %s. Got %s", test.field, response.Body.String())
+			}
+		}
+
+		req, _ := http.NewRequest("PUT", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"renamed cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			if cert, _ := certificates.GetCert("1"); cert.Title != "renamed cert" || !cert.Transfer.pending() || cert.Transfer.ToUserID != "12" {
+				t.Errorf("Expected the renamed certificate to still be transferred to user 12. Got %+v", cert)
+			}
+			return nil
+		})
+	})
+}
+
+// TestCreateCertWithTransfer verifies that a certificate cannot be created with a transfer
+func TestCreateCertWithTransfer(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"transfer":{"to":"test12@test.com","status":"Requested"}}`))
+		checkErrorResponse(t, executeRequest(req), http.StatusUnprocessableEntity, codeValidationFailed, "Certificate 1 is invalid.")
+	})
+}
+
+// TestReassignOwner reassigns a certificate as an admin, and verifies that the reason is recorded in the audit log
+func TestReassignOwner(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/owner", bytes.NewBufferString(`{"ownerId":"11","reason":"the owner passed away"}`))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if !bytes.Contains(response.Body.Bytes(), []byte(`"ownerId":"11"`)) || response.Header().Get("ETag") != `"2"` {
+			t.Errorf("Expected certificate 1 to be owned by user 11. Got %s", response.Body.String())
+		}
+
+		entries := listAuditEntries(t, "certId=1")
+		if last := entries[len(entries)-1]; last.Reason != "the owner passed away" || last.ActorID != "1" {
+			t.Errorf("Expected the reassignment to be recorded with its reason. Got %+v", last)
+		}
+		if first := entries[0]; first.Reason != "" {
+			t.Errorf("Expected the creation to have no reason. Got %q", first.Reason)
+		}
+	})
+}
+
+// TestReassignOwnerErrors verifies that reassignments without a reason, to an unknown user or the current owner,
+// or of a certificate that is being transferred are rejected
+func TestReassignOwnerErrors(t *testing.T) {
+	withPendingTransfer(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/2", bytes.NewBuffer(cert2))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+		tests := []struct {
+			path, body string
+			status     int
+			code, msg  string
+		}{
+			{"/certificates/2/owner", `{"ownerId":"11"}`, http.StatusUnprocessableEntity, codeValidationFailed, "Reassignment is invalid."},
+			{"/certificates/2/owner", `{"ownerId":"100","reason":"typo"}`, http.StatusUnprocessableEntity, codeUserInvalid, "User ID 100 is invalid. Cannot reassign certificate."},
+			{"/certificates/2/owner", `{"ownerId":"10","reason":"typo"}`, http.StatusUnprocessableEntity, codeValidationFailed, "Reassignment of certificate 2 is invalid."},
+			{"/certificates/1/owner", `{"ownerId":"11","reason":"typo"}`, http.StatusConflict, codeTransferInProgress, "Certificate 1 is being transferred to test12@test.com. Cancel the transfer before reassigning it."},
+			{"/certificates/9/owner", `{"ownerId":"11","reason":"typo"}`, http.StatusNotFound, codeCertNotFound, "Certificate ID 9 doesn't exist. Cannot reassign certificate."},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest("POST", "http://localhost:8080"+test.path, bytes.NewBufferString(test.body))
+			checkErrorResponse(t, executeRequest(req), test.status, test.code, test.msg)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 1000
+)
+
+// page is the envelope of every listing. NextCursor is empty on the last page
+type page struct {
+	Items      []interface{} `json:"items"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+// pageRequest holds the limit, cursor, sort and order query parameters of a listing
+type pageRequest struct {
+	limit      int
+	sortBy     string
+	descending bool
+	after      *cursor
+}
+
+// cursor marks the last item of the previous page. It is sent to the client as an opaque base64 string
+type cursor struct {
+	SortBy string `json:"s"`
+	Key    string `json:"k"`
+	ID     string `json:"id"`
+}
+
+// pageItem is a listed item together with the key it is sorted by. Items with the same key are sorted by ID,
+// so that the order is always the same no matter in which order the store returns them
+type pageItem struct {
+	key   string
+	id    string
+	value interface{}
+}
+
+// parsePageRequest reads the paging query parameters. sortFields lists the fields the listing can be sorted by;
+// the first one is the default
+func parsePageRequest(r *http.Request, sortFields ...string) (pageRequest, error) {
+	query := r.URL.Query()
+	p := pageRequest{limit: defaultPageLimit, sortBy: sortFields[0]}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return p, newAPIError(http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("Limit %s is invalid. It must be between 1 and %d.", limit, maxPageLimit)).with("parameter", "limit")
+		}
+		p.limit = n
+	}
+
+	if sortBy := query.Get("sort"); sortBy != "" {
+		valid := false
+		for _, field := range sortFields {
+			if sortBy == field {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return p, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Cannot sort by "+sortBy+".").with("parameter", "sort").with("allowed", sortFields)
+		}
+		p.sortBy = sortBy
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		p.descending = true
+	default:
+		return p, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Order "+order+" is invalid. It must be asc or desc.").with("parameter", "order")
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		p.after = new(cursor)
+		data, err := base64.RawURLEncoding.DecodeString(c)
+		if err == nil {
+			err = json.Unmarshal(data, p.after)
+		}
+		if err != nil || p.after.SortBy != p.sortBy {
+			return p, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Cursor "+c+" is invalid.").with("parameter", "cursor")
+		}
+	}
+	return p, nil
+}
+
+// less orders items by key and then by ID
+func (item pageItem) less(other pageItem) bool {
+	if item.key != other.key {
+		return item.key < other.key
+	}
+	return item.id < other.id
+}
+
+// paginate sorts the items and returns the page that follows the requested cursor
+func (p pageRequest) paginate(items []pageItem) page {
+	sort.Slice(items, func(i, j int) bool {
+		if p.descending {
+			return items[j].less(items[i])
+		}
+		return items[i].less(items[j])
+	})
+
+	start := 0
+	if p.after != nil {
+		last := pageItem{key: p.after.Key, id: p.after.ID}
+		start = sort.Search(len(items), func(i int) bool {
+			if p.descending {
+				return items[i].less(last)
+			}
+			return last.less(items[i])
+		})
+	}
+
+	end := start + p.limit
+	if end > len(items) {
+		end = len(items)
+	}
+
+	result := page{Items: make([]interface{}, 0, end-start)}
+	for _, item := range items[start:end] {
+		result.Items = append(result.Items, item.value)
+	}
+	if end < len(items) {
+		last := items[end-1]
+		data, _ := json.Marshal(cursor{SortBy: p.sortBy, Key: last.key, ID: last.id})
+		result.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return result
+}
+
+// certSortKey returns the key a certificate is sorted by. Keys are compared as strings, so numbers and dates are
+// written in a fixed-width form
+func certSortKey(cert certificate, sortBy string) string {
+	switch sortBy {
+	case "issuedAt":
+		return cert.IssuedAt
+	case "createdAt":
+		return timeSortKey(cert.CreatedAt)
+	case "updatedAt":
+		return timeSortKey(cert.UpdatedAt)
+	case "year":
+		return fmt.Sprintf("%010d", cert.Year)
+	case "title":
+		return cert.Title
+	case "deletedAt":
+		return timeSortKey(cert.DeletedAt)
+	default:
+		return cert.ID
+	}
+}
+
+// certPageItems prepares certificates for paginate
+func certPageItems(certs []certificate, sortBy string) []pageItem {
+	items := make([]pageItem, 0, len(certs))
+	for _, cert := range certs {
+		items = append(items, pageItem{key: certSortKey(cert, sortBy), id: cert.ID, value: cert})
+	}
+	return items
+}
+
+// transferSortKey returns the key a transfer is sorted by. Times are written with a fixed number of fractional digits,
+// so that they sort as strings
+func transferSortKey(xfer transfer, sortBy string) string {
+	var at string
+	switch sortBy {
+	case "requestedAt":
+		at = xfer.RequestedAt
+	case "resolvedAt":
+		at = xfer.ResolvedAt // pending transfers come first
+	default:
+		return xfer.ID
+	}
+	return timeSortKey(at)
+}
+
+// timeSortKey writes an RFC 3339 time with a fixed number of fractional digits, so that times sort as strings
+func timeSortKey(at string) string {
+	if t, err := time.Parse(time.RFC3339Nano, at); err == nil {
+		return t.UTC().Format("2006-01-02T15:04:05.000000000")
+	}
+	return at
+}
+
+// transferPageItems prepares transfers for paginate
+func transferPageItems(list []transfer, sortBy string) []pageItem {
+	items := make([]pageItem, 0, len(list))
+	for _, xfer := range list {
+		items = append(items, pageItem{key: transferSortKey(xfer, sortBy), id: xfer.ID, value: xfer})
+	}
+	return items
+}
+
+// webhookPageItems prepares webhooks for paginate. Webhooks are always sorted by ID
+func webhookPageItems(list []webhook) []pageItem {
+	items := make([]pageItem, 0, len(list))
+	for _, hook := range list {
+		items = append(items, pageItem{key: hook.ID, id: hook.ID, value: hook})
+	}
+	return items
+}
+
+// deliveryPageItems prepares deliveries for paginate. Deliveries are always sorted by the time they were created
+func deliveryPageItems(list []delivery) []pageItem {
+	items := make([]pageItem, 0, len(list))
+	for _, dl := range list {
+		items = append(items, pageItem{key: timeSortKey(dl.CreatedAt), id: dl.ID, value: dl})
+	}
+	return items
+}
+
+// auditPageItems prepares audit entries for paginate. Entries are always sorted by their sequence number
+func auditPageItems(list []auditEntry) []pageItem {
+	items := make([]pageItem, 0, len(list))
+	for _, e := range list {
+		items = append(items, pageItem{key: fmt.Sprintf("%020d", e.Seq), id: e.Hash, value: e})
+	}
+	return items
+}
+
+// revisionPageItems prepares revisions for paginate. Revisions are always sorted by version
+func revisionPageItems(list []revision) []pageItem {
+	items := make([]pageItem, 0, len(list))
+	for _, rev := range list {
+		items = append(items, pageItem{key: fmt.Sprintf("%010d", rev.Version), id: strconv.Itoa(rev.Version), value: rev})
+	}
+	return items
+}
+
+// userPageItems prepares users for paginate. Users are always sorted by ID
+func userPageItems(list []user) []pageItem {
+	items := make([]pageItem, 0, len(list))
+	for _, u := range list {
+		items = append(items, pageItem{key: u.ID, id: u.ID, value: u})
+	}
+	return items
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// pageOfCerts is the decoded envelope of a certificate listing
+type pageOfCerts struct {
+	Items      []certificate `json:"items"`
+	NextCursor string        `json:"nextCursor"`
+}
+
+// readAllPages follows nextCursor from the first page of the listing to the last one, and returns the IDs
+// of the listed certificates in the order they were received
+func readAllPages(t *testing.T, path, query string) []string {
+	var ids []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		q := query
+		if cursor != "" {
+			q += "&cursor=" + url.QueryEscape(cursor)
+		}
+		req, _ := http.NewRequest("GET", "http://localhost:8080"+path+"?"+q, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var p pageOfCerts
+		if err := json.Unmarshal(response.Body.Bytes(), &p); err != nil {
+			t.Fatalf("Cannot decode page %s: %v", response.Body.String(), err)
+		}
+		for _, cert := range p.Items {
+			ids = append(ids, cert.ID)
+		}
+		if cursor = p.NextCursor; cursor == "" {
+			return ids
+		}
+	}
+	t.Fatalf("Listing %s?%s never reached its last page", path, query)
+	return nil
+}
+
+// createPagingCerts creates five certificates owned by user 10 with different titles, years and issue dates,
+// written in a few of the formats clients may use
+func createPagingCerts() {
+	certs := []struct {
+		id, title, issuedAt string
+		year                int
+	}{
+		{"a", "delta", "3 FEB 2017", 2017},
+		{"b", "alpha", "29 MAR 2019", 2019},
+		{"c", "echo", "2018-01-01", 2018},
+		{"d", "charlie", "July 15, 2016", 2016},
+		{"e", "bravo", "2 FEB 2017", 2017},
+	}
+	for _, c := range certs {
+		cert := fmt.Sprintf(`{"id":"%s","title":"%s","issuedAt":"%s","ownerId":"10","year":%d}`, c.id, c.title, c.issuedAt, c.year)
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/"+c.id, bytes.NewBufferString(cert))
+		executeRequest(req)
+	}
+}
+
+// TestPaginateCerts walks through the certificate listings two at a time in every supported order
+func TestPaginateCerts(t *testing.T) {
+	withTestStore(func() {
+		createPagingCerts()
+
+		tests := []struct {
+			path, query string
+			expected    []string
+		}{
+			{"/certificates", "limit=2", []string{"a", "b", "c", "d", "e"}},
+			{"/certificates", "limit=2&sort=title", []string{"b", "e", "d", "a", "c"}},
+			{"/certificates", "limit=2&sort=year", []string{"d", "a", "e", "c", "b"}},
+			{"/certificates", "limit=2&sort=year&order=desc", []string{"b", "c", "e", "a", "d"}},
+			{"/certificates", "limit=2&sort=issuedAt", []string{"d", "e", "a", "c", "b"}},
+			{"/certificates", "limit=2&sort=createdAt", []string{"a", "b", "c", "d", "e"}},
+			{"/certificates", "limit=5", []string{"a", "b", "c", "d", "e"}},
+			{"/certificates", "limit=3&year=2017", []string{"a", "e"}},
+			{"/users/10/certificates", "limit=1&sort=title&order=desc", []string{"c", "a", "d", "e", "b"}},
+		}
+		for _, test := range tests {
+			if ids := readAllPages(t, test.path, test.query); !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("%s?%s: expected %v. Got %v", test.path, test.query, test.expected, ids)
+			}
+		}
+	})
+}
+
+// TestPaginateSurvivesInserts verifies that a certificate created between two pages doesn't shift the next page
+func TestPaginateSurvivesInserts(t *testing.T) {
+	withTestStore(func() {
+		createPagingCerts()
+
+		req, _ := http.NewRequest("GET", "http://localhost:8080/certificates?limit=2", nil)
+		var first pageOfCerts
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &first)
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/0", bytes.NewBufferString(`{"id":"0","title":"zero","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		executeRequest(req)
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates?limit=2&cursor="+url.QueryEscape(first.NextCursor), nil)
+		var second pageOfCerts
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &second)
+
+		if len(second.Items) != 2 || second.Items[0].ID != "c" || second.Items[1].ID != "d" {
+			t.Errorf("Expected certificates c and d on the second page. Got %v", second.Items)
+		}
+	})
+}
+
+// TestPaginateInvalidParameters checks that invalid paging parameters are rejected
+func TestPaginateInvalidParameters(t *testing.T) {
+	withTestStore(func() {
+		tests := []struct {
+			query, expected string
+		}{
+			{"limit=0", "Limit 0 is invalid. It must be between 1 and 1000."},
+			{"limit=1001", "Limit 1001 is invalid. It must be between 1 and 1000."},
+			{"sort=note", "Cannot sort by note."},
+			{"order=up", "Order up is invalid. It must be asc or desc."},
+			{"cursor=garbage", "Cursor garbage is invalid."},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest("GET", "http://localhost:8080/certificates?"+test.query, nil)
+			t.Log(test.query)
+			checkErrorResponse(t, executeRequest(req), http.StatusBadRequest, codeInvalidParameter, test.expected)
+		}
+
+		// A cursor only makes sense for the sort order it was issued for
+		createPagingCerts()
+		req, _ := http.NewRequest("GET", "http://localhost:8080/certificates?sort=year&limit=1", nil)
+		var p pageOfCerts
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &p)
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates?sort=title&cursor="+url.QueryEscape(p.NextCursor), nil)
+		checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+	})
+}
@@ -0,0 +1,368 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The content types a PATCH of a certificate may be sent in
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// immutableFields are the fields of a certificate a patch cannot change, with the reason given to the client
+var immutableFields = map[string]string{
+	"id":        "cannot be changed",
+	"ownerId":   "cannot be changed. Transfer the certificate instead",
+	"transfer":  "cannot be changed. Use the transfer routes instead",
+	"createdAt": "is set by the server",
+	"updatedAt": "is set by the server",
+}
+
+// patchOperation is one operation of a JSON Patch. Value is nil when the operation has none
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// mergePatch applies a JSON Merge Patch to a JSON value. Objects are merged, a null member removes the member,
+// and any other value replaces the target
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], value)
+		}
+	}
+	return t
+}
+
+// parsePointer splits a JSON Pointer into its unescaped reference tokens. The empty pointer refers to the whole document
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex reads a reference token as an index into an array of length n. "-" stands for the end of the array,
+// and is only accepted when end is set
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if token == "-" && end {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%q is not an array index", token)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("index %d is out of range", i)
+	}
+	return i, nil
+}
+
+// valueAt returns the value the reference tokens point to
+func valueAt(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q doesn't exist", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = container[i]
+		default:
+			return nil, fmt.Errorf("%q cannot be looked up in a %T", token, doc)
+		}
+	}
+	return doc, nil
+}
+
+// updateAt returns doc with the container the reference tokens end in replaced by what fn makes of it.
+// fn gets the container and the last token
+func updateAt(doc interface{}, tokens []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+	child, err := valueAt(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = updateAt(child, tokens[1:], fn); err != nil {
+		return nil, err
+	}
+	if container, ok := doc.([]interface{}); ok {
+		i, _ := arrayIndex(tokens[0], len(container), false)
+		container[i] = child
+	} else {
+		doc.(map[string]interface{})[tokens[0]] = child
+	}
+	return doc, nil
+}
+
+// addValue adds value to doc at the reference tokens, replacing any member with the same name
+func addValue(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return updateAt(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		default:
+			return nil, fmt.Errorf("%q cannot be added to a %T", token, container)
+		}
+	})
+}
+
+// removeValue removes the value at the reference tokens from doc
+func removeValue(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("the whole document cannot be removed")
+	}
+	return updateAt(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, fmt.Errorf("member %q doesn't exist", token)
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("%q cannot be removed from a %T", token, container)
+		}
+	})
+}
+
+// applyOperation applies one JSON Patch operation to doc
+func applyOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("%s needs a value", op.Op)
+		}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = valueAt(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, errors.New("a value cannot be moved into itself")
+			}
+			if doc, err = removeValue(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			data, _ := json.Marshal(value) // the copy must not share maps or slices with the original
+			json.Unmarshal(data, &value)
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return addValue(doc, path, value)
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, err = removeValue(doc, path); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "test":
+		current, err := valueAt(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, fmt.Errorf("%s is %s", op.Path, mustMarshal(current))
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// mustMarshal writes a decoded JSON value back as JSON
+func mustMarshal(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// readPatch reads the body of a PATCH request in either of the supported content types, and returns a function
+// that applies it to a JSON document
+func readPatch(w http.ResponseWriter, r *http.Request) (func(doc interface{}) (interface{}, error), error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case mergePatchType:
+		var patch interface{}
+		if err := decodeBody(w, r, &patch); err != nil {
+			return nil, err
+		}
+		return func(doc interface{}) (interface{}, error) {
+			return mergePatch(doc, patch), nil
+		}, nil
+	case jsonPatchType:
+		var ops []patchOperation
+		if err := decodeBody(w, r, &ops); err != nil {
+			return nil, err
+		}
+		return func(doc interface{}) (interface{}, error) {
+			for i, op := range ops {
+				var err error
+				if doc, err = applyOperation(doc, op); err != nil {
+					return nil, newAPIError(http.StatusUnprocessableEntity, codePatchFailed, fmt.Sprintf("Operation %d (%s %s) failed: %v.", i, op.Op, op.Path, err)).with("operation", i)
+				}
+			}
+			return doc, nil
+		}, nil
+	default:
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		return nil, newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Content type "+contentType+" is not supported. Send "+mergePatchType+" or "+jsonPatchType+".").with("allowed", []string{mergePatchType, jsonPatchType})
+	}
+}
+
+// patchCertificate applies a patch to the certificate, and checks that the result is a valid certificate
+// whose immutable fields are unchanged
+func patchCertificate(cert certificate, apply func(doc interface{}) (interface{}, error)) (certificate, error) {
+	var doc interface{}
+	json.Unmarshal(mustMarshal(cert), &doc)
+	doc, err := apply(doc)
+	if err != nil {
+		return cert, err
+	}
+
+	var patched certificate
+	decoder := json.NewDecoder(strings.NewReader(string(mustMarshal(doc))))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patched); err != nil {
+		return cert, newAPIError(http.StatusUnprocessableEntity, codePatchFailed, "Patched certificate "+cert.ID+" is not a certificate: "+err.Error()+".")
+	}
+
+	f := make(fieldErrors)
+	for _, change := range diffCerts(&cert, &patched) {
+		field := strings.SplitN(change.Field, ".", 2)[0]
+		if reason, ok := immutableFields[field]; ok {
+			f[field] = reason
+		}
+	}
+	if err := f.err("Patch of certificate " + cert.ID); err != nil {
+		return cert, err
+	}
+	patched.Transfer = cert.Transfer // keeps what isn't written in JSON, such as the claim token's hash
+	if patched.IssuedAt != cert.IssuedAt && patched.Year == cert.Year {
+		patched.Year = 0 // the year was only carried over from the old date, so it is filled in from the new one
+	}
+	if err := validateCert(patched); err != nil {
+		return cert, err
+	}
+	normalizeDates(&patched)
+	return patched, nil
+}
+
+// patchCert changes some of the fields of an existing certificate, leaving the others as they are
+func patchCert(w http.ResponseWriter, r *http.Request) {
+	certID := mux.Vars(r)["id"]
+	apply, err := readPatch(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var cert certificate
+	var etag string
+	var deliveries []*delivery
+	err = db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		current, ok := liveCert(certificates, certID)
+		if !ok {
+			return newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist. Cannot update certificate.").with("certId", certID)
+		}
+		if err := authorize(r, actionUpdateCert, target{cert: &current}); err != nil {
+			return err
+		}
+		if err := checkIfMatch(r, revisions, certID); err != nil {
+			return err
+		}
+		var err error
+		if cert, err = patchCertificate(current, apply); err != nil {
+			return err
+		}
+		if err := saveCert(certificates, &cert); err != nil {
+			return err
+		}
+		etag = certETag(revisions, certID)
+		deliveries = newDeliveries(hooks, eventCertUpdated, cert)
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		webhookDeliveries.send(deliveries...)
+		w.Header().Set("ETag", etag)
+		json.NewEncoder(w).Encode(cert) // Return a JSON with the patched certificate
+	}
+}
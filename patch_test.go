@@ -0,0 +1,141 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// sendPatch patches certificate 1 with a body of this content type, as its owner
+func sendPatch(contentType, body string) *http.Request {
+	req, _ := http.NewRequest("PATCH", "http://localhost:8080/certificates/1", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", contentType)
+	return asUser(req, "10")
+}
+
+// withNotedCert runs fn on a fresh store that holds certificate 1, owned by user 10, with a note
+func withNotedCert(t *testing.T, fn func()) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"a note"}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		fn()
+	})
+}
+
+// TestPatchCert patches a certificate with both kinds of patches, and verifies that only the patched fields change
+func TestPatchCert(t *testing.T) {
+	tests := []struct {
+		contentType, body, expected string
+	}{
+		{mergePatchType, `{"title":"renamed cert"}`, `{"id":"1","title":"renamed cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"a note","transfer":{"to":"","status":""}}`},
+		{mergePatchType + "; charset=utf-8", `{"note":null,"issuedAt":"1 MAY 2018","year":null}`, `{"id":"1","title":"first cert","issuedAt":"2018-05-01","ownerId":"10","year":2018,"note":"","transfer":{"to":"","status":""}}`},
+		{mergePatchType, `{"issuedAt":"2018-05-01"}`, `{"id":"1","title":"first cert","issuedAt":"2018-05-01","ownerId":"10","year":2018,"note":"a note","transfer":{"to":"","status":""}}`},
+		{jsonPatchType, `[{"op":"replace","path":"/issuedAt","value":"1 MAY 2018"}]`, `{"id":"1","title":"first cert","issuedAt":"2018-05-01","ownerId":"10","year":2018,"note":"a note","transfer":{"to":"","status":""}}`},
+		{jsonPatchType, `[{"op":"test","path":"/title","value":"first cert"},{"op":"replace","path":"/title","value":"renamed cert"},{"op":"remove","path":"/note"},{"op":"add","path":"/issuedAt","value":"March 28, 2019"}]`, `{"id":"1","title":"renamed cert","issuedAt":"2019-03-28","ownerId":"10","year":2019,"note":"","transfer":{"to":"","status":""}}`},
+	}
+	for _, test := range tests {
+		withNotedCert(t, func() {
+			response := executeRequest(sendPatch(test.contentType, test.body))
+			checkResponseCode(t, http.StatusOK, response.Code)
+			if pass, err := IsEqualJSON(withoutServerTimes(response.Body.String()), test.expected); err != nil || !pass {
+				t.Errorf("%s\nExpected %s\nGot\t %s", test.body, test.expected, response.Body.String())
+			}
+			if etag := response.Header().Get("ETag"); etag != `"2"` {
+				t.Errorf("Expected the patch to make version 2. Got %q", etag)
+			}
+		})
+	}
+}
+
+// TestPatchCertErrors verifies that patches that cannot be applied, that change immutable fields, or that
+// leave an invalid certificate behind are rejected, and leave the certificate as it was
+func TestPatchCertErrors(t *testing.T) {
+	tests := []struct {
+		contentType, body string
+		status            int
+		code, msg         string
+		field             string
+	}{
+		{"application/json", `{"title":"renamed cert"}`, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Content type application/json is not supported. Send application/merge-patch+json or application/json-patch+json.", ""},
+		{mergePatchType, `{"ownerId":"11"}`, http.StatusUnprocessableEntity, codeValidationFailed, "Patch of certificate 1 is invalid.", "ownerId"},
+		{mergePatchType, `{"id":"2","transfer":{"to":"test12@test.com"}}`, http.StatusUnprocessableEntity, codeValidationFailed, "Patch of certificate 1 is invalid.", "transfer"},
+		{mergePatchType, `{"updatedAt":"2019-03-29T10:00:00Z"}`, http.StatusUnprocessableEntity, codeValidationFailed, "Patch of certificate 1 is invalid.", "updatedAt"},
+		{mergePatchType, `{"year":2018}`, http.StatusUnprocessableEntity, codeValidationFailed, "Certificate 1 is invalid.", "year"},
+		{mergePatchType, `{"issuedAt":"2018-05-01","year":2017}`, http.StatusUnprocessableEntity, codeValidationFailed, "Certificate 1 is invalid.", "year"},
+		{mergePatchType, `{"title":null}`, http.StatusUnprocessableEntity, codeValidationFailed, "Certificate 1 is invalid.", "title"},
+		{mergePatchType, `{"deletedAt":"2019-03-29T10:00:00Z"}`, http.StatusUnprocessableEntity, codeValidationFailed, "Certificate 1 is invalid.", "deletedAt"},
+		{mergePatchType, `{"color":"red"}`, http.StatusUnprocessableEntity, codePatchFailed, `Patched certificate 1 is not a certificate: json: unknown field "color".`, ""},
+		{mergePatchType, `{"title":`, http.StatusBadRequest, codeMalformedBody, "Request body is not valid JSON: unexpected EOF.", ""},
+		{jsonPatchType, `[{"op":"test","path":"/title","value":"other cert"}]`, http.StatusUnprocessableEntity, codePatchFailed, `Operation 0 (test /title) failed: /title is "first cert".`, ""},
+		{jsonPatchType, `[{"op":"replace","path":"/title","value":"renamed cert"},{"op":"remove","path":"/subtitle"}]`, http.StatusUnprocessableEntity, codePatchFailed, `Operation 1 (remove /subtitle) failed: member "subtitle" doesn't exist.`, ""},
+		{jsonPatchType, `[{"op":"replace","path":"/ownerId","value":"11"}]`, http.StatusUnprocessableEntity, codeValidationFailed, "Patch of certificate 1 is invalid.", "ownerId"},
+		{jsonPatchType, `[{"op":"rename","path":"/title"}]`, http.StatusUnprocessableEntity, codePatchFailed, `Operation 0 (rename /title) failed: unknown operation "rename".`, ""},
+	}
+	for _, test := range tests {
+		withNotedCert(t, func() {
+			response := executeRequest(sendPatch(test.contentType, test.body))
+			checkErrorResponse(t, response, test.status, test.code, test.msg)
+			if test.field != "" {
+				var e apiError
+				json.Unmarshal(response.Body.Bytes(), &e)
+				if fields, _ := e.Details["fields"].(map[string]interface{}); fields[test.field] == nil {
+					t.Errorf("%s: expected a problem with %s. Got %s", test.body, test.field, response.Body.String())
+				}
+			}
+
+			req, _ := http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+			response = executeRequest(req)
+			if response.Header().Get("ETag") != `"1"` {
+				t.Errorf("%s: expected the certificate to be left as it was. Got %s", test.body, response.Body.String())
+			}
+		})
+	}
+}
+
+// TestJSONPatchOperations applies the operations of RFC 6902 to documents with nested objects and arrays
+func TestJSONPatchOperations(t *testing.T) {
+	tests := []struct {
+		doc, patch, expected string
+	}{
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"a/b":{"m~n":1}}`, `[{"op":"copy","from":"/a~1b/m~0n","path":"/c"},{"op":"replace","path":"/a~1b/m~0n","value":2}]`, `{"a/b":{"m~n":2},"c":1}`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":{"baz":"qux"}}]`, `{"baz":"qux"}`},
+	}
+	for _, test := range tests {
+		var doc interface{}
+		var ops []patchOperation
+		json.Unmarshal([]byte(test.doc), &doc)
+		json.Unmarshal([]byte(test.patch), &ops)
+		for _, op := range ops {
+			var err error
+			if doc, err = applyOperation(doc, op); err != nil {
+				t.Fatalf("%s: %v", test.patch, err)
+			}
+		}
+		if pass, err := IsEqualJSON(string(mustMarshal(doc)), test.expected); err != nil || !pass {
+			t.Errorf("%s\nExpected %s\nGot\t %s", test.patch, test.expected, mustMarshal(doc))
+		}
+	}
+
+	var doc interface{}
+	json.Unmarshal([]byte(`{"foo":["bar"],"baz":{}}`), &doc)
+	for _, op := range []patchOperation{
+		{Op: "add", Path: "/foo/2", Value: json.RawMessage(`1`)},
+		{Op: "add", Path: "/foo/01", Value: json.RawMessage(`1`)},
+		{Op: "add", Path: "foo", Value: json.RawMessage(`1`)},
+		{Op: "add", Path: "/qux/a", Value: json.RawMessage(`1`)},
+		{Op: "replace", Path: "/baz"},
+		{Op: "move", From: "/baz", Path: "/baz/x"},
+		{Op: "remove", Path: ""},
+	} {
+		if _, err := applyOperation(doc, op); err == nil {
+			t.Errorf("Expected %+v to fail", op)
+		}
+	}
+}
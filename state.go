@@ -0,0 +1,386 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// store guards the certificates, users, transfers, webhooks and revisions stores with a single lock, so that every request
+// sees and leaves them in a consistent state even though net/http serves each request on its own goroutine
+type store struct {
+	mu        sync.RWMutex
+	certs     *certIndex
+	users     *userIndex
+	transfers TransferStore
+	hooks     WebhookStore
+	revisions RevisionStore
+	audit     *auditLog
+}
+
+// newStore wraps the certificates, users, transfers, webhooks and revisions stores. Every change to them is recorded
+// in the audit log, every change to a certificate adds a revision of it, and certificates and users are indexed,
+// so that they can be looked up by e-mail address
+func newStore(certs CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore, audit *auditLog) *store {
+	return &store{
+		certs:     newCertIndex(certs),
+		users:     newUserIndex(users),
+		transfers: transfers,
+		hooks:     hooks,
+		revisions: revisions,
+		audit:     audit,
+	}
+}
+
+// view runs fn with read-only access to the stores. Any number of views may run at the same time
+func (s *store) view(fn func(certs CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(s.certs, s.users, s.transfers, s.hooks, s.revisions)
+}
+
+// update runs fn with exclusive access to the stores, so that a read-check-write sequence in fn is atomic.
+// The changes fn makes are recorded as made by the server itself
+func (s *store) update(fn func(certs CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error) error {
+	return s.updateBy(nil, fn)
+}
+
+// updateBy runs fn like update, and records the changes fn makes as made by the user that sent the request
+func (s *store) updateBy(r *http.Request, fn func(certs CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error) error {
+	return s.updateFor(r, "", fn)
+}
+
+// updateFor runs fn like updateBy, and records the reason the user gave for the changes. fn makes its changes to
+// staged stores, which are only made to the stores, and written to the audit log, if fn succeeds. Either every change
+// fn makes is kept, or none is
+func (s *store) updateFor(r *http.Request, reason string, fn func(certs CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r != nil {
+		u, _ := currentUser(r)
+		s.audit.actorID, s.audit.requestID, s.audit.reason = u.ID, requestID(r), reason
+		defer func() { s.audit.actorID, s.audit.requestID, s.audit.reason = "", "", "" }()
+	}
+	if err := s.audit.begin(); err != nil {
+		return err
+	}
+
+	tx := newTransaction(s)
+	err := fn(tx.wrapped())
+	if err == nil {
+		err = s.commit(tx.changes())
+	}
+	if err != nil {
+		s.rollback(tx.changes())
+	}
+	return err
+}
+
+// commit writes the changes to the audit log, and then makes them to the stores. A store that can make them all at once,
+// such as the file store, does
+func (s *store) commit(changes changeSet) error {
+	if changes.empty() {
+		return nil
+	}
+	if err := s.audit.commit(); err != nil {
+		return err
+	}
+	if a, ok := s.certs.CertificateStore.(interface{ apply(changeSet) error }); ok {
+		return a.apply(changes)
+	}
+	return changes.applyTo(s.certs.CertificateStore, s.users.UserStore, s.transfers, s.hooks, s.revisions)
+}
+
+// rollback takes back the changes from the audit log, and indexes the stores again as they were before them
+func (s *store) rollback(changes changeSet) {
+	s.audit.rollback()
+	if !changes.empty() {
+		s.certs = newCertIndex(s.certs.CertificateStore)
+		s.users = newUserIndex(s.users.UserStore)
+	}
+}
+
+// transaction holds the changes a call of store.updateFor makes, until they are committed
+type transaction struct {
+	store     *store
+	certs     stagedCerts
+	users     stagedUsers
+	transfers stagedTransfers
+	hooks     stagedWebhooks
+	revisions stagedRevisions
+}
+
+func newTransaction(s *store) *transaction {
+	return &transaction{
+		store:     s,
+		certs:     newStagedCerts(s.certs.CertificateStore),
+		users:     newStagedUsers(s.users.UserStore),
+		transfers: newStagedTransfers(s.transfers),
+		hooks:     newStagedWebhooks(s.hooks),
+		revisions: newStagedRevisions(s.revisions),
+	}
+}
+
+// wrapped returns the staged stores as the handlers use them: every change is recorded in the audit log, every change
+// to a certificate adds a revision of it, and the store's indexes are kept up to date
+func (tx *transaction) wrapped() (CertificateStore, UserStore, TransferStore, WebhookStore, RevisionStore) {
+	audit := tx.store.audit
+	certs := &certIndex{CertificateStore: auditedCerts{versionedCerts{tx.certs, tx.revisions}, audit}, pendingTo: tx.store.certs.pendingTo}
+	users := &userIndex{UserStore: auditedUsers{tx.users, audit}, byEmail: tx.store.users.byEmail}
+	return certs, users, auditedTransfers{tx.transfers, audit}, auditedWebhooks{tx.hooks, audit}, tx.revisions
+}
+
+// changes returns the changes made to the staged stores
+func (tx *transaction) changes() changeSet {
+	return changeSet{
+		certs:     tx.certs.changed,
+		users:     tx.users.changed,
+		transfers: tx.transfers.changed,
+		hooks:     tx.hooks.changed,
+		dropped:   tx.revisions.deleted,
+		revisions: tx.revisions.added,
+	}
+}
+
+// stagedCerts keeps the changes made to a certificates store to itself, so that they can be made all at once,
+// or not at all
+type stagedCerts struct {
+	CertificateStore
+	changed map[string]*certificate // nil for certificates that have been deleted
+}
+
+func newStagedCerts(certificates CertificateStore) stagedCerts {
+	return stagedCerts{certificates, make(map[string]*certificate)}
+}
+
+// GetCert returns the certificate with this id as the changes left it
+func (s stagedCerts) GetCert(id string) (certificate, bool) {
+	if cert, ok := s.changed[id]; ok {
+		if cert == nil {
+			return certificate{}, false
+		}
+		return *cert, true
+	}
+	return s.CertificateStore.GetCert(id)
+}
+
+// PutCert stages the certificate
+func (s stagedCerts) PutCert(cert certificate) error {
+	s.changed[cert.ID] = &cert
+	return nil
+}
+
+// DeleteCert stages the removal of the certificate
+func (s stagedCerts) DeleteCert(id string) error {
+	s.changed[id] = nil
+	return nil
+}
+
+// ListCerts returns all the certificates as the changes left them
+func (s stagedCerts) ListCerts() []certificate {
+	var list []certificate
+	for _, cert := range s.CertificateStore.ListCerts() {
+		if _, ok := s.changed[cert.ID]; !ok {
+			list = append(list, cert)
+		}
+	}
+	for _, cert := range s.changed {
+		if cert != nil {
+			list = append(list, *cert)
+		}
+	}
+	return list
+}
+
+// stagedTransfers keeps the changes made to a transfers store to itself
+type stagedTransfers struct {
+	TransferStore
+	changed transfersMap
+}
+
+func newStagedTransfers(transfers TransferStore) stagedTransfers {
+	return stagedTransfers{transfers, make(transfersMap)}
+}
+
+// GetTransfer returns the transfer with this id as the changes left it
+func (s stagedTransfers) GetTransfer(id string) (transfer, bool) {
+	if xfer, ok := s.changed[id]; ok {
+		return xfer, true
+	}
+	return s.TransferStore.GetTransfer(id)
+}
+
+// PutTransfer stages the transfer
+func (s stagedTransfers) PutTransfer(xfer transfer) error {
+	return s.changed.PutTransfer(xfer)
+}
+
+// ListTransfers returns all the transfers as the changes left them
+func (s stagedTransfers) ListTransfers() []transfer {
+	list := s.changed.ListTransfers()
+	for _, xfer := range s.TransferStore.ListTransfers() {
+		if _, ok := s.changed[xfer.ID]; !ok {
+			list = append(list, xfer)
+		}
+	}
+	return list
+}
+
+// stagedUsers keeps the changes made to a users store to itself
+type stagedUsers struct {
+	UserStore
+	changed map[string]*user // nil for users that have been deleted
+}
+
+func newStagedUsers(users UserStore) stagedUsers {
+	return stagedUsers{users, make(map[string]*user)}
+}
+
+// GetUser returns the user with this id as the changes left it
+func (s stagedUsers) GetUser(id string) (user, bool) {
+	if u, ok := s.changed[id]; ok {
+		if u == nil {
+			return user{}, false
+		}
+		return *u, true
+	}
+	return s.UserStore.GetUser(id)
+}
+
+// PutUser stages the user
+func (s stagedUsers) PutUser(u user) error {
+	s.changed[u.ID] = &u
+	return nil
+}
+
+// DeleteUser stages the removal of the user
+func (s stagedUsers) DeleteUser(id string) error {
+	s.changed[id] = nil
+	return nil
+}
+
+// ListUsers returns all the users as the changes left them
+func (s stagedUsers) ListUsers() []user {
+	var list []user
+	for _, u := range s.UserStore.ListUsers() {
+		if _, ok := s.changed[u.ID]; !ok {
+			list = append(list, u)
+		}
+	}
+	for _, u := range s.changed {
+		if u != nil {
+			list = append(list, *u)
+		}
+	}
+	return list
+}
+
+// stagedWebhooks keeps the changes made to a webhooks store to itself
+type stagedWebhooks struct {
+	WebhookStore
+	changed map[string]*webhook // nil for webhooks that have been deleted
+}
+
+func newStagedWebhooks(hooks WebhookStore) stagedWebhooks {
+	return stagedWebhooks{hooks, make(map[string]*webhook)}
+}
+
+// GetWebhook returns the webhook with this id as the changes left it
+func (s stagedWebhooks) GetWebhook(id string) (webhook, bool) {
+	if hook, ok := s.changed[id]; ok {
+		if hook == nil {
+			return webhook{}, false
+		}
+		return *hook, true
+	}
+	return s.WebhookStore.GetWebhook(id)
+}
+
+// PutWebhook stages the webhook
+func (s stagedWebhooks) PutWebhook(hook webhook) error {
+	s.changed[hook.ID] = &hook
+	return nil
+}
+
+// DeleteWebhook stages the removal of the webhook
+func (s stagedWebhooks) DeleteWebhook(id string) error {
+	s.changed[id] = nil
+	return nil
+}
+
+// ListWebhooks returns all the webhooks as the changes left them
+func (s stagedWebhooks) ListWebhooks() []webhook {
+	var list []webhook
+	for _, hook := range s.WebhookStore.ListWebhooks() {
+		if _, ok := s.changed[hook.ID]; !ok {
+			list = append(list, hook)
+		}
+	}
+	for _, hook := range s.changed {
+		if hook != nil {
+			list = append(list, *hook)
+		}
+	}
+	return list
+}
+
+// stagedRevisions keeps the revisions added to a revisions store to itself, so that the versions of certificates
+// that are changed more than once are checked as they would be
+type stagedRevisions struct {
+	RevisionStore
+	added   revisionsMap
+	deleted map[string]bool
+}
+
+func newStagedRevisions(revisions RevisionStore) stagedRevisions {
+	return stagedRevisions{revisions, make(revisionsMap), make(map[string]bool)}
+}
+
+// AddRevision stages the revision
+func (s stagedRevisions) AddRevision(rev revision) error {
+	return s.added.AddRevision(rev)
+}
+
+// ListRevisions returns the revisions of the certificate as the changes left them
+func (s stagedRevisions) ListRevisions(certID string) []revision {
+	var list []revision
+	if !s.deleted[certID] {
+		list = s.RevisionStore.ListRevisions(certID)
+	}
+	return append(list, s.added.ListRevisions(certID)...)
+}
+
+// DeleteRevisions stages the removal of the certificate's revisions
+func (s stagedRevisions) DeleteRevisions(certID string) error {
+	s.deleted[certID] = true
+	return s.added.DeleteRevisions(certID)
+}
+
+// close closes the files the stores and the audit log are kept in. The store cannot be used afterwards
+func (s *store) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if c, ok := s.certs.CertificateStore.(io.Closer); ok {
+		err = c.Close()
+	}
+	if e := s.audit.close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// auditTrail returns every entry of the audit log
+func (s *store) auditTrail() ([]auditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.audit.load()
+}
+
+// verifyAudit checks the chain of the audit log
+func (s *store) verifyAudit() auditVerification {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.audit.verify()
+}
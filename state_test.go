@@ -0,0 +1,259 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// These tests hammer the routes from many goroutines at once. Run them with go test -race
+
+const stressWorkers = 50
+
+// runParallel calls fn from stressWorkers goroutines and waits for all of them to return
+func runParallel(fn func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestStressAllRoutes runs the full life cycle of a certificate through every route of the router from many goroutines in parallel
+func TestStressAllRoutes(t *testing.T) {
+	withWebhooks(func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+		for i := 0; i < stressWorkers; i++ {
+			id := fmt.Sprintf("s%d", i)
+			auth.addAPIKey(testAPIKey(id), id)
+			defer delete(auth.apiKeys, hashAPIKey(testAPIKey(id)))
+		}
+
+		runParallel(func(i int) {
+			id := fmt.Sprintf("s%d", i)
+			cert := []byte(`{"id":"` + id + `","title":"stress cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"","transfer":{"to":"","status":""}}`)
+			updated := []byte(`{"id":"` + id + `","title":"updated stress cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"","transfer":{"to":"","status":""}}`)
+			batched := `{"id":"b` + id + `","title":"batched stress cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":""}`
+			batch := []byte(`{"mode":"atomic","operations":[{"op":"create","id":"b` + id + `","certificate":` + batched + `},{"op":"update","id":"b` + id + `","certificate":` + batched + `},{"op":"delete","id":"b` + id + `"}]}`)
+			reassign := []byte(`{"ownerId":"11","reason":"stress test"}`)
+			xfer := []byte(`{"to":"test12@test.com","status":"Requested"}`)
+			invite := []byte(`{"to":"invited-` + id + `@test.com","status":"Requested"}`)
+			u := []byte(`{"email":"` + id + `@test.com","name":"Stress User"}`)
+			hook := []byte(`{"url":"` + server.URL + `","events":["certificate.updated","transfer.accepted"]}`)
+			imported := []byte(`{"type":"user","user":{"id":"i` + id + `","email":"i` + id + `@test.com","name":"Imported Stress User"}}` + "\n")
+
+			// send runs a request as the user, the admin if it is empty, and checks its status
+			send := func(method, path string, body []byte, asUserID, contentType string, expected int) *httptest.ResponseRecorder {
+				req, _ := http.NewRequest(method, "http://localhost:8080"+path, bytes.NewBuffer(body))
+				if asUserID != "" {
+					asUser(req, asUserID)
+				}
+				if contentType != "" {
+					req.Header.Set("Content-Type", contentType)
+				}
+				response := executeRequest(req)
+				if response.Code != expected {
+					t.Errorf("%s %s: expected response code %d. Got %d: %s", method, path, expected, response.Code, response.Body.String())
+				}
+				return response
+			}
+
+			send("POST", "/users/"+id, u, "", "", http.StatusOK)
+			send("GET", "/users/"+id, nil, "", "", http.StatusOK)
+			send("PUT", "/users/"+id, u, "", "", http.StatusOK)
+			send("GET", "/users", nil, "", "", http.StatusOK)
+
+			send("POST", "/certificates/"+id, cert, "", "", http.StatusOK)
+			send("PUT", "/certificates/"+id, updated, "", "", http.StatusOK)
+			send("PATCH", "/certificates/"+id, []byte(`{"note":"patched"}`), "", mergePatchType, http.StatusOK)
+			send("POST", "/certificates/"+id+"/owner", reassign, "", "", http.StatusOK)
+			send("GET", "/certificates/"+id, nil, "", "", http.StatusOK)
+			send("GET", "/certificates?ownerId=11", nil, "", "", http.StatusOK)
+			send("GET", "/users/11/certificates", nil, "", "", http.StatusOK)
+			send("GET", "/certificates/"+id+"/versions", nil, "", "", http.StatusOK)
+			send("GET", "/certificates/"+id+"/versions/1", nil, "", "", http.StatusOK)
+			send("GET", "/certificates/"+id+"/versions/3/diff", nil, "", "", http.StatusOK)
+			send("POST", "/certificates:batch", batch, "", "", http.StatusOK)
+
+			send("POST", "/certificates/"+id+"/transfers", xfer, "", "", http.StatusOK)
+			send("GET", "/users/12/transfers/pending", nil, "12", "", http.StatusOK)
+			send("POST", "/certificates/"+id+"/transfers/reject", nil, "12", "", http.StatusOK)
+			send("POST", "/certificates/"+id+"/transfers", xfer, "", "", http.StatusOK)
+			send("POST", "/certificates/"+id+"/transfers/cancel", nil, "11", "", http.StatusOK)
+			var invitation certificate
+			json.Unmarshal(send("POST", "/certificates/"+id+"/transfers", invite, "", "", http.StatusOK).Body.Bytes(), &invitation)
+			send("PUT", "/certificates/"+id+"/transfers", []byte(`{"claimToken":"`+invitation.Transfer.ClaimToken+`"}`), id, "", http.StatusOK)
+			send("POST", "/certificates/"+id+"/transfers", xfer, id, "", http.StatusOK)
+			send("POST", "/certificates/"+id+"/transfers/accept", nil, "12", "", http.StatusOK)
+			send("GET", "/certificates/"+id+"/transfers", nil, "", "", http.StatusOK)
+			send("GET", "/users/12/transfers?direction=incoming", nil, "12", "", http.StatusOK)
+
+			var subscribed webhook
+			json.Unmarshal(send("POST", "/webhooks", hook, "", "", http.StatusCreated).Body.Bytes(), &subscribed)
+			send("PATCH", "/certificates/"+id, []byte(`{"note":"patched by the new owner"}`), "12", mergePatchType, http.StatusOK)
+			send("GET", "/webhooks", nil, "", "", http.StatusOK)
+			send("GET", "/webhooks/"+subscribed.ID, nil, "", "", http.StatusOK)
+			send("GET", "/webhooks/"+subscribed.ID+"/deliveries", nil, "", "", http.StatusOK)
+			send("DELETE", "/webhooks/"+subscribed.ID, nil, "", "", http.StatusNoContent)
+
+			send("DELETE", "/certificates/"+id, nil, "", "", http.StatusNoContent)
+			send("GET", "/trash", nil, "", "", http.StatusOK)
+			send("POST", "/certificates/"+id+"/restore", nil, "", "", http.StatusOK)
+			send("DELETE", "/certificates/"+id, nil, "", "", http.StatusNoContent)
+
+			send("GET", "/audit?certId="+id, nil, "", "", http.StatusOK)
+			send("GET", "/audit/verify", nil, "", "", http.StatusOK)
+			send("GET", "/export?format=ndjson", nil, "", "", http.StatusOK)
+			send("POST", "/import?mode=insert&dryRun=true", imported, "", ndjsonType, http.StatusOK)
+			send("POST", "/import?mode=insert", imported, "", ndjsonType, http.StatusOK)
+			send("DELETE", "/users/i"+id, nil, "", "", http.StatusNoContent)
+			send("DELETE", "/users/"+id, nil, "", "", http.StatusNoContent)
+		})
+
+		db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			for _, cert := range certificates.ListCerts() {
+				if !cert.deleted() {
+					t.Errorf("Expected all certificates to be deleted. Certificate %s is left", cert.ID)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// TestStressCreateTransferRace races many transfer requests on one certificate and verifies that exactly one of them wins
+func TestStressCreateTransferRace(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		executeRequest(req)
+
+		var mu sync.Mutex
+		succeeded := 0
+		runParallel(func(i int) {
+			xfer := []byte(`{"to":"test1` + fmt.Sprint(1+i%2) + `@test.com","status":"Requested"}`)
+			req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBuffer(xfer))
+			if executeRequest(req).Code == http.StatusOK {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		})
+
+		if succeeded != 1 {
+			t.Errorf("Expected exactly one transfer request to succeed. %d did", succeeded)
+		}
+	})
+}
+
+// TestStressAcceptTransferRace races accepting transfers against new transfer requests on one certificate,
+// and verifies that every requested transfer has been accepted exactly once or is still pending
+func TestStressAcceptTransferRace(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		executeRequest(req)
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBuffer([]byte(`{"to":"test12@test.com","status":"Requested"}`)))
+		executeRequest(req)
+
+		var mu sync.Mutex
+		requested, accepted := 1, 0
+		runParallel(func(i int) {
+			var req *http.Request
+			if i%2 == 0 {
+				req, _ = http.NewRequest("PUT", "http://localhost:8080/certificates/1/transfers", nil)
+			} else {
+				req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBuffer([]byte(`{"to":"test11@test.com","status":"Requested"}`)))
+			}
+			// Each accept is sent by one of the two users the certificate may be waiting for
+			if i%4 == 0 {
+				asUser(req, "12")
+			} else if i%4 == 2 {
+				asUser(req, "11")
+			}
+			if executeRequest(req).Code != http.StatusOK {
+				return
+			}
+			mu.Lock()
+			if req.Method == "PUT" {
+				accepted++
+			} else {
+				requested++
+			}
+			mu.Unlock()
+		})
+
+		db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			cert, _ := certificates.GetCert("1")
+			pending := 0
+			if cert.Transfer.Status == "Requested" {
+				pending = 1
+			}
+			if accepted+pending != requested {
+				t.Errorf("%d transfers were requested, but %d were accepted and %d are pending", requested, accepted, pending)
+			}
+			return nil
+		})
+	})
+}
+
+// TestUpdateFailureKeepsNothing makes an update that changes a transfer and a certificate and then fails, and verifies
+// that neither change is kept, that nothing is recorded in the audit log and that the indexes are as they were
+func TestUpdateFailureKeepsNothing(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		executeRequest(req)
+		entries, _ := db.auditTrail()
+
+		failure := errors.New("save failed")
+		err := db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			xfer := transfer{ID: "t1", CertID: "1", FromUserID: "10", To: "test12@test.com", Status: transferRequested}
+			if err := transfers.PutTransfer(xfer); err != nil {
+				return err
+			}
+			cert, _ := certificates.GetCert("1")
+			cert.Transfer = xfer
+			if err := certificates.PutCert(cert); err != nil {
+				return err
+			}
+			if err := users.DeleteUser("12"); err != nil {
+				return err
+			}
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("Expected the update to fail with %v. Got %v", failure, err)
+		}
+
+		db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			if _, ok := transfers.GetTransfer("t1"); ok {
+				t.Errorf("Expected the transfer of the failed update to be dropped")
+			}
+			if cert, _ := certificates.GetCert("1"); cert.Transfer.Status != "" {
+				t.Errorf("Expected certificate 1 to have no transfer. Got %+v", cert.Transfer)
+			}
+			if n := len(revisions.ListRevisions("1")); n != 1 {
+				t.Errorf("Expected certificate 1 to have 1 revision. Got %d", n)
+			}
+			if certs := pendingTransfersTo(certificates, "test12@test.com"); len(certs) != 0 {
+				t.Errorf("Expected no pending transfers to test12@test.com. Got %v", certs)
+			}
+			if _, ok := userByEmail(users, "test12@test.com"); !ok {
+				t.Errorf("Expected user 12 to be kept")
+			}
+			return nil
+		})
+		if after, _ := db.auditTrail(); len(after) != len(entries) {
+			t.Errorf("Expected the audit log to keep its %d entries. Got %d", len(entries), len(after))
+		}
+	})
+}
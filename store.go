@@ -0,0 +1,693 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// CertificateStore is implemented by every backend that can hold certificates
+type CertificateStore interface {
+	GetCert(id string) (certificate, bool)
+	PutCert(cert certificate) error
+	DeleteCert(id string) error
+	ListCerts() []certificate
+}
+
+// UserStore is implemented by every backend that can hold users
+type UserStore interface {
+	GetUser(id string) (user, bool)
+	PutUser(u user) error
+	DeleteUser(id string) error
+	ListUsers() []user
+}
+
+// TransferStore is implemented by every backend that can hold transfers. Transfers are never deleted,
+// so that the history of every certificate can be traced
+type TransferStore interface {
+	GetTransfer(id string) (transfer, bool)
+	PutTransfer(xfer transfer) error
+	ListTransfers() []transfer
+}
+
+// WebhookStore is implemented by every backend that can hold webhook subscriptions
+type WebhookStore interface {
+	GetWebhook(id string) (webhook, bool)
+	PutWebhook(hook webhook) error
+	DeleteWebhook(id string) error
+	ListWebhooks() []webhook
+}
+
+// RevisionStore is implemented by every backend that can hold the revisions of certificates. Revisions are never
+// changed, only added, and removed with their certificate when it is purged
+type RevisionStore interface {
+	AddRevision(rev revision) error
+	ListRevisions(certID string) []revision
+	DeleteRevisions(certID string) error
+}
+
+// GetCert returns the certificate with this id
+func (m certsMap) GetCert(id string) (certificate, bool) {
+	cert, ok := m[id]
+	return cert, ok
+}
+
+// PutCert adds the certificate to the map, replacing any certificate with the same id
+func (m certsMap) PutCert(cert certificate) error {
+	m[cert.ID] = cert
+	return nil
+}
+
+// DeleteCert removes the certificate with this id from the map
+func (m certsMap) DeleteCert(id string) error {
+	delete(m, id)
+	return nil
+}
+
+// ListCerts returns all the certificates in the map
+func (m certsMap) ListCerts() []certificate {
+	certs := make([]certificate, 0, len(m))
+	for _, cert := range m {
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+// GetUser returns the user with this id
+func (m usersMap) GetUser(id string) (user, bool) {
+	u, ok := m[id]
+	return u, ok
+}
+
+// PutUser adds the user to the map, replacing any user with the same id
+func (m usersMap) PutUser(u user) error {
+	m[u.ID] = u
+	return nil
+}
+
+// DeleteUser removes the user with this id from the map
+func (m usersMap) DeleteUser(id string) error {
+	delete(m, id)
+	return nil
+}
+
+// ListUsers returns all the users in the map
+func (m usersMap) ListUsers() []user {
+	list := make([]user, 0, len(m))
+	for _, u := range m {
+		list = append(list, u)
+	}
+	return list
+}
+
+// GetTransfer returns the transfer with this id
+func (m transfersMap) GetTransfer(id string) (transfer, bool) {
+	xfer, ok := m[id]
+	return xfer, ok
+}
+
+// PutTransfer adds the transfer to the map, replacing any transfer with the same id
+func (m transfersMap) PutTransfer(xfer transfer) error {
+	m[xfer.ID] = xfer
+	return nil
+}
+
+// ListTransfers returns all the transfers in the map
+func (m transfersMap) ListTransfers() []transfer {
+	list := make([]transfer, 0, len(m))
+	for _, xfer := range m {
+		list = append(list, xfer)
+	}
+	return list
+}
+
+// GetWebhook returns the webhook with this id
+func (m webhooksMap) GetWebhook(id string) (webhook, bool) {
+	hook, ok := m[id]
+	return hook, ok
+}
+
+// PutWebhook adds the webhook to the map, replacing any webhook with the same id
+func (m webhooksMap) PutWebhook(hook webhook) error {
+	m[hook.ID] = hook
+	return nil
+}
+
+// DeleteWebhook removes the webhook with this id from the map
+func (m webhooksMap) DeleteWebhook(id string) error {
+	delete(m, id)
+	return nil
+}
+
+// ListWebhooks returns all the webhooks in the map
+func (m webhooksMap) ListWebhooks() []webhook {
+	list := make([]webhook, 0, len(m))
+	for _, hook := range m {
+		list = append(list, hook)
+	}
+	return list
+}
+
+// AddRevision appends the revision to those of its certificate
+func (m revisionsMap) AddRevision(rev revision) error {
+	m[rev.CertID] = append(m[rev.CertID], rev)
+	return nil
+}
+
+// ListRevisions returns the revisions of the certificate with this id, oldest first
+func (m revisionsMap) ListRevisions(certID string) []revision {
+	return append([]revision(nil), m[certID]...)
+}
+
+// DeleteRevisions removes the revisions of the certificate with this id from the map
+func (m revisionsMap) DeleteRevisions(certID string) error {
+	delete(m, certID)
+	return nil
+}
+
+// changeSet holds changes to the certificates, users, transfers, webhooks and revisions stores that are made together
+type changeSet struct {
+	certs     map[string]*certificate // nil for certificates that are deleted
+	users     map[string]*user        // nil for users that are deleted
+	transfers transfersMap
+	hooks     map[string]*webhook // nil for webhooks that are deleted
+	dropped   map[string]bool     // IDs of the certificates whose revisions are removed, before any are added
+	revisions revisionsMap        // revisions that are added
+}
+
+// empty reports whether the change set holds no change at all
+func (c changeSet) empty() bool {
+	return len(c.certs) == 0 && len(c.users) == 0 && len(c.transfers) == 0 && len(c.hooks) == 0 && len(c.dropped) == 0 && len(c.revisions) == 0
+}
+
+// applyTo makes the changes to the stores one by one
+func (c changeSet) applyTo(certs CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+	for id, cert := range c.certs {
+		var err error
+		if cert == nil {
+			err = certs.DeleteCert(id)
+		} else {
+			err = certs.PutCert(*cert)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for id, u := range c.users {
+		var err error
+		if u == nil {
+			err = users.DeleteUser(id)
+		} else {
+			err = users.PutUser(*u)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, xfer := range c.transfers {
+		if err := transfers.PutTransfer(xfer); err != nil {
+			return err
+		}
+	}
+	for id, hook := range c.hooks {
+		var err error
+		if hook == nil {
+			err = hooks.DeleteWebhook(id)
+		} else {
+			err = hooks.PutWebhook(*hook)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for id := range c.dropped {
+		if err := revisions.DeleteRevisions(id); err != nil {
+			return err
+		}
+	}
+	for _, revs := range c.revisions {
+		for _, rev := range revs {
+			if err := revisions.AddRevision(rev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The buckets of a file store, one for every collection. Claim tokens' hashes are never written with their transfers,
+// so they are kept in a bucket of their own, keyed by transfer ID. The revisions bucket holds a bucket for every
+// certificate, with its revisions in the order they were added
+var (
+	certsBucket     = []byte("certificates")
+	usersBucket     = []byte("users")
+	transfersBucket = []byte("transfers")
+	webhooksBucket  = []byte("webhooks")
+	revisionsBucket = []byte("revisions")
+	claimsBucket    = []byte("claims")
+)
+
+// fileStore keeps certificates, users, transfers, webhooks and revisions in a bbolt database file, so that the data
+// survives a restart of the server. A change only writes the records it touches, and the changes of a request are
+// written in a single transaction
+type fileStore struct {
+	db *bolt.DB
+}
+
+// openFileStore opens the store kept in path, or creates an empty one if the file doesn't exist yet. A store that
+// was kept in a JSON file by earlier versions is moved to path.bak, and its records are copied to the new store
+func openFileStore(path string) (*fileStore, error) {
+	legacy, err := readJSONStore(path)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		if err := os.Rename(path, path+".bak"); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open store %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{certsBucket, usersBucket, transfersBucket, webhooksBucket, revisionsBucket, claimsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s := &fileStore{db}
+	if err == nil && legacy != nil {
+		err = s.apply(*legacy)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open store %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// jsonStore is the JSON file the file store was kept in by earlier versions
+type jsonStore struct {
+	Certificates certsMap          `json:"certificates"`
+	Users        usersMap          `json:"users"`
+	Transfers    transfersMap      `json:"transfers"`
+	Webhooks     webhooksMap       `json:"webhooks"`
+	Revisions    revisionsMap      `json:"revisions"`
+	Claims       map[string]string `json:"claims,omitempty"`
+}
+
+// readJSONStore reads the records of a store kept in a JSON file as the changes that add them. It returns nil
+// when the file doesn't exist, or isn't a JSON file
+func readJSONStore(path string) (*changeSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data = bytes.TrimSpace(data); len(data) == 0 || data[0] != '{' {
+		return nil, nil
+	}
+	var old jsonStore
+	if err := json.Unmarshal(data, &old); err != nil {
+		return nil, fmt.Errorf("cannot read store %s: %v", path, err)
+	}
+
+	// Give the claim tokens' hashes back to their transfers, and to the certificates they are pending on
+	c := &changeSet{
+		certs:     make(map[string]*certificate),
+		users:     make(map[string]*user),
+		transfers: make(transfersMap),
+		hooks:     make(map[string]*webhook),
+		revisions: old.Revisions,
+	}
+	for id, xfer := range old.Transfers {
+		xfer.ClaimTokenHash = old.Claims[id]
+		c.transfers[id] = xfer
+	}
+	for id, cert := range old.Certificates {
+		if cert.Transfer.ID != "" {
+			cert.Transfer.ClaimTokenHash = old.Claims[cert.Transfer.ID]
+		}
+		cert = upgradeCert(cert)
+		c.certs[id] = &cert
+	}
+	for id, u := range old.Users {
+		u := u
+		c.users[id] = &u
+	}
+	for id, hook := range old.Webhooks {
+		hook := hook
+		c.hooks[id] = &hook
+	}
+	return c, nil
+}
+
+// Close closes the database file
+func (s *fileStore) Close() error {
+	return s.db.Close()
+}
+
+// view runs fn on a read-only transaction of the store
+func (s *fileStore) view(fn func(t fileTx)) {
+	s.db.View(func(tx *bolt.Tx) error {
+		fn(fileTx{tx})
+		return nil
+	})
+}
+
+// apply makes the changes in a single transaction, so that either all of them are written or none is
+func (s *fileStore) apply(c changeSet) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t := fileTx{tx}
+		return c.applyTo(t, t, t, t, t)
+	})
+}
+
+// GetCert returns the certificate with this id
+func (s *fileStore) GetCert(id string) (cert certificate, ok bool) {
+	s.view(func(t fileTx) { cert, ok = t.GetCert(id) })
+	return cert, ok
+}
+
+// PutCert adds or replaces the certificate
+func (s *fileStore) PutCert(cert certificate) error {
+	return s.apply(changeSet{certs: map[string]*certificate{cert.ID: &cert}})
+}
+
+// DeleteCert removes the certificate
+func (s *fileStore) DeleteCert(id string) error {
+	return s.apply(changeSet{certs: map[string]*certificate{id: nil}})
+}
+
+// ListCerts returns all the stored certificates
+func (s *fileStore) ListCerts() (certs []certificate) {
+	s.view(func(t fileTx) { certs = t.ListCerts() })
+	return certs
+}
+
+// GetUser returns the user with this id
+func (s *fileStore) GetUser(id string) (u user, ok bool) {
+	s.view(func(t fileTx) { u, ok = t.GetUser(id) })
+	return u, ok
+}
+
+// PutUser adds or replaces the user
+func (s *fileStore) PutUser(u user) error {
+	return s.apply(changeSet{users: map[string]*user{u.ID: &u}})
+}
+
+// DeleteUser removes the user
+func (s *fileStore) DeleteUser(id string) error {
+	return s.apply(changeSet{users: map[string]*user{id: nil}})
+}
+
+// ListUsers returns all the stored users
+func (s *fileStore) ListUsers() (list []user) {
+	s.view(func(t fileTx) { list = t.ListUsers() })
+	return list
+}
+
+// GetTransfer returns the transfer with this id
+func (s *fileStore) GetTransfer(id string) (xfer transfer, ok bool) {
+	s.view(func(t fileTx) { xfer, ok = t.GetTransfer(id) })
+	return xfer, ok
+}
+
+// PutTransfer adds or replaces the transfer
+func (s *fileStore) PutTransfer(xfer transfer) error {
+	return s.apply(changeSet{transfers: transfersMap{xfer.ID: xfer}})
+}
+
+// ListTransfers returns all the stored transfers
+func (s *fileStore) ListTransfers() (list []transfer) {
+	s.view(func(t fileTx) { list = t.ListTransfers() })
+	return list
+}
+
+// GetWebhook returns the webhook with this id
+func (s *fileStore) GetWebhook(id string) (hook webhook, ok bool) {
+	s.view(func(t fileTx) { hook, ok = t.GetWebhook(id) })
+	return hook, ok
+}
+
+// PutWebhook adds or replaces the webhook
+func (s *fileStore) PutWebhook(hook webhook) error {
+	return s.apply(changeSet{hooks: map[string]*webhook{hook.ID: &hook}})
+}
+
+// DeleteWebhook removes the webhook
+func (s *fileStore) DeleteWebhook(id string) error {
+	return s.apply(changeSet{hooks: map[string]*webhook{id: nil}})
+}
+
+// ListWebhooks returns all the stored webhooks
+func (s *fileStore) ListWebhooks() (list []webhook) {
+	s.view(func(t fileTx) { list = t.ListWebhooks() })
+	return list
+}
+
+// AddRevision appends the revision
+func (s *fileStore) AddRevision(rev revision) error {
+	return s.apply(changeSet{revisions: revisionsMap{rev.CertID: {rev}}})
+}
+
+// ListRevisions returns the stored revisions of the certificate with this id, oldest first
+func (s *fileStore) ListRevisions(certID string) (list []revision) {
+	s.view(func(t fileTx) { list = t.ListRevisions(certID) })
+	return list
+}
+
+// DeleteRevisions removes the revisions of the certificate with this id
+func (s *fileStore) DeleteRevisions(certID string) error {
+	return s.apply(changeSet{dropped: map[string]bool{certID: true}})
+}
+
+// fileTx reads and writes the records of a file store within one of its transactions. Records are kept as JSON,
+// keyed by their IDs
+type fileTx struct {
+	tx *bolt.Tx
+}
+
+// get reads the record with this key from the bucket into v, and reports whether it is there
+func (t fileTx) get(bucket []byte, key string, v interface{}) bool {
+	data := t.tx.Bucket(bucket).Get([]byte(key))
+	return data != nil && json.Unmarshal(data, v) == nil
+}
+
+// put writes v to the bucket under this key
+func (t fileTx) put(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.tx.Bucket(bucket).Put([]byte(key), data)
+}
+
+// each reads every record of the bucket into a new value made by newValue, and passes it to fn
+func (t fileTx) each(bucket []byte, newValue func() interface{}, fn func(v interface{})) {
+	t.tx.Bucket(bucket).ForEach(func(_, data []byte) error {
+		v := newValue()
+		if json.Unmarshal(data, v) == nil {
+			fn(v)
+		}
+		return nil
+	})
+}
+
+// claimHash returns the hash of the claim token of the transfer with this id, if it has one
+func (t fileTx) claimHash(xferID string) string {
+	return string(t.tx.Bucket(claimsBucket).Get([]byte(xferID)))
+}
+
+// withClaimHash gives the certificate's transfer back the hash of its claim token
+func (t fileTx) withClaimHash(cert certificate) certificate {
+	if cert.Transfer.ID != "" {
+		cert.Transfer.ClaimTokenHash = t.claimHash(cert.Transfer.ID)
+	}
+	return cert
+}
+
+// GetCert returns the certificate with this id
+func (t fileTx) GetCert(id string) (certificate, bool) {
+	var cert certificate
+	if !t.get(certsBucket, id, &cert) {
+		return certificate{}, false
+	}
+	return t.withClaimHash(cert), true
+}
+
+// PutCert adds or replaces the certificate
+func (t fileTx) PutCert(cert certificate) error {
+	return t.put(certsBucket, cert.ID, cert)
+}
+
+// DeleteCert removes the certificate
+func (t fileTx) DeleteCert(id string) error {
+	return t.tx.Bucket(certsBucket).Delete([]byte(id))
+}
+
+// ListCerts returns all the certificates
+func (t fileTx) ListCerts() []certificate {
+	var certs []certificate
+	t.each(certsBucket, func() interface{} { return new(certificate) }, func(v interface{}) {
+		certs = append(certs, t.withClaimHash(*v.(*certificate)))
+	})
+	return certs
+}
+
+// GetUser returns the user with this id
+func (t fileTx) GetUser(id string) (user, bool) {
+	var u user
+	ok := t.get(usersBucket, id, &u)
+	return u, ok
+}
+
+// PutUser adds or replaces the user
+func (t fileTx) PutUser(u user) error {
+	return t.put(usersBucket, u.ID, u)
+}
+
+// DeleteUser removes the user
+func (t fileTx) DeleteUser(id string) error {
+	return t.tx.Bucket(usersBucket).Delete([]byte(id))
+}
+
+// ListUsers returns all the users
+func (t fileTx) ListUsers() []user {
+	var list []user
+	t.each(usersBucket, func() interface{} { return new(user) }, func(v interface{}) {
+		list = append(list, *v.(*user))
+	})
+	return list
+}
+
+// GetTransfer returns the transfer with this id
+func (t fileTx) GetTransfer(id string) (transfer, bool) {
+	var xfer transfer
+	if !t.get(transfersBucket, id, &xfer) {
+		return transfer{}, false
+	}
+	xfer.ClaimTokenHash = t.claimHash(id)
+	return xfer, true
+}
+
+// PutTransfer adds or replaces the transfer, and keeps the hash of its claim token apart
+func (t fileTx) PutTransfer(xfer transfer) error {
+	if err := t.put(transfersBucket, xfer.ID, xfer); err != nil {
+		return err
+	}
+	if xfer.ClaimTokenHash != "" {
+		return t.tx.Bucket(claimsBucket).Put([]byte(xfer.ID), []byte(xfer.ClaimTokenHash))
+	}
+	return t.tx.Bucket(claimsBucket).Delete([]byte(xfer.ID))
+}
+
+// ListTransfers returns all the transfers
+func (t fileTx) ListTransfers() []transfer {
+	var list []transfer
+	t.each(transfersBucket, func() interface{} { return new(transfer) }, func(v interface{}) {
+		xfer := *v.(*transfer)
+		xfer.ClaimTokenHash = t.claimHash(xfer.ID)
+		list = append(list, xfer)
+	})
+	return list
+}
+
+// GetWebhook returns the webhook with this id
+func (t fileTx) GetWebhook(id string) (webhook, bool) {
+	var hook webhook
+	ok := t.get(webhooksBucket, id, &hook)
+	return hook, ok
+}
+
+// PutWebhook adds or replaces the webhook
+func (t fileTx) PutWebhook(hook webhook) error {
+	return t.put(webhooksBucket, hook.ID, hook)
+}
+
+// DeleteWebhook removes the webhook
+func (t fileTx) DeleteWebhook(id string) error {
+	return t.tx.Bucket(webhooksBucket).Delete([]byte(id))
+}
+
+// ListWebhooks returns all the webhooks
+func (t fileTx) ListWebhooks() []webhook {
+	var list []webhook
+	t.each(webhooksBucket, func() interface{} { return new(webhook) }, func(v interface{}) {
+		list = append(list, *v.(*webhook))
+	})
+	return list
+}
+
+// AddRevision appends the revision to the bucket of its certificate
+func (t fileTx) AddRevision(rev revision) error {
+	revs, err := t.tx.Bucket(revisionsBucket).CreateBucketIfNotExists([]byte(rev.CertID))
+	if err != nil {
+		return err
+	}
+	seq, err := revs.NextSequence()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], seq) // so that the revisions are kept in the order they were added
+	return revs.Put(key[:], data)
+}
+
+// ListRevisions returns the revisions of the certificate with this id, oldest first
+func (t fileTx) ListRevisions(certID string) []revision {
+	revs := t.tx.Bucket(revisionsBucket).Bucket([]byte(certID))
+	if revs == nil {
+		return nil
+	}
+	var list []revision
+	revs.ForEach(func(_, data []byte) error {
+		var rev revision
+		if json.Unmarshal(data, &rev) == nil {
+			list = append(list, rev)
+		}
+		return nil
+	})
+	return list
+}
+
+// DeleteRevisions removes the revisions of the certificate with this id
+func (t fileTx) DeleteRevisions(certID string) error {
+	if err := t.tx.Bucket(revisionsBucket).DeleteBucket([]byte(certID)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+// openStore returns the certificates, users, transfers, webhooks and revisions stores of the requested kind ("memory" or "file")
+func openStore(kind, path string) (CertificateStore, UserStore, TransferStore, WebhookStore, RevisionStore, error) {
+	switch kind {
+	case "memory":
+		return make(certsMap), make(usersMap), make(transfersMap), make(webhooksMap), make(revisionsMap), nil
+	case "file":
+		s, err := openFileStore(path)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		return s, s, s, s, s, nil
+	default:
+		return nil, nil, nil, nil, nil, fmt.Errorf("unknown store %q", kind)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// TestFileStoreSurvivesReopen saves a user and a certificate to a file store, reopens it and verifies that both are still there
+func TestFileStoreSurvivesReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certificates.db")
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutUser(user{"10", "test10@test.com", "Test User 10", ""}); err != nil {
+		t.Fatal(err)
+	}
+	cert := certificate{ID: "1", Title: "first cert", IssuedAt: "2019-03-29", OwnerID: "10", Year: 2019}
+	if err := s.PutCert(cert); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Close()
+	reopened, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reopened.GetCert("1"); !ok || got != cert {
+		t.Errorf("\nExpected %v\nGot\t %v", cert, got)
+	}
+	if _, ok := reopened.GetUser("10"); !ok {
+		t.Errorf("User 10 wasn't saved")
+	}
+
+	xfer := transfer{ID: "t1", CertID: "1", FromUserID: "10", ToUserID: "12", To: "test12@test.com", Status: transferRejected}
+	if err := reopened.PutTransfer(xfer); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	reopened, err = openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reopened.GetTransfer("t1"); !ok || got != xfer {
+		t.Errorf("\nExpected %v\nGot\t %v", xfer, got)
+	}
+
+	hook := webhook{ID: "w1", URL: "http://localhost:9/hook", Events: []string{eventCertCreated}, Secret: "secret"}
+	if err := reopened.PutWebhook(hook); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	reopened, err = openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reopened.GetWebhook("w1"); !ok || got.Secret != hook.Secret || got.URL != hook.URL {
+		t.Errorf("\nExpected %v\nGot\t %v", hook, got)
+	}
+
+	rev := revision{CertID: "1", Version: 1, At: "2019-03-29T10:00:00Z", Certificate: cert}
+	if err := reopened.AddRevision(rev); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	reopened, err = openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.ListRevisions("1"); len(got) != 1 || got[0] != rev {
+		t.Errorf("\nExpected %v\nGot\t %v", rev, got)
+	}
+
+	if err := reopened.DeleteCert("1"); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	reopened, err = openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.GetCert("1"); ok {
+		t.Errorf("Certificate 1 wasn't deleted")
+	}
+	reopened.Close()
+}
+
+// TestOpenStoreUnknownKind verifies that an unknown store kind is rejected
+func TestOpenStoreUnknownKind(t *testing.T) {
+	if _, _, _, _, _, err := openStore("nosuchstore", ""); err == nil {
+		t.Errorf("Expected an error for an unknown store kind")
+	}
+}
+
+// TestFileStoreUpgradesCreationDates opens a store saved before certificates had an issue date, and verifies
+// that the dates clients wrote as createdAt become issue dates
+func TestFileStoreUpgradesCreationDates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certificates.json")
+	legacy := `{"certificates":{"1":{"id":"1","title":"first cert","createdAt":"29 MAR 2019","ownerId":"10","year":2019},"2":{"id":"2","title":"second cert","createdAt":"last spring","ownerId":"10","year":2019}}}`
+	if err := ioutil.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := os.Stat(path + ".bak"); err != nil {
+		t.Errorf("Expected the JSON store to be kept as %s.bak: %v", path, err)
+	}
+	for id, issuedAt := range map[string]string{"1": "2019-03-29", "2": "last spring"} {
+		if cert, _ := s.GetCert(id); cert.IssuedAt != issuedAt || cert.CreatedAt != "" {
+			t.Errorf("Expected certificate %s to be issued at %s, at an unknown time. Got %+v", id, issuedAt, cert)
+		}
+	}
+}
+
+// TestFileStoreKeepsUnsavedChangesOut makes the file store fail to save, and verifies that the changes it couldn't save
+// are not seen by later reads
+func TestFileStoreKeepsUnsavedChangesOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certificates.db")
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := certificate{ID: "1", Title: "first cert", IssuedAt: "2019-03-29", OwnerID: "10", Year: 2019}
+	if err := s.PutCert(cert); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openReadOnlyFileStore(t, path)
+	defer s.Close()
+	second := certificate{ID: "2", Title: "second cert", IssuedAt: "2019-03-29", OwnerID: "10", Year: 2019}
+	if err := s.apply(changeSet{certs: map[string]*certificate{"1": nil, "2": &second}}); err == nil {
+		t.Fatal("Expected the save to fail")
+	}
+	if _, ok := s.GetCert("2"); ok {
+		t.Errorf("Certificate 2 wasn't saved, but is in the store")
+	}
+	if got, ok := s.GetCert("1"); !ok || got != cert {
+		t.Errorf("Certificate 1 wasn't deleted from the file, but is gone from the store")
+	}
+}
+
+// openReadOnlyFileStore opens the file store kept in path so that it can be read, but every change to it fails
+func openReadOnlyFileStore(t *testing.T, path string) *fileStore {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fileStore{db}
+}
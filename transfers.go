@@ -0,0 +1,292 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The states of a transfer. A transfer starts as Requested and ends in exactly one of the other states
+const (
+	transferRequested = "Requested"
+	transferAccepted  = "Accepted"
+	transferRejected  = "Rejected"
+	transferCancelled = "Cancelled"
+	transferExpired   = "Expired"
+)
+
+// transferTransitions lists the states each state may move to. States that aren't listed are final
+var transferTransitions = map[string][]string{
+	transferRequested: {transferAccepted, transferRejected, transferCancelled, transferExpired},
+}
+
+// transferTTL is how long a transfer may stay pending before it expires. Zero means transfers never expire
+var transferTTL = 7 * 24 * time.Hour
+
+// state returns the state of the transfer at this time. A pending transfer whose expiry has passed is Expired,
+// even before expireTransfers gets to it. A certificate that isn't being transferred has no state
+func (xfer transfer) state(now time.Time) string {
+	if xfer.Status != transferRequested || xfer.ExpiresAt == "" {
+		return xfer.Status
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, xfer.ExpiresAt); err == nil && !now.Before(expiresAt) {
+		return transferExpired
+	}
+	return xfer.Status
+}
+
+// pending checks whether the transfer is still waiting for its recipient
+func (xfer transfer) pending() bool {
+	return xfer.state(time.Now()) == transferRequested
+}
+
+// requestTransfer turns a transfer request into a new transfer of the certificate from its owner to the recipient,
+// stamped with the time it was requested and the time it expires. The recipient is empty when nobody has registered
+// the address the transfer is sent to
+func requestTransfer(xfer transfer, cert certificate, recipient user, now time.Time) transfer {
+	xfer.ID = newID()
+	xfer.CertID = cert.ID
+	xfer.FromUserID = cert.OwnerID
+	xfer.ToUserID = recipient.ID
+	xfer.Status = transferRequested
+	xfer.RequestedAt = now.UTC().Format(time.RFC3339Nano)
+	xfer.ExpiresAt = ""
+	if transferTTL > 0 {
+		xfer.ExpiresAt = now.Add(transferTTL).UTC().Format(time.RFC3339Nano)
+	}
+	xfer.ResolvedAt = ""
+	xfer.ClaimToken, xfer.ClaimTokenHash = "", ""
+	return xfer
+}
+
+// resolveTransfer moves the pending transfer of the certificate to a final state, and returns the transfer as it ended,
+// to be saved in the transfers store. The certificate is left with no transfer, so that a new one can be requested
+func resolveTransfer(cert *certificate, to string, now time.Time) (transfer, error) {
+	from := cert.Transfer.Status
+	switch {
+	case from == "":
+		return transfer{}, newAPIError(http.StatusConflict, codeNoTransferRequested, "No transfer has been requested for certificate "+cert.ID+".").with("certId", cert.ID)
+	case to != transferExpired && cert.Transfer.state(now) == transferExpired:
+		return transfer{}, newAPIError(http.StatusConflict, codeTransferExpired, "The transfer of certificate "+cert.ID+" expired at "+cert.Transfer.ExpiresAt+".").with("certId", cert.ID).with("expiresAt", cert.Transfer.ExpiresAt)
+	}
+
+	allowed := false
+	for _, state := range transferTransitions[from] {
+		if state == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return transfer{}, newAPIError(http.StatusConflict, codeInvalidTransferTransition, "The transfer of certificate "+cert.ID+" cannot move from "+from+" to "+to+".").with("certId", cert.ID).with("from", from).with("to", to)
+	}
+
+	xfer := cert.Transfer
+	if xfer.ID == "" {
+		xfer.ID = newID() // transfers set directly on a certificate weren't recorded when they were requested
+		xfer.CertID = cert.ID
+	}
+	xfer.Status = to
+	xfer.ResolvedAt = now.UTC().Format(time.RFC3339Nano)
+	cert.Transfer = transfer{}
+	return xfer, nil
+}
+
+// closeTransfer handles a request to move the pending transfer of a certificate to a final state.
+// The user must be allowed to perform the action, and the transfer must still be pending. verb names the request in errors
+func closeTransfer(w http.ResponseWriter, r *http.Request, verb string, a action, to string) {
+	certID := mux.Vars(r)["id"]
+
+	var xfer transfer
+	var messages []message
+	var deliveries []*delivery
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		cert, ok := liveCert(certificates, certID)
+		if !ok {
+			return newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist. Cannot "+verb+" transfer.").with("certId", certID)
+		}
+		// A transfer that is no longer pending has no recipient, so the user's permission cannot be checked against it.
+		// Only users that may read the certificate, or that the lapsed transfer was sent to, are told what became of it
+		now := time.Now()
+		if cert.Transfer.state(now) == transferRequested {
+			if err := authorize(r, a, target{cert: &cert}); err != nil {
+				return err
+			}
+		} else if u, _ := currentUser(r); cert.Transfer.To == "" || cert.Transfer.To != u.Email {
+			if err := authorize(r, actionReadCert, target{cert: &cert}); err != nil {
+				return err
+			}
+		}
+		if err := checkIfMatch(r, revisions, certID); err != nil {
+			return err
+		}
+		// An invitation goes to whoever holds its claim token, and not to whoever has its address by then
+		if to == transferAccepted && cert.Transfer.state(now) == transferRequested && cert.Transfer.ClaimTokenHash != "" {
+			return newAPIError(http.StatusForbidden, codeClaimTokenInvalid, "Transfer of certificate "+certID+" is an invitation. Send its claim token to accept it.").with("certId", certID)
+		}
+
+		var err error
+		if xfer, err = resolveTransfer(&cert, to, now); err != nil {
+			return err
+		}
+		if to == transferAccepted {
+			recipient, ok := userByEmail(users, xfer.To)
+			if !ok {
+				return newAPIError(http.StatusUnprocessableEntity, codeTransferTargetInvalid, "Target "+xfer.To+" isn't valid.").with("to", xfer.To)
+			}
+			xfer.ToUserID = recipient.ID
+			cert.OwnerID = recipient.ID
+		}
+		if err := transfers.PutTransfer(xfer); err != nil {
+			return err
+		}
+		messages = transferMessages(users, cert, xfer)
+		deliveries = transferDeliveries(hooks, xfer)
+		return certificates.PutCert(cert)
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		notifications.send(messages...)
+		webhookDeliveries.send(deliveries...)
+		json.NewEncoder(w).Encode(xfer) // Return a JSON with the transfer as it ended
+	}
+}
+
+// rejectTransfer lets the recipient decline the pending transfer of a certificate
+func rejectTransfer(w http.ResponseWriter, r *http.Request) {
+	closeTransfer(w, r, "reject", actionRejectTransfer, transferRejected)
+}
+
+// cancelTransfer lets the owner withdraw the pending transfer of a certificate
+func cancelTransfer(w http.ResponseWriter, r *http.Request) {
+	closeTransfer(w, r, "cancel", actionCancelTransfer, transferCancelled)
+}
+
+// expireTransfers ends every pending transfer whose expiry has passed, and returns the transfers it ended
+func expireTransfers(certificates CertificateStore, transfers TransferStore, now time.Time) ([]transfer, error) {
+	var expired []transfer
+	for _, cert := range certificates.ListCerts() {
+		if cert.Transfer.Status != transferRequested || cert.Transfer.state(now) != transferExpired {
+			continue
+		}
+		xfer, err := resolveTransfer(&cert, transferExpired, now)
+		if err != nil {
+			return expired, err
+		}
+		if err := transfers.PutTransfer(xfer); err != nil {
+			return expired, err
+		}
+		if err := certificates.PutCert(cert); err != nil {
+			return expired, err
+		}
+		expired = append(expired, xfer)
+	}
+	return expired, nil
+}
+
+// sweepTransfers expires lapsed transfers every interval. Lapsed transfers are treated as expired as soon as their
+// expiry passes; sweeping them frees their certificates in the store, and lets their owners and recipients know
+func sweepTransfers(interval time.Duration) {
+	for range time.Tick(interval) {
+		var messages []message
+		var deliveries []*delivery
+		db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			expired, err := expireTransfers(certificates, transfers, time.Now())
+			if err != nil {
+				log.Printf("cannot expire transfers: %v", err)
+			} else if len(expired) > 0 {
+				log.Printf("expired %d transfers", len(expired))
+			}
+			// Transfers that expired before an error are saved, so they are notified either way
+			messages = closedTransferMessages(certificates, users, expired)
+			deliveries = transferDeliveries(hooks, expired...)
+			return err
+		})
+		notifications.send(messages...)
+		webhookDeliveries.send(deliveries...)
+	}
+}
+
+// transferSortFields are the fields transfer listings can be sorted by. The first one is the default
+var transferSortFields = []string{"requestedAt", "resolvedAt", "id"}
+
+// listCertTransfers lists the transfers of the certificate with this id, oldest first, one page at a time
+func listCertTransfers(w http.ResponseWriter, r *http.Request) {
+	certID := mux.Vars(r)["id"]
+
+	paging, err := parsePageRequest(r, transferSortFields...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var history []transfer
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		cert, ok := liveCert(certificates, certID)
+		if !ok {
+			return newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist. Cannot list transfers.").with("certId", certID)
+		}
+		if err := authorize(r, actionListCertTransfers, target{cert: &cert}); err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, xfer := range transfers.ListTransfers() {
+			if xfer.CertID == certID {
+				xfer.Status = xfer.state(now)
+				history = append(history, xfer)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(paging.paginate(transferPageItems(history, paging.sortBy))) // Return a JSON with the certificate's transfers
+	}
+}
+
+// listUserTransfers lists the transfers sent or received by the user with this id, one page at a time.
+// The direction query parameter selects the incoming or the outgoing transfers only
+func listUserTransfers(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+
+	paging, err := parsePageRequest(r, transferSortFields...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	direction := r.URL.Query().Get("direction")
+	if direction != "" && direction != "incoming" && direction != "outgoing" {
+		writeError(w, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Direction "+direction+" is invalid. It must be incoming or outgoing.").with("parameter", "direction"))
+		return
+	}
+
+	var list []transfer
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		if _, ok := users.GetUser(userID); !ok {
+			return newAPIError(http.StatusNotFound, codeUserNotFound, "User ID "+userID+" is invalid. Cannot list transfers.").with("userId", userID)
+		}
+		if err := authorize(r, actionListUserTransfers, target{userID: userID}); err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, xfer := range transfers.ListTransfers() {
+			incoming, outgoing := xfer.ToUserID == userID, xfer.FromUserID == userID
+			if (direction == "incoming" && incoming) || (direction == "outgoing" && outgoing) || (direction == "" && (incoming || outgoing)) {
+				xfer.Status = xfer.state(now)
+				list = append(list, xfer)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(paging.paginate(transferPageItems(list, paging.sortBy))) // Return a JSON with the user's transfers
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withPendingTransfer runs fn on a fresh store where certificate 1, owned by user 10, is waiting to be transferred to user 12
+func withPendingTransfer(fn func()) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		executeRequest(req)
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBufferString(`{"to":"test12@test.com"}`))
+		executeRequest(req)
+
+		fn()
+	})
+}
+
+// expireTransferOf moves the expiry of the certificate's pending transfer to the past
+func expireTransferOf(certID string) {
+	db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		cert, _ := certificates.GetCert(certID)
+		cert.Transfer.ExpiresAt = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+		transfers.PutTransfer(cert.Transfer)
+		return certificates.PutCert(cert)
+	})
+}
+
+// checkClosedTransfer verifies the transfer returned by an accept, reject or cancel request, and that certificate 1
+// is no longer being transferred and belongs to the expected owner
+func checkClosedTransfer(t *testing.T, response *http.Response, status, ownerID string) {
+	var xfer transfer
+	json.NewDecoder(response.Body).Decode(&xfer)
+	if xfer.To != "test12@test.com" || xfer.Status != status || xfer.RequestedAt == "" || xfer.ResolvedAt == "" {
+		t.Errorf("Expected a %s transfer to test12@test.com. Got %v", status, xfer)
+	}
+
+	db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		cert, _ := certificates.GetCert("1")
+		if cert.Transfer != (transfer{}) || cert.OwnerID != ownerID {
+			t.Errorf("Expected certificate 1 to belong to user %s with no transfer. Got %v", ownerID, cert)
+		}
+		return nil
+	})
+}
+
+// TestCloseTransfer accepts, rejects and cancels a pending transfer, and verifies where the certificate ends up
+func TestCloseTransfer(t *testing.T) {
+	tests := []struct {
+		method, path, userID, status, ownerID string
+	}{
+		{"PUT", "/certificates/1/transfers", "12", transferAccepted, "12"},
+		{"POST", "/certificates/1/transfers/accept", "12", transferAccepted, "12"},
+		{"POST", "/certificates/1/transfers/reject", "12", transferRejected, "10"},
+		{"POST", "/certificates/1/transfers/cancel", "10", transferCancelled, "10"},
+		{"POST", "/certificates/1/transfers/cancel", "1", transferCancelled, "10"},
+	}
+
+	for _, test := range tests {
+		withPendingTransfer(func() {
+			req, _ := http.NewRequest(test.method, "http://localhost:8080"+test.path, nil)
+			response := executeRequest(asUser(req, test.userID))
+			checkResponseCode(t, http.StatusOK, response.Code)
+			checkClosedTransfer(t, response.Result(), test.status, test.ownerID)
+
+			// The transfer is over, so it cannot be closed again
+			req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers/reject", nil)
+			checkErrorResponse(t, executeRequest(asUser(req, test.ownerID)), http.StatusConflict, codeNoTransferRequested, "No transfer has been requested for certificate 1.")
+		})
+	}
+}
+
+// TestTransferAfterReject verifies that a rejected transfer no longer blocks the certificate
+func TestTransferAfterReject(t *testing.T) {
+	withPendingTransfer(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBufferString(`{"to":"test11@test.com"}`))
+		checkResponseCode(t, http.StatusConflict, executeRequest(req).Code)
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers/reject", nil)
+		checkResponseCode(t, http.StatusOK, executeRequest(asUser(req, "12")).Code)
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBufferString(`{"to":"test11@test.com"}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	})
+}
+
+// TestExpiredTransfer verifies that a transfer cannot be accepted, rejected or cancelled once it has expired,
+// and that it no longer blocks the certificate or gives its recipient access to it
+func TestExpiredTransfer(t *testing.T) {
+	withPendingTransfer(func() {
+		expireTransferOf("1")
+
+		for _, path := range []string{"/certificates/1/transfers/accept", "/certificates/1/transfers/reject", "/certificates/1/transfers/cancel"} {
+			req, _ := http.NewRequest("POST", "http://localhost:8080"+path, nil)
+			response := executeRequest(asUser(req, "12"))
+			checkResponseCode(t, http.StatusConflict, response.Code)
+
+			var e apiError
+			json.Unmarshal(response.Body.Bytes(), &e)
+			if e.Code != codeTransferExpired {
+				t.Errorf("Expected %s for %s. Got %s", codeTransferExpired, path, e.Code)
+			}
+		}
+
+		req, _ := http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+		checkResponseCode(t, http.StatusForbidden, executeRequest(asUser(req, "12")).Code)
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates?transferStatus=Expired", nil)
+		var listed page
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &listed)
+		if len(listed.Items) != 1 {
+			t.Errorf("Expected certificate 1 to be listed as Expired. Got %v", listed.Items)
+		}
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBufferString(`{"to":"test11@test.com"}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	})
+}
+
+// TestClosedTransferHidden verifies that users that may not read a certificate aren't told whether it has a transfer
+func TestClosedTransferHidden(t *testing.T) {
+	withPendingTransfer(func() {
+		expireTransferOf("1")
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers/reject", nil)
+		checkErrorResponse(t, executeRequest(asUser(req, "11")), http.StatusForbidden, codeForbidden, "User 11 is not allowed to read certificate 1.")
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers/cancel", nil)
+		checkResponseCode(t, http.StatusConflict, executeRequest(asUser(req, "10")).Code)
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers/cancel", nil)
+		checkErrorResponse(t, executeRequest(asUser(req, "11")), http.StatusForbidden, codeForbidden, "User 11 is not allowed to read certificate 1.")
+	})
+}
+
+// TestExpireTransfers verifies that the sweep ends lapsed transfers and leaves the others alone
+func TestExpireTransfers(t *testing.T) {
+	withPendingTransfer(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/2", bytes.NewBufferString(`{"title":"second cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		executeRequest(req)
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/2/transfers", bytes.NewBufferString(`{"to":"test11@test.com"}`))
+		executeRequest(req)
+		expireTransferOf("1")
+
+		db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			if expired, err := expireTransfers(certificates, transfers, time.Now()); len(expired) != 1 || err != nil {
+				t.Errorf("Expected 1 transfer to expire. Got %v, %v", expired, err)
+			}
+			if cert, _ := certificates.GetCert("1"); cert.Transfer != (transfer{}) {
+				t.Errorf("Expected the transfer of certificate 1 to be cleared. Got %v", cert.Transfer)
+			}
+			if cert, _ := certificates.GetCert("2"); !cert.Transfer.pending() {
+				t.Errorf("Expected the transfer of certificate 2 to be pending. Got %v", cert.Transfer)
+			}
+			return nil
+		})
+	})
+}
+
+// TestInvalidTransferTransition verifies that a transfer stored in a final state cannot move to another one
+func TestInvalidTransferTransition(t *testing.T) {
+	withPendingTransfer(func() {
+		db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			cert, _ := certificates.GetCert("1")
+			cert.Transfer.Status = transferRejected
+			return certificates.PutCert(cert)
+		})
+
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers/cancel", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusConflict, codeInvalidTransferTransition, "The transfer of certificate 1 cannot move from Rejected to Cancelled.")
+	})
+}
+
+// TestTransfersNeverExpire verifies that a zero transferTTL leaves transfers without an expiry
+func TestTransfersNeverExpire(t *testing.T) {
+	defer func(ttl time.Duration) { transferTTL = ttl }(transferTTL)
+	transferTTL = 0
+
+	xfer := requestTransfer(transfer{To: "test12@test.com"}, certificate{ID: "1", OwnerID: "10"}, user{ID: "12"}, time.Now())
+	if xfer.ExpiresAt != "" || xfer.state(time.Now().Add(100*365*24*time.Hour)) != transferRequested {
+		t.Errorf("Expected a transfer that never expires. Got %v", xfer)
+	}
+}
+
+// listTransfers returns the transfers listed at path as the user with this id
+func listTransfers(t *testing.T, path, userID string) []transfer {
+	req, _ := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+	response := executeRequest(asUser(req, userID))
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var listed struct {
+		Items []transfer `json:"items"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &listed)
+	return listed.Items
+}
+
+// TestAcceptedTransferIsIncoming verifies that an accepted transfer names the user that accepted it, and is listed
+// among that user's incoming transfers
+func TestAcceptedTransferIsIncoming(t *testing.T) {
+	withPendingTransfer(func() {
+		// The recipient registers after the transfer was requested, so the transfer only knows the address
+		db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			cert, _ := certificates.GetCert("1")
+			cert.Transfer.ToUserID = ""
+			transfers.PutTransfer(cert.Transfer)
+			return certificates.PutCert(cert)
+		})
+
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers/accept", nil)
+		response := executeRequest(asUser(req, "12"))
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var xfer transfer
+		json.Unmarshal(response.Body.Bytes(), &xfer)
+		if xfer.ToUserID != "12" {
+			t.Errorf("Expected the transfer to be accepted by user 12. Got %v", xfer)
+		}
+		if incoming := listTransfers(t, "/users/12/transfers?direction=incoming", "12"); len(incoming) != 1 {
+			t.Errorf("Expected the accepted transfer to be incoming to user 12. Got %v", incoming)
+		}
+	})
+}
+
+// TestTransferHistory transfers certificate 1 back and forth, and verifies that every transfer is kept in order
+// with the users involved and its final status
+func TestTransferHistory(t *testing.T) {
+	withPendingTransfer(func() {
+		steps := []struct {
+			method, path, body, userID string
+		}{
+			{"POST", "/certificates/1/transfers/reject", ``, "12"},
+			{"POST", "/certificates/1/transfers", `{"to":"test12@test.com"}`, "10"},
+			{"POST", "/certificates/1/transfers/accept", ``, "12"},
+			{"POST", "/certificates/1/transfers", `{"to":"test11@test.com"}`, "12"},
+		}
+		for _, step := range steps {
+			req, _ := http.NewRequest(step.method, "http://localhost:8080"+step.path, bytes.NewBufferString(step.body))
+			checkResponseCode(t, http.StatusOK, executeRequest(asUser(req, step.userID)).Code)
+		}
+
+		expected := []struct{ from, to, status string }{
+			{"10", "12", transferRejected},
+			{"10", "12", transferAccepted},
+			{"12", "11", transferRequested},
+		}
+		history := listTransfers(t, "/certificates/1/transfers", "12")
+		if len(history) != len(expected) {
+			t.Fatalf("Expected %d transfers. Got %v", len(expected), history)
+		}
+		for i, xfer := range history {
+			if xfer.CertID != "1" || xfer.FromUserID != expected[i].from || xfer.ToUserID != expected[i].to || xfer.Status != expected[i].status {
+				t.Errorf("Expected transfer %d to be %v. Got %v", i, expected[i], xfer)
+			}
+			if (xfer.ResolvedAt == "") != (xfer.Status == transferRequested) {
+				t.Errorf("Expected only the pending transfer to be unresolved. Got %v", xfer)
+			}
+		}
+
+		for _, test := range []struct {
+			path     string
+			expected int
+		}{
+			{"/users/12/transfers", 3},
+			{"/users/12/transfers?direction=incoming", 2},
+			{"/users/12/transfers?direction=outgoing", 1},
+			{"/users/10/transfers?direction=incoming", 0},
+			{"/users/11/transfers", 1},
+		} {
+			if n := len(listTransfers(t, test.path, "1")); n != test.expected {
+				t.Errorf("%s: expected %d transfers. Got %d", test.path, test.expected, n)
+			}
+		}
+
+		req, _ := http.NewRequest("GET", "http://localhost:8080/users/12/transfers?direction=sideways", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusBadRequest, codeInvalidParameter, "Direction sideways is invalid. It must be incoming or outgoing.")
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/9/transfers", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusNotFound, codeCertNotFound, "Certificate ID 9 doesn't exist. Cannot list transfers.")
+	})
+}
+
+// TestLapsedTransferHistory verifies that a transfer that lapsed is listed as Expired, both before it is swept
+// and once a new transfer replaces it
+func TestLapsedTransferHistory(t *testing.T) {
+	withPendingTransfer(func() {
+		expireTransferOf("1")
+		if history := listTransfers(t, "/certificates/1/transfers", "1"); len(history) != 1 || history[0].Status != transferExpired {
+			t.Errorf("Expected one Expired transfer. Got %v", history)
+		}
+
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBufferString(`{"to":"test11@test.com"}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+		db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			statuses := make(map[string]int)
+			for _, xfer := range transfers.ListTransfers() {
+				statuses[xfer.Status]++
+			}
+			if statuses[transferExpired] != 1 || statuses[transferRequested] != 1 {
+				t.Errorf("Expected an Expired and a Requested transfer in the store. Got %v", statuses)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trashRetention is how long a deleted certificate stays in the trash before it is purged. Zero means it stays until it is restored
+var trashRetention = 30 * 24 * time.Hour
+
+// deleted checks whether the certificate is in the trash
+func (cert certificate) deleted() bool {
+	return cert.DeletedAt != ""
+}
+
+// liveCert returns the certificate with this id, unless it is in the trash. Certificates in the trash can only be
+// listed, restored or purged
+func liveCert(certificates CertificateStore, id string) (certificate, bool) {
+	cert, ok := certificates.GetCert(id)
+	return cert, ok && !cert.deleted()
+}
+
+// purgeTrash permanently removes the certificates that have been in the trash for longer than trashRetention,
+// and returns the certificates it removed
+func purgeTrash(certificates CertificateStore, now time.Time) ([]certificate, error) {
+	if trashRetention <= 0 {
+		return nil, nil
+	}
+	var purged []certificate
+	for _, cert := range certificates.ListCerts() {
+		if !cert.deleted() {
+			continue
+		}
+		if deletedAt, err := time.Parse(time.RFC3339, cert.DeletedAt); err != nil || now.Before(deletedAt.Add(trashRetention)) {
+			continue
+		}
+		if err := certificates.DeleteCert(cert.ID); err != nil {
+			return purged, err
+		}
+		purged = append(purged, cert)
+	}
+	return purged, nil
+}
+
+// sweepTrash purges the trash every interval
+func sweepTrash(interval time.Duration) {
+	for range time.Tick(interval) {
+		var deliveries []*delivery
+		db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			purged, err := purgeTrash(certificates, time.Now())
+			if err != nil {
+				log.Printf("cannot purge the trash: %v", err)
+			} else if len(purged) > 0 {
+				log.Printf("purged %d certificates", len(purged))
+			}
+			// Certificates purged before an error are gone, so they are announced either way
+			for _, cert := range purged {
+				deliveries = append(deliveries, newDeliveries(hooks, eventCertPurged, cert)...)
+			}
+			return err
+		})
+		webhookDeliveries.send(deliveries...)
+	}
+}
+
+// restoreCert takes the certificate with this id out of the trash
+func restoreCert(w http.ResponseWriter, r *http.Request) {
+	certID := mux.Vars(r)["id"]
+
+	var cert certificate
+	var etag string
+	var deliveries []*delivery
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var ok bool
+		if cert, ok = certificates.GetCert(certID); !ok {
+			return newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist. Cannot restore certificate.").with("certId", certID)
+		}
+		if err := authorize(r, actionRestoreCert, target{cert: &cert}); err != nil {
+			return err
+		}
+		if !cert.deleted() {
+			return newAPIError(http.StatusConflict, codeCertNotDeleted, "Certificate ID "+certID+" isn't in the trash. Cannot restore certificate.").with("certId", certID)
+		}
+		if err := checkIfMatch(r, revisions, certID); err != nil {
+			return err
+		}
+		cert.DeletedAt = ""
+		if err := saveCert(certificates, &cert); err != nil {
+			return err
+		}
+		etag = certETag(revisions, certID)
+		deliveries = newDeliveries(hooks, eventCertRestored, cert)
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		webhookDeliveries.send(deliveries...)
+		w.Header().Set("ETag", etag)
+		json.NewEncoder(w).Encode(cert) // Return a JSON with the restored certificate
+	}
+}
+
+// trashSortFields are the fields the trash can be sorted by. The first one is the default
+var trashSortFields = []string{"deletedAt", "id", "issuedAt", "createdAt", "updatedAt", "year", "title"}
+
+// listTrash lists the certificates in the trash that the user may read, most recently deleted last, one page at a time
+func listTrash(w http.ResponseWriter, r *http.Request) {
+	paging, err := parsePageRequest(r, trashSortFields...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var certs []certificate
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		for _, cert := range certificates.ListCerts() {
+			if cert.deleted() && mayRead(r, cert) {
+				certs = append(certs, cert)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(paging.paginate(certPageItems(certs, paging.sortBy))) // Return a JSON with the deleted certificates
+}
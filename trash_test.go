@@ -0,0 +1,195 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// listTrashIDs returns the IDs of the certificates in the trash, as the user with this id lists them
+func listTrashIDs(t *testing.T, userID string) []string {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/trash", nil)
+	response := executeRequest(asUser(req, userID))
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var p pageOfCerts
+	json.Unmarshal(response.Body.Bytes(), &p)
+	var ids []string
+	for _, cert := range p.Items {
+		if cert.DeletedAt == "" {
+			t.Errorf("Expected certificate %s in the trash to have a deletion time", cert.ID)
+		}
+		ids = append(ids, cert.ID)
+	}
+	return ids
+}
+
+// TestTrashAndRestore deletes a certificate, and verifies that it is hidden until it is restored
+func TestTrashAndRestore(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		req, _ = http.NewRequest("DELETE", "http://localhost:8080/certificates/1", nil)
+		checkResponseCode(t, http.StatusNoContent, executeRequest(asUser(req, "10")).Code)
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusNotFound, codeCertNotFound, "Certificate ID 1 doesn't exist.")
+		req, _ = http.NewRequest("GET", "http://localhost:8080/users/10/certificates", nil)
+		if body := executeRequest(req).Body.String(); body != "{\"items\":[]}\n" {
+			t.Errorf("Expected the deleted certificate to be left out of the listing. Got %s", body)
+		}
+		if ids := listTrashIDs(t, "10"); len(ids) != 1 || ids[0] != "1" {
+			t.Errorf("Expected certificate 1 in the trash of its owner. Got %v", ids)
+		}
+		if ids := listTrashIDs(t, "11"); len(ids) != 0 {
+			t.Errorf("Expected user 11 to see nothing in the trash. Got %v", ids)
+		}
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"another cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		checkErrorResponse(t, executeRequest(req), http.StatusConflict, codeCertExists, "Certificate ID 1 is in the trash. Restore it, or create the certificate with another ID.")
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/restore", nil)
+		checkResponseCode(t, http.StatusForbidden, executeRequest(asUser(req, "11")).Code)
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/restore", nil)
+		response := executeRequest(asUser(req, "10"))
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var cert certificate
+		json.Unmarshal(response.Body.Bytes(), &cert)
+		if cert.ID != "1" || cert.Title != "first cert" || cert.DeletedAt != "" {
+			t.Errorf("Expected the restored certificate. Got %s", response.Body.String())
+		}
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/restore", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusConflict, codeCertNotDeleted, "Certificate ID 1 isn't in the trash. Cannot restore certificate.")
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	})
+}
+
+// TestRestoreIfMatch verifies that restoring a certificate checks If-Match like the other changes do
+func TestRestoreIfMatch(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		req, _ = http.NewRequest("DELETE", "http://localhost:8080/certificates/1", nil)
+		checkResponseCode(t, http.StatusNoContent, executeRequest(req).Code)
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/restore", nil)
+		req.Header.Set("If-Match", `"1"`)
+		checkErrorResponse(t, executeRequest(req), http.StatusPreconditionFailed, codePreconditionFailed, `Certificate 1 has changed. Its ETag is now "2". Read it again before changing it.`)
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/restore", nil)
+		req.Header.Set("If-Match", `"2"`)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if etag := response.Header().Get("ETag"); etag != `"3"` {
+			t.Errorf("Expected the restored certificate to have ETag \"3\". Got %q", etag)
+		}
+	})
+}
+
+// TestPurgedCertETags purges a certificate and creates another one under its id, and verifies that the ETags
+// clients kept of the purged certificate don't match the new one
+func TestPurgedCertETags(t *testing.T) {
+	saved := trashRetention
+	defer func() { trashRetention = saved }()
+
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		req, _ = http.NewRequest("DELETE", "http://localhost:8080/certificates/1", nil)
+		checkResponseCode(t, http.StatusNoContent, executeRequest(req).Code)
+
+		trashRetention = time.Nanosecond
+		db.update(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			_, err := purgeTrash(certificates, time.Now().Add(time.Second))
+			return err
+		})
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if etag := response.Header().Get("ETag"); etag != `"3"` {
+			t.Errorf("Expected the new certificate to carry on from the purged one's ETag \"2\". Got %q", etag)
+		}
+		for _, etag := range []string{`"1"`, `"2"`} {
+			req, _ = http.NewRequest("PUT", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+			req.Header.Set("If-Match", etag)
+			checkResponseCode(t, http.StatusPreconditionFailed, executeRequest(req).Code)
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1/versions", nil)
+		response = executeRequest(req)
+		var p struct {
+			Items []revision `json:"items"`
+		}
+		json.Unmarshal(response.Body.Bytes(), &p)
+		if len(p.Items) != 1 || p.Items[0].Version != 3 || p.Items[0].Purged {
+			t.Errorf("Expected only the new certificate's version 3. Got %s", response.Body.String())
+		}
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1/versions/3/diff", nil)
+		var diff versionDiff
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &diff)
+		if diff.From != 0 || diff.To != 3 || len(diff.Changes) == 0 {
+			t.Errorf("Expected the first version of the new certificate to be compared with version 0. Got %+v", diff)
+		}
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1/versions/3/diff?from=2", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusNotFound, codeVersionNotFound, "Certificate ID 1 has no version 2.")
+	})
+}
+
+// TestDeleteCertWithPendingTransfer verifies that a certificate that is being transferred is only deleted when forced,
+// and that forcing the deletion cancels the transfer
+func TestDeleteCertWithPendingTransfer(t *testing.T) {
+	withPendingTransfer(func() {
+		req, _ := http.NewRequest("DELETE", "http://localhost:8080/certificates/1", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusConflict, codeTransferInProgress, "Certificate 1 is being transferred to test12@test.com. Cancel the transfer, or pass force=true, to delete it.")
+		req, _ = http.NewRequest("DELETE", "http://localhost:8080/certificates/1?force=maybe", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusBadRequest, codeInvalidParameter, "Force maybe is invalid. It must be true or false.")
+
+		req, _ = http.NewRequest("DELETE", "http://localhost:8080/certificates/1?force=true", nil)
+		checkResponseCode(t, http.StatusNoContent, executeRequest(req).Code)
+
+		db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+			cert, _ := certificates.GetCert("1")
+			if !cert.deleted() || cert.Transfer.Status != "" {
+				t.Errorf("Expected certificate 1 in the trash with no transfer. Got %v", cert)
+			}
+			for _, xfer := range transfers.ListTransfers() {
+				if xfer.Status != transferCancelled {
+					t.Errorf("Expected the transfer to be cancelled. Got %v", xfer)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// TestPurgeTrash verifies that only the certificates that have been in the trash for longer than the retention period are purged
+func TestPurgeTrash(t *testing.T) {
+	saved := trashRetention
+	defer func() { trashRetention = saved }()
+
+	now := time.Now()
+	certificates := certsMap{
+		"old":    {ID: "old", DeletedAt: now.Add(-48 * time.Hour).UTC().Format(time.RFC3339Nano)},
+		"recent": {ID: "recent", DeletedAt: now.Add(-time.Hour).UTC().Format(time.RFC3339Nano)},
+		"live":   {ID: "live"},
+	}
+
+	trashRetention = 0
+	if purged, _ := purgeTrash(certificates, now); len(purged) != 0 {
+		t.Errorf("Expected nothing to be purged without a retention period. Got %v", purged)
+	}
+
+	trashRetention = 24 * time.Hour
+	purged, err := purgeTrash(certificates, now)
+	if err != nil || len(purged) != 1 || purged[0].ID != "old" {
+		t.Errorf("Expected the old certificate to be purged. Got %v, %v", purged, err)
+	}
+	if _, ok := certificates["old"]; ok || len(certificates) != 2 {
+		t.Errorf("Expected the recent and the live certificates to be left. Got %v", certificates)
+	}
+}
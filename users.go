@@ -0,0 +1,202 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// emailInUse checks whether a user other than userID already uses this e-mail address
+func emailInUse(users UserStore, email, userID string) bool {
+	u, ok := userByEmail(users, email)
+	return ok && u.ID != userID
+}
+
+// hasPendingTransferTo checks whether any certificate is waiting to be transferred to this e-mail address
+func hasPendingTransferTo(certificates CertificateStore, email string) bool {
+	return len(pendingTransfersTo(certificates, email)) > 0
+}
+
+// decodeUser populates u with the received payload and validates it. The user ID in the path is authoritative:
+// the body may omit the ID, but it cannot name a different user
+func decodeUser(w http.ResponseWriter, r *http.Request, u *user) error {
+	userID := mux.Vars(r)["id"]
+
+	if err := decodeBody(w, r, u); err != nil {
+		return err
+	}
+	if u.ID != "" && u.ID != userID {
+		return newAPIError(http.StatusUnprocessableEntity, codeUserIDMismatch, "User ID "+u.ID+" doesn't match the requested user ID "+userID+".").with("userId", userID).with("bodyId", u.ID)
+	}
+	u.ID = userID
+	return validateUser(*u)
+}
+
+// createUser creates a user and adds it to the users store
+func createUser(w http.ResponseWriter, r *http.Request) {
+	var u user
+	if err := decodeUser(w, r, &u); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var messages []message
+	var deliveries []*delivery
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var err error
+		messages, deliveries, err = addUser(r, certificates, users, transfers, hooks, u)
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		notifications.send(messages...)
+		webhookDeliveries.send(deliveries...)
+		json.NewEncoder(w).Encode(u) // Return a JSON with the new user
+	}
+}
+
+// addUser adds a new, validated user to the stores on behalf of the user that sent the request, and gives the new user
+// the certificates that were sent to the user's e-mail address. It returns what to send once the change is saved
+func addUser(r *http.Request, certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, u user) ([]message, []*delivery, error) {
+	if err := authorize(r, actionCreateUser, target{userID: u.ID}); err != nil {
+		return nil, nil, err
+	}
+	if _, ok := users.GetUser(u.ID); ok {
+		return nil, nil, newAPIError(http.StatusConflict, codeUserExists, "User ID "+u.ID+" already exists. Cannot create user.").with("userId", u.ID)
+	}
+	// Transfers are addressed by e-mail, so every e-mail address must belong to a single user
+	if emailInUse(users, u.Email, u.ID) {
+		return nil, nil, newAPIError(http.StatusConflict, codeEmailInUse, "E-mail address "+u.Email+" is already in use. Cannot create user.").with("email", u.Email)
+	}
+	if err := users.PutUser(u); err != nil {
+		return nil, nil, err
+	}
+	// Certificates sent to the user's address before the user registered now belong to the user
+	claimed, err := claimInvitations(certificates, transfers, u, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	return closedTransferMessages(certificates, users, claimed), transferDeliveries(hooks, claimed...), nil
+}
+
+// getUser returns the user with this id
+func getUser(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+
+	var u user
+	err := db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var ok bool
+		if u, ok = users.GetUser(userID); !ok {
+			return newAPIError(http.StatusNotFound, codeUserNotFound, "User ID "+userID+" doesn't exist.").with("userId", userID)
+		}
+		return authorize(r, actionReadUser, target{userID: userID})
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(u) // Return a JSON with the user
+	}
+}
+
+// updateUser updates an existing user
+func updateUser(w http.ResponseWriter, r *http.Request) {
+	var u user
+	if err := decodeUser(w, r, &u); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		return replaceUser(r, certificates, users, u)
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(u) // Return a JSON with the updated user
+	}
+}
+
+// replaceUser replaces an existing user in the stores with a validated one, on behalf of the user that sent the request
+func replaceUser(r *http.Request, certificates CertificateStore, users UserStore, u user) error {
+	current, ok := users.GetUser(u.ID)
+	if !ok {
+		return newAPIError(http.StatusNotFound, codeUserNotFound, "User ID "+u.ID+" doesn't exist. Cannot update user.").with("userId", u.ID)
+	}
+	if err := authorize(r, actionUpdateUser, target{userID: u.ID}); err != nil {
+		return err
+	}
+	// Users may change their own details, but only an admin may change their role
+	if u.Role != current.Role {
+		if err := authorize(r, actionChangeRole, target{userID: u.ID}); err != nil {
+			return err
+		}
+	}
+	if emailInUse(users, u.Email, u.ID) {
+		return newAPIError(http.StatusConflict, codeEmailInUse, "E-mail address "+u.Email+" is already in use. Cannot update user.").with("email", u.Email)
+	}
+	// A pending transfer is addressed to the old e-mail address, and would be lost if it changed
+	if u.Email != current.Email && hasPendingTransferTo(certificates, current.Email) {
+		return newAPIError(http.StatusConflict, codeUserHasPendingTransfers, "User ID "+u.ID+" has pending incoming transfers. Cannot change e-mail address.").with("userId", u.ID)
+	}
+	// Invitations to the new address belong to whoever holds their claim tokens, and must not go to the user instead
+	if u.Email != current.Email && hasPendingTransferTo(certificates, u.Email) {
+		return newAPIError(http.StatusConflict, codeEmailInUse, "E-mail address "+u.Email+" has pending invitations. Cannot update user.").with("email", u.Email)
+	}
+	return users.PutUser(u)
+}
+
+// deleteUser deletes a user that doesn't own any certificate and isn't the target of a pending transfer
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		u, ok := users.GetUser(userID)
+		if !ok {
+			return newAPIError(http.StatusNotFound, codeUserNotFound, "User ID "+userID+" doesn't exist. Cannot delete user.").with("userId", userID)
+		}
+		if err := authorize(r, actionDeleteUser, target{userID: userID}); err != nil {
+			return err
+		}
+		for _, cert := range certificates.ListCerts() {
+			if cert.OwnerID == userID {
+				return newAPIError(http.StatusConflict, codeUserOwnsCertificates, "User ID "+userID+" still owns certificate "+cert.ID+". Cannot delete user.").with("userId", userID).with("certId", cert.ID)
+			}
+		}
+		if hasPendingTransferTo(certificates, u.Email) {
+			return newAPIError(http.StatusConflict, codeUserHasPendingTransfers, "User ID "+userID+" has pending incoming transfers. Cannot delete user.").with("userId", userID)
+		}
+		return users.DeleteUser(userID)
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listUsers lists all the currently defined users, one page at a time
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	paging, err := parsePageRequest(r, "id")
+	if err == nil {
+		err = authorize(r, actionListUsers, target{})
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var list []user
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		list = users.ListUsers()
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(paging.paginate(userPageItems(list))) // Return a JSON with the users
+}
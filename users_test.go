@@ -0,0 +1,103 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+// TestUserLifeCycle creates, reads, updates, lists and deletes a user
+func TestUserLifeCycle(t *testing.T) {
+	withTestStore(func() {
+		u := []byte(`{"id":"20","email":"test20@test.com","name":"Test User 20"}`)
+		req, _ := http.NewRequest("POST", "http://localhost:8080/users/20", bytes.NewBuffer(u))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if pass, _ := IsEqualJSON(response.Body.String(), string(u)); !pass {
+			t.Errorf("\nExpected %s\nGot\t %s", u, response.Body.String())
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/users/20", nil)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if pass, _ := IsEqualJSON(response.Body.String(), string(u)); !pass {
+			t.Errorf("\nExpected %s\nGot\t %s", u, response.Body.String())
+		}
+
+		// The ID may be omitted from the body, as the path names the user
+		updated := []byte(`{"email":"test20@example.com","name":"Updated User 20"}`)
+		req, _ = http.NewRequest("PUT", "http://localhost:8080/users/20", bytes.NewBuffer(updated))
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		expected := `{"id":"20","email":"test20@example.com","name":"Updated User 20"}`
+		if pass, _ := IsEqualJSON(response.Body.String(), expected); !pass {
+			t.Errorf("\nExpected %s\nGot\t %s", expected, response.Body.String())
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/users", nil)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		expected = `{"items":[{"id":"1","email":"admin@test.com","name":"Test Admin","role":"admin"},` +
+			`{"id":"10","email":"test10@test.com","name":"Test User 10"},` +
+			`{"id":"11","email":"test11@test.com","name":"Test User 11"},` +
+			`{"id":"12","email":"test12@test.com","name":"Test User 12"},` +
+			`{"id":"20","email":"test20@example.com","name":"Updated User 20"}]}`
+		if pass, _ := IsEqualJSON(response.Body.String(), expected); !pass {
+			t.Errorf("\nExpected %s\nGot\t %s", expected, response.Body.String())
+		}
+
+		req, _ = http.NewRequest("DELETE", "http://localhost:8080/users/20", nil)
+		checkResponseCode(t, http.StatusNoContent, executeRequest(req).Code)
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/users/20", nil)
+		response = executeRequest(req)
+		checkErrorResponse(t, response, http.StatusNotFound, codeUserNotFound, "User ID 20 doesn't exist.")
+	})
+}
+
+// TestUserErrors checks that invalid user requests are rejected with the right status, error code and message
+func TestUserErrors(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		executeRequest(req)
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBuffer([]byte(`{"to":"test12@test.com","status":"Requested"}`)))
+		executeRequest(req)
+
+		tests := []struct {
+			name, method, path, body string
+			status                   int
+			code, message            string
+		}{
+			{"existing ID", "POST", "/users/10", `{"email":"test20@test.com"}`, http.StatusConflict, codeUserExists, "User ID 10 already exists. Cannot create user."},
+			{"duplicate e-mail", "POST", "/users/20", `{"email":"test10@test.com"}`, http.StatusConflict, codeEmailInUse, "E-mail address test10@test.com is already in use. Cannot create user."},
+			{"missing e-mail", "POST", "/users/20", `{"name":"Test User 20"}`, http.StatusUnprocessableEntity, codeValidationFailed, "User 20 is invalid."},
+			{"mismatched ID", "POST", "/users/20", `{"id":"21","email":"test21@test.com"}`, http.StatusUnprocessableEntity, codeUserIDMismatch, "User ID 21 doesn't match the requested user ID 20."},
+			{"update unknown user", "PUT", "/users/20", `{"email":"test20@test.com"}`, http.StatusNotFound, codeUserNotFound, "User ID 20 doesn't exist. Cannot update user."},
+			{"update to duplicate e-mail", "PUT", "/users/11", `{"email":"test10@test.com"}`, http.StatusConflict, codeEmailInUse, "E-mail address test10@test.com is already in use. Cannot update user."},
+			{"change e-mail with pending transfer", "PUT", "/users/12", `{"email":"test12@example.com"}`, http.StatusConflict, codeUserHasPendingTransfers, "User ID 12 has pending incoming transfers. Cannot change e-mail address."},
+			{"delete unknown user", "DELETE", "/users/20", ``, http.StatusNotFound, codeUserNotFound, "User ID 20 doesn't exist. Cannot delete user."},
+			{"delete certificate owner", "DELETE", "/users/10", ``, http.StatusConflict, codeUserOwnsCertificates, "User ID 10 still owns certificate 1. Cannot delete user."},
+			{"delete transfer target", "DELETE", "/users/12", ``, http.StatusConflict, codeUserHasPendingTransfers, "User ID 12 has pending incoming transfers. Cannot delete user."},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest(test.method, "http://localhost:8080"+test.path, bytes.NewBufferString(test.body))
+			response := executeRequest(req)
+
+			t.Log(test.name)
+			checkErrorResponse(t, response, test.status, test.code, test.message)
+		}
+	})
+}
+
+// TestCreateCertForNewUser verifies that a user created through the API can own certificates
+func TestCreateCertForNewUser(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/users/20", bytes.NewBuffer([]byte(`{"email":"test20@test.com","name":"Test User 20"}`)))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+		cert := []byte(`{"id":"20","title":"new user cert","issuedAt":"2019-03-29","ownerId":"20","year":2019,"note":"","transfer":{"to":"","status":""}}`)
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/20", bytes.NewBuffer(cert))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	})
+}
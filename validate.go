@@ -0,0 +1,267 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Limits on the size of request bodies and of the fields in them
+const (
+	maxBodyBytes    = 1 << 20  // 1 MB
+	maxImportBytes  = 32 << 20 // 32 MB
+	maxIDLength     = 64
+	maxTitleLength  = 200
+	maxNoteLength   = 2000
+	maxNameLength   = 200
+	maxEmailLength  = 254
+	maxURLLength    = 2000
+	maxReasonLength = 500
+	maxBatchSize    = 1000
+	minYear         = 1900
+)
+
+// dateLayout is the format dates are kept in, and returned to clients in
+const dateLayout = "2006-01-02"
+
+// dateLayouts are the formats in which clients may write a date. Month names may be written in any case
+var dateLayouts = []string{
+	dateLayout, "2006/01/02", "2 Jan 2006", "2 January 2006", "2-Jan-2006", "Jan 2, 2006", "January 2, 2006",
+	"Jan 2 2006", "January 2 2006", time.RFC3339,
+}
+
+// parseDate reads a date in any of dateLayouts, such as the free-text dates certificates used to be created with
+func parseDate(s string) (time.Time, error) {
+	s = strings.Join(strings.Fields(s), " ") // "29  MAR 2019 " is read as "29 MAR 2019"
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date", s)
+}
+
+// decodeBody populates v with the JSON body of the request. It rejects bodies that are larger than maxBodyBytes,
+// that aren't a single valid JSON value, or that hold fields v doesn't have
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return newAPIError(http.StatusBadRequest, codeMalformedBody, "Request body is empty.")
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err == nil && decoder.More() {
+		err = errors.New("unexpected data after the JSON value")
+	}
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &tooLarge):
+		return newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("Request body is larger than %d bytes.", maxBodyBytes)).with("limit", maxBodyBytes)
+	case err == io.EOF:
+		return newAPIError(http.StatusBadRequest, codeMalformedBody, "Request body is empty.")
+	default:
+		return newAPIError(http.StatusBadRequest, codeMalformedBody, "Request body is not valid JSON: "+err.Error()+".")
+	}
+}
+
+// fieldErrors collects the problems found in a request body, keyed by the name of the field
+type fieldErrors map[string]string
+
+// required checks that a string field is set and isn't longer than max
+func (f fieldErrors) required(field, value string, max int) {
+	if value == "" {
+		f[field] = "is required"
+	} else {
+		f.maxLength(field, value, max)
+	}
+}
+
+// maxLength checks that a string field isn't longer than max
+func (f fieldErrors) maxLength(field, value string, max int) {
+	if len(value) > max {
+		f[field] = fmt.Sprintf("must be at most %d characters long", max)
+	}
+}
+
+// email checks that a field holds a bare e-mail address
+func (f fieldErrors) email(field, value string) {
+	f.required(field, value, maxEmailLength)
+	if _, ok := f[field]; ok {
+		return
+	}
+	if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+		f[field] = "must be an e-mail address"
+	}
+}
+
+// err returns the validation error of what, or nil if no problem was found
+func (f fieldErrors) err(what string) error {
+	if len(f) == 0 {
+		return nil
+	}
+	return newAPIError(http.StatusUnprocessableEntity, codeValidationFailed, what+" is invalid.").with("fields", f)
+}
+
+// validateCert checks a certificate received from a client
+func validateCert(cert certificate) error {
+	f := make(fieldErrors)
+	f.required("id", cert.ID, maxIDLength)
+	f.required("title", cert.Title, maxTitleLength)
+	f.required("ownerId", cert.OwnerID, maxIDLength)
+	f.maxLength("note", cert.Note, maxNoteLength)
+
+	// A certificate may be issued up to a year ahead. Its year may be left out, and is then the year it is issued in
+	if cert.IssuedAt == "" {
+		f["issuedAt"] = "is required"
+	} else if issued, err := parseDate(cert.IssuedAt); err != nil {
+		f["issuedAt"] = "must be a date, e.g. 2019-03-29 or 29 MAR 2019"
+	} else if maxYear := time.Now().Year() + 1; issued.Year() < minYear || issued.Year() > maxYear {
+		f["issuedAt"] = fmt.Sprintf("must be in a year between %d and %d", minYear, maxYear)
+	} else if cert.Year != 0 && cert.Year != issued.Year() {
+		f["year"] = fmt.Sprintf("must be %d, the year of issuedAt, or be left out", issued.Year())
+	}
+
+	if cert.Transfer != (transfer{}) {
+		validateTransferFields(f, "transfer.", cert.Transfer)
+	}
+	if cert.DeletedAt != "" {
+		f["deletedAt"] = "cannot be set. Delete the certificate instead"
+	}
+	return f.err("Certificate " + cert.ID)
+}
+
+// normalizeDates writes the issue date of a valid certificate in dateLayout, and fills in its year
+func normalizeDates(cert *certificate) {
+	issued, _ := parseDate(cert.IssuedAt)
+	cert.IssuedAt = issued.Format(dateLayout)
+	cert.Year = issued.Year()
+}
+
+// upgradeCert moves the free-text creation date certificates used to be given by clients to issuedAt, written in
+// dateLayout if it can be read. The time such a certificate was created is not known
+func upgradeCert(cert certificate) certificate {
+	if cert.IssuedAt != "" || cert.CreatedAt == "" {
+		return cert
+	}
+	cert.IssuedAt = cert.CreatedAt // kept as written when it cannot be read
+	if issued, err := parseDate(cert.CreatedAt); err == nil {
+		cert.IssuedAt = issued.Format(dateLayout)
+	}
+	cert.CreatedAt = ""
+	return cert
+}
+
+// validateTransfer checks a transfer request received from a client
+func validateTransfer(xfer transfer) error {
+	f := make(fieldErrors)
+	validateTransferFields(f, "", xfer)
+	return f.err("Transfer")
+}
+
+// validateTransferFields checks the fields of a transfer, whose names are written with this prefix
+func validateTransferFields(f fieldErrors, prefix string, xfer transfer) {
+	f.email(prefix+"to", xfer.To)
+	if xfer.Status != "" && xfer.Status != "Requested" {
+		f[prefix+"status"] = "must be Requested"
+	}
+}
+
+// validateReassign checks a request to reassign a certificate
+func validateReassign(req reassignRequest) error {
+	f := make(fieldErrors)
+	f.required("ownerId", req.OwnerID, maxIDLength)
+	f.required("reason", req.Reason, maxReasonLength)
+	return f.err("Reassignment")
+}
+
+// validateBatch checks the envelope of a batch received from a client. Its operations are checked one by one
+func validateBatch(req batchRequest) error {
+	f := make(fieldErrors)
+	if req.Mode != batchAtomic && req.Mode != batchBestEffort {
+		f["mode"] = "must be " + batchAtomic + " or " + batchBestEffort
+	}
+	if len(req.Operations) == 0 {
+		f["operations"] = "is required"
+	} else if len(req.Operations) > maxBatchSize {
+		f["operations"] = fmt.Sprintf("must hold at most %d operations", maxBatchSize)
+	}
+	return f.err("Batch")
+}
+
+// validateBatchOperation checks the fields an operation of a batch needs, and the ones it cannot have
+func validateBatchOperation(i int, op batchOperation) error {
+	f := make(fieldErrors)
+	switch op.Op {
+	case batchCreate:
+		f.maxLength("id", op.ID, maxIDLength)
+	case batchUpdate, batchDelete, batchTransfer:
+		f.required("id", op.ID, maxIDLength)
+	default:
+		f["op"] = "must be " + batchCreate + ", " + batchUpdate + ", " + batchDelete + " or " + batchTransfer
+	}
+	if op.Op == batchCreate || op.Op == batchUpdate {
+		if op.Certificate == nil {
+			f["certificate"] = "is required"
+		}
+	} else if op.Certificate != nil {
+		f["certificate"] = "can only be sent with " + batchCreate + " and " + batchUpdate
+	}
+	if op.Op == batchTransfer {
+		f.email("to", op.To)
+	} else if op.To != "" {
+		f["to"] = "can only be sent with " + batchTransfer
+	}
+	if op.Force && op.Op != batchDelete {
+		f["force"] = "can only be sent with " + batchDelete
+	}
+	return f.err(fmt.Sprintf("Operation %d", i))
+}
+
+// validateUser checks a user received from a client
+func validateUser(u user) error {
+	f := make(fieldErrors)
+	f.required("id", u.ID, maxIDLength)
+	f.email("email", u.Email)
+	f.maxLength("name", u.Name, maxNameLength)
+	if u.Role != "" && role(u.Role) != roleAdmin && role(u.Role) != roleAuditor {
+		f["role"] = "must be admin, auditor or empty"
+	}
+	return f.err("User " + u.ID)
+}
+
+// validateWebhook checks a webhook subscription received from a client
+func validateWebhook(req webhookRequest) error {
+	f := make(fieldErrors)
+	f.required("url", req.URL, maxURLLength)
+	if _, ok := f["url"]; !ok {
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			f["url"] = "must be an absolute http or https URL"
+		}
+	}
+
+	if len(req.Events) == 0 {
+		f["events"] = "is required"
+	}
+	for _, event := range req.Events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			f["events"] = "must only hold " + strings.Join(webhookEvents, ", ")
+			break
+		}
+	}
+	return f.err("Webhook")
+}
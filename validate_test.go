@@ -0,0 +1,143 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMalformedBodies sends bodies that cannot be decoded, and checks that they are rejected
+func TestMalformedBodies(t *testing.T) {
+	withTestStore(func() {
+		tests := []struct {
+			name, path, body string
+			status           int
+			code             string
+		}{
+			{"garbage", "/certificates/1", `garbage`, http.StatusBadRequest, codeMalformedBody},
+			{"truncated JSON", "/certificates/1", `{"id":"1","title":`, http.StatusBadRequest, codeMalformedBody},
+			{"unknown field", "/certificates/1", `{"id":"1","title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"color":"red"}`, http.StatusBadRequest, codeMalformedBody},
+			{"wrong type", "/certificates/1", `{"id":"1","title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":"2019"}`, http.StatusBadRequest, codeMalformedBody},
+			{"two values", "/certificates/1", string(cert1) + string(cert1), http.StatusBadRequest, codeMalformedBody},
+			{"empty body", "/certificates/1", ``, http.StatusBadRequest, codeMalformedBody},
+			{"empty transfer", "/certificates/1/transfers", ``, http.StatusBadRequest, codeMalformedBody},
+			{"unknown transfer field", "/certificates/1/transfers", `{"to":"test12@test.com","when":"now"}`, http.StatusBadRequest, codeMalformedBody},
+			{"unknown user field", "/users/20", `{"email":"test20@test.com","admin":true}`, http.StatusBadRequest, codeMalformedBody},
+			{"oversized body", "/certificates/1", `{"id":"1","note":"` + strings.Repeat("x", maxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest("POST", "http://localhost:8080"+test.path, bytes.NewBufferString(test.body))
+			response := executeRequest(req)
+
+			var e apiError
+			json.Unmarshal(response.Body.Bytes(), &e)
+			if response.Code != test.status || e.Code != test.code {
+				t.Errorf("%s: expected %d %s. Got %d %s", test.name, test.status, test.code, response.Code, response.Body.String())
+			}
+		}
+
+		// Nothing has been created by the garbage
+		req, _ := http.NewRequest("GET", "http://localhost:8080/certificates", nil)
+		if body := executeRequest(req).Body.String(); body != "{\"items\":[]}\n" {
+			t.Errorf("Expected no certificates. Got %s", body)
+		}
+	})
+}
+
+// TestValidationErrors sends well-formed bodies with invalid fields, and checks the per-field error details
+func TestValidationErrors(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		executeRequest(req)
+		yearRange := fmt.Sprintf("must be in a year between %d and %d", minYear, time.Now().Year()+1)
+
+		tests := []struct {
+			name, method, path, body string
+			fields                   map[string]string
+		}{
+			{"empty certificate", "POST", "/certificates/2", `{}`, map[string]string{
+				"title": "is required", "issuedAt": "is required", "ownerId": "is required",
+			}},
+			{"bad certificate fields", "PUT", "/certificates/1", `{"id":"1","title":"` + strings.Repeat("t", maxTitleLength+1) + `","issuedAt":"yesterday","ownerId":"10","year":-5,"note":"","transfer":{"to":"nobody","status":"Done"}}`, map[string]string{
+				"title": "must be at most 200 characters long", "issuedAt": "must be a date, e.g. 2019-03-29 or 29 MAR 2019",
+				"transfer.to": "must be an e-mail address", "transfer.status": "must be Requested",
+			}},
+			{"issued too long ago", "PUT", "/certificates/1", `{"title":"first cert","issuedAt":"1 JAN 1850","ownerId":"10"}`, map[string]string{"issuedAt": yearRange}},
+			{"year of another date", "PUT", "/certificates/1", `{"title":"first cert","issuedAt":"29 MAR 2019","ownerId":"10","year":2018}`, map[string]string{
+				"year": "must be 2019, the year of issuedAt, or be left out",
+			}},
+			{"transfer without recipient", "POST", "/certificates/1/transfers", `{"status":"Requested"}`, map[string]string{"to": "is required"}},
+			{"transfer to a name", "POST", "/certificates/1/transfers", `{"to":"Test User <test12@test.com>"}`, map[string]string{"to": "must be an e-mail address"}},
+			{"bad user fields", "POST", "/users/20", `{"email":"test20","name":"` + strings.Repeat("n", maxNameLength+1) + `","role":"owner"}`, map[string]string{
+				"email": "must be an e-mail address", "name": "must be at most 200 characters long", "role": "must be admin, auditor or empty",
+			}},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest(test.method, "http://localhost:8080"+test.path, bytes.NewBufferString(test.body))
+			response := executeRequest(req)
+
+			var e struct {
+				Code    string `json:"code"`
+				Details struct {
+					Fields map[string]string `json:"fields"`
+				} `json:"details"`
+			}
+			json.Unmarshal(response.Body.Bytes(), &e)
+			if response.Code != http.StatusUnprocessableEntity || e.Code != codeValidationFailed {
+				t.Errorf("%s: expected %d %s. Got %d %s", test.name, http.StatusUnprocessableEntity, codeValidationFailed, response.Code, response.Body.String())
+			}
+			if !reflect.DeepEqual(e.Details.Fields, test.fields) {
+				t.Errorf("%s:\nExpected %v\nGot\t %v", test.name, test.fields, e.Details.Fields)
+			}
+		}
+	})
+}
+
+// TestTransferStatusDefaultsToRequested verifies that a transfer request doesn't need to carry its status
+func TestTransferStatusDefaultsToRequested(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBuffer(cert1))
+		executeRequest(req)
+
+		req, _ = http.NewRequest("POST", "http://localhost:8080/certificates/1/transfers", bytes.NewBufferString(`{"to":"test12@test.com"}`))
+		var cert certificate
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &cert)
+		if cert.Transfer.Status != "Requested" {
+			t.Errorf("Expected a Requested transfer. Got %v", cert.Transfer)
+		}
+	})
+}
+
+// TestParseDate reads dates in the formats clients have been writing them in
+func TestParseDate(t *testing.T) {
+	for _, s := range []string{"2019-03-29", "2019/03/29", "29 MAR 2019", "29 mar 2019", " 29  March 2019 ", "29-Mar-2019", "Mar 29, 2019", "MARCH 29 2019", "2019-03-29T10:00:00Z"} {
+		if d, err := parseDate(s); err != nil || d.Format(dateLayout) != "2019-03-29" {
+			t.Errorf("%q: expected 2019-03-29. Got %v, %v", s, d, err)
+		}
+	}
+	for _, s := range []string{"", "yesterday", "29/03/2019", "2019-02-30"} {
+		if _, err := parseDate(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+// TestIssueDates verifies that certificates get their issue date in a single format, and their year from it
+func TestIssueDates(t *testing.T) {
+	withTestStore(func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"29 MAR 2019","ownerId":"10"}`))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var cert certificate
+		json.Unmarshal(response.Body.Bytes(), &cert)
+		if cert.IssuedAt != "2019-03-29" || cert.Year != 2019 {
+			t.Errorf("Expected a certificate issued on 2019-03-29 in 2019. Got %s", response.Body.String())
+		}
+	})
+}
@@ -0,0 +1,346 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// revision is an immutable copy of a certificate as it was after one of its changes. The first revision of a
+// certificate is version 1. When a certificate is purged, its revisions are replaced with a tombstone that only
+// holds its last version, so that a certificate created again under its id carries on from that version
+type revision struct {
+	CertID      string      `json:"certId"`
+	Version     int         `json:"version"`
+	At          string      `json:"at"`
+	Certificate certificate `json:"certificate"`
+	Purged      bool        `json:"purged,omitempty"` /* set on tombstones, which are never shown to clients */
+}
+
+type revisionsMap map[string][]revision
+
+// versionedCerts adds a revision to a revisions store on every change to a certificates store, and stamps
+// certificates with the times they were created and last changed
+type versionedCerts struct {
+	CertificateStore
+	revisions RevisionStore
+}
+
+// PutCert adds or replaces the certificate, and adds its new revision. Whatever times the certificate holds are
+// replaced with the server's
+func (v versionedCerts) PutCert(cert certificate) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if current, ok := v.CertificateStore.GetCert(cert.ID); ok {
+		cert.CreatedAt = current.CreatedAt
+	} else {
+		cert.CreatedAt = now
+	}
+	cert.UpdatedAt = now
+
+	if err := v.CertificateStore.PutCert(cert); err != nil {
+		return err
+	}
+	return v.revisions.AddRevision(revision{
+		CertID:      cert.ID,
+		Version:     lastVersion(v.revisions, cert.ID) + 1,
+		At:          now,
+		Certificate: cert,
+	})
+}
+
+// DeleteCert removes the certificate for good, with its revisions. A tombstone keeps its last version, so that
+// the versions, and the ETags, of a certificate created again under this id are never those of the purged one
+func (v versionedCerts) DeleteCert(id string) error {
+	last := lastVersion(v.revisions, id)
+	if err := v.CertificateStore.DeleteCert(id); err != nil {
+		return err
+	}
+	if err := v.revisions.DeleteRevisions(id); err != nil || last == 0 {
+		return err
+	}
+	return v.revisions.AddRevision(revision{CertID: id, Version: last, At: time.Now().UTC().Format(time.RFC3339Nano), Purged: true})
+}
+
+// lastVersion returns the version of the last revision of the certificate with this id, or of its tombstone.
+// It is 0 when there is neither
+func lastVersion(revisions RevisionStore, certID string) int {
+	revs := revisions.ListRevisions(certID)
+	if len(revs) == 0 {
+		return 0
+	}
+	return revs[len(revs)-1].Version
+}
+
+// findVersion returns the revision with version n
+func findVersion(history []revision, n int) (revision, bool) {
+	for _, rev := range history {
+		if rev.Version == n {
+			return rev, true
+		}
+	}
+	return revision{}, false
+}
+
+// saveCert adds or replaces the certificate, and reads back what the store set on it, such as its times
+func saveCert(certificates CertificateStore, cert *certificate) error {
+	if err := certificates.PutCert(*cert); err != nil {
+		return err
+	}
+	*cert, _ = certificates.GetCert(cert.ID)
+	return nil
+}
+
+// revisionAt returns the revision of the certificate that was current at this time
+func revisionAt(revisions []revision, at time.Time) (revision, bool) {
+	var found revision
+	ok := false
+	for _, rev := range revisions {
+		t, err := time.Parse(time.RFC3339Nano, rev.At)
+		if err != nil || t.After(at) {
+			break
+		}
+		found, ok = rev, true
+	}
+	return found, ok
+}
+
+// fieldChange is a field of a certificate that differs between two revisions. Fields of nested objects are named
+// with their path, e.g. transfer.status
+type fieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// versionDiff is the difference between two revisions of a certificate. Version 0 stands for the certificate
+// before it was created
+type versionDiff struct {
+	CertID  string        `json:"certId"`
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []fieldChange `json:"changes"`
+}
+
+// flattenFields writes the fields of a JSON object to fields, keyed by their path
+func flattenFields(prefix string, v interface{}, fields map[string]interface{}) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		fields[prefix] = v
+		return
+	}
+	for name, value := range obj {
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		flattenFields(name, value, fields)
+	}
+}
+
+// certFields returns the fields of the certificate as it is written in JSON, keyed by their path
+func certFields(cert *certificate) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if cert == nil {
+		return fields
+	}
+	data, _ := json.Marshal(cert)
+	var v interface{}
+	json.Unmarshal(data, &v)
+	flattenFields("", v, fields)
+	return fields
+}
+
+// diffCerts lists the fields that differ between two certificates, sorted by name. A nil certificate has no fields
+func diffCerts(from, to *certificate) []fieldChange {
+	before, after := certFields(from), certFields(to)
+	for field := range after {
+		if _, ok := before[field]; !ok {
+			before[field] = nil
+		}
+	}
+
+	changes := []fieldChange{}
+	for field, old := range before {
+		if !reflect.DeepEqual(old, after[field]) {
+			changes = append(changes, fieldChange{Field: field, From: old, To: after[field]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// parseVersion reads a version number. Version 0 is only accepted when zeroOK is set
+func parseVersion(name, s string, zeroOK bool) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || (n == 0 && !zeroOK) {
+		return 0, newAPIError(http.StatusBadRequest, codeInvalidParameter, name+" "+s+" is invalid. It must be a version number.").with("parameter", strings.ToLower(name))
+	}
+	return n, nil
+}
+
+// certRevisions returns the revisions of the certificate with this id, provided the user may read its history
+func certRevisions(r *http.Request, certificates CertificateStore, revisions RevisionStore, certID, verb string) ([]revision, error) {
+	cert, ok := liveCert(certificates, certID)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, codeCertNotFound, "Certificate ID "+certID+" doesn't exist. Cannot "+verb+".").with("certId", certID)
+	}
+	if err := authorize(r, actionReadCertHistory, target{cert: &cert}); err != nil {
+		return nil, err
+	}
+	var history []revision
+	for _, rev := range revisions.ListRevisions(certID) {
+		if !rev.Purged {
+			history = append(history, rev)
+		}
+	}
+	return history, nil
+}
+
+// versionNotFound is the error for a version the certificate doesn't have
+func versionNotFound(certID string, n int) error {
+	return newAPIError(http.StatusNotFound, codeVersionNotFound, fmt.Sprintf("Certificate ID %s has no version %d.", certID, n)).with("certId", certID).with("version", n)
+}
+
+// listVersions lists the revisions of the certificate with this id, oldest first, one page at a time
+func listVersions(w http.ResponseWriter, r *http.Request) {
+	certID := mux.Vars(r)["id"]
+
+	paging, err := parsePageRequest(r, "version")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var history []revision
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		history, err = certRevisions(r, certificates, revisions, certID, "list versions")
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(paging.paginate(revisionPageItems(history))) // Return a JSON with the certificate's revisions
+	}
+}
+
+// getVersion returns one revision of the certificate with this id
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	certID := mux.Vars(r)["id"]
+	n, err := parseVersion("Version", mux.Vars(r)["version"], false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var rev revision
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		history, err := certRevisions(r, certificates, revisions, certID, "read version")
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if rev, ok = findVersion(history, n); !ok {
+			return versionNotFound(certID, n)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(rev) // Return a JSON with the revision
+	}
+}
+
+// diffVersions returns the fields that changed between two revisions of the certificate with this id. The from query
+// parameter defaults to the revision before, and may be 0 to compare with the certificate before it was created
+func diffVersions(w http.ResponseWriter, r *http.Request) {
+	certID := mux.Vars(r)["id"]
+	n, err := parseVersion("Version", mux.Vars(r)["version"], false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	from := -1
+	if s := r.URL.Query().Get("from"); s != "" {
+		if from, err = parseVersion("From", s, true); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	diff := versionDiff{CertID: certID, To: n}
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		history, err := certRevisions(r, certificates, revisions, certID, "compare versions")
+		if err != nil {
+			return err
+		}
+		after, ok := findVersion(history, n)
+		if !ok {
+			return versionNotFound(certID, n)
+		}
+		// The revision before is the one before in the history. The first version of a certificate created under
+		// the id of a purged one has none, and is compared with the certificate before it was created
+		if from < 0 {
+			from = n - 1
+			if history[0].Version == n {
+				from = 0
+			}
+		}
+		diff.From = from
+		var before *certificate
+		if from > 0 {
+			rev, ok := findVersion(history, from)
+			if !ok {
+				return versionNotFound(certID, from)
+			}
+			before = &rev.Certificate
+		}
+		diff.Changes = diffCerts(before, &after.Certificate)
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(diff) // Return a JSON with the changed fields
+	}
+}
+
+// getCertAsOf returns the certificate with this id as it was at the time given in the asOf query parameter
+func getCertAsOf(w http.ResponseWriter, r *http.Request) {
+	certID := mux.Vars(r)["id"]
+	s := r.URL.Query().Get("asOf")
+	asOf, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		writeError(w, newAPIError(http.StatusBadRequest, codeInvalidParameter, "AsOf "+s+" is invalid. It must be an RFC 3339 time, e.g. 2019-03-29T10:00:00Z.").with("parameter", "asOf"))
+		return
+	}
+
+	var rev revision
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		history, err := certRevisions(r, certificates, revisions, certID, "read certificate")
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if rev, ok = revisionAt(history, asOf); !ok || rev.Certificate.deleted() {
+			return newAPIError(http.StatusNotFound, codeVersionNotFound, "Certificate ID "+certID+" didn't exist at "+s+".").with("certId", certID).with("asOf", s)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	etag := versionETag(rev.Version)
+	w.Header().Set("ETag", etag)
+	if !notModified(w, r, etag) {
+		json.NewEncoder(w).Encode(rev.Certificate) // Return a JSON with the certificate as it was
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestVersionHistory changes a certificate a few times, and verifies that every change is kept as a revision
+// that can be listed, read, compared and read back in time
+func TestVersionHistory(t *testing.T) {
+	withTestStore(func() {
+		steps := []struct {
+			method, path, body, userID string
+		}{
+			{"POST", "/certificates/1", `{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`, "10"},
+			{"PUT", "/certificates/1", `{"title":"renamed cert","issuedAt":"2019-03-29","ownerId":"10","year":2019,"note":"a note"}`, "10"},
+			{"POST", "/certificates/1/transfers", `{"to":"test12@test.com"}`, "10"},
+			{"POST", "/certificates/1/transfers/accept", ``, "12"},
+		}
+		var times []string // the time after each step
+		for _, step := range steps {
+			req, _ := http.NewRequest(step.method, "http://localhost:8080"+step.path, bytes.NewBufferString(step.body))
+			if code := executeRequest(asUser(req, step.userID)).Code; code != http.StatusOK {
+				t.Fatalf("%s %s: unexpected response code %d", step.method, step.path, code)
+			}
+			times = append(times, time.Now().UTC().Format(time.RFC3339Nano))
+			time.Sleep(time.Millisecond)
+		}
+
+		req, _ := http.NewRequest("GET", "http://localhost:8080/certificates/1/versions", nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var p struct {
+			Items []revision `json:"items"`
+		}
+		json.Unmarshal(response.Body.Bytes(), &p)
+		if len(p.Items) != len(steps) {
+			t.Fatalf("Expected %d versions. Got %s", len(steps), response.Body.String())
+		}
+		for i, rev := range p.Items {
+			if rev.Version != i+1 || rev.CertID != "1" {
+				t.Errorf("Expected version %d of certificate 1. Got %+v", i+1, rev)
+			}
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1/versions/1", nil)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var rev revision
+		json.Unmarshal(response.Body.Bytes(), &rev)
+		if rev.Certificate.Title != "first cert" || rev.Certificate.OwnerID != "10" {
+			t.Errorf("Expected the certificate as it was created. Got %s", response.Body.String())
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1/versions/2/diff", nil)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var diff versionDiff
+		json.Unmarshal(response.Body.Bytes(), &diff)
+		if diff.From != 1 || diff.To != 2 || len(diff.Changes) != 3 || diff.Changes[0] != (fieldChange{"note", "", "a note"}) ||
+			diff.Changes[1] != (fieldChange{"title", "first cert", "renamed cert"}) || diff.Changes[2].Field != "updatedAt" {
+			t.Errorf("Expected the note, the title and the time of the update to change. Got %s", response.Body.String())
+		}
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1/versions/4/diff?from=2", nil)
+		response = executeRequest(req)
+		diff = versionDiff{}
+		json.Unmarshal(response.Body.Bytes(), &diff)
+		if len(diff.Changes) != 2 || diff.Changes[0] != (fieldChange{"ownerId", "10", "12"}) || diff.Changes[1].Field != "updatedAt" {
+			t.Errorf("Expected only the owner to change over the transfer. Got %s", response.Body.String())
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1?asOf="+times[1], nil)
+		response = executeRequest(asUser(req, "12"))
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var cert certificate
+		json.Unmarshal(response.Body.Bytes(), &cert)
+		if cert.Title != "renamed cert" || cert.OwnerID != "10" || cert.Transfer.Status != "" {
+			t.Errorf("Expected the certificate as it was before the transfer. Got %s", response.Body.String())
+		}
+	})
+}
+
+// TestVersionErrors verifies the errors for versions that don't exist, bad parameters and users that may not read the history
+func TestVersionErrors(t *testing.T) {
+	withTestStore(func() {
+		before := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+		tests := []struct {
+			path, userID string
+			status       int
+			code, msg    string
+		}{
+			{"/certificates/1/versions/2", "10", http.StatusNotFound, codeVersionNotFound, "Certificate ID 1 has no version 2."},
+			{"/certificates/1/versions/0", "10", http.StatusBadRequest, codeInvalidParameter, "Version 0 is invalid. It must be a version number."},
+			{"/certificates/1/versions/1/diff?from=x", "10", http.StatusBadRequest, codeInvalidParameter, "From x is invalid. It must be a version number."},
+			{"/certificates/1/versions/1/diff?from=3", "10", http.StatusNotFound, codeVersionNotFound, "Certificate ID 1 has no version 3."},
+			{"/certificates/1?asOf=yesterday", "10", http.StatusBadRequest, codeInvalidParameter, "AsOf yesterday is invalid. It must be an RFC 3339 time, e.g. 2019-03-29T10:00:00Z."},
+			{"/certificates/1?asOf=" + before, "10", http.StatusNotFound, codeVersionNotFound, "Certificate ID 1 didn't exist at " + before + "."},
+			{"/certificates/2/versions", "10", http.StatusNotFound, codeCertNotFound, "Certificate ID 2 doesn't exist. Cannot list versions."},
+			{"/certificates/1/versions", "11", http.StatusForbidden, codeForbidden, "User 11 is not allowed to read the history of certificate 1."},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest("GET", "http://localhost:8080"+test.path, nil)
+			checkErrorResponse(t, executeRequest(asUser(req, test.userID)), test.status, test.code, test.msg)
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1/versions/1/diff", nil)
+		var diff versionDiff
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &diff)
+		if diff.From != 0 || len(diff.Changes) != 10 || diff.Changes[0].Field != "createdAt" || diff.Changes[0].From != nil {
+			t.Errorf("Expected the first version to add every field. Got %+v", diff)
+		}
+	})
+}
+
+// TestPurgeDeletesRevisions verifies that a certificate purged for good takes its revisions with it, and leaves
+// a tombstone that a certificate created again under its id carries on from
+func TestPurgeDeletesRevisions(t *testing.T) {
+	revisions := make(revisionsMap)
+	certificates := versionedCerts{make(certsMap), revisions}
+	certificates.PutCert(certificate{ID: "1", Title: "first cert"})
+	certificates.PutCert(certificate{ID: "1", Title: "renamed cert"})
+	if list := revisions.ListRevisions("1"); len(list) != 2 || list[1].Version != 2 || list[1].Certificate.Title != "renamed cert" {
+		t.Errorf("Expected 2 revisions. Got %+v", list)
+	}
+	certificates.DeleteCert("1")
+	if list := revisions.ListRevisions("1"); len(list) != 1 || !list[0].Purged || list[0].Version != 2 || list[0].Certificate.Title != "" {
+		t.Errorf("Expected the revisions to be deleted, but for a tombstone. Got %+v", list)
+	}
+	certificates.PutCert(certificate{ID: "1", Title: "another cert"})
+	if list := revisions.ListRevisions("1"); len(list) != 2 || list[1].Version != 3 {
+		t.Errorf("Expected the new certificate to carry on from version 2. Got %+v", list)
+	}
+}
+
+// TestServerTimes verifies that certificates keep the time they were created, that every change moves the time they
+// were last updated, and that the times clients send are ignored
+func TestServerTimes(t *testing.T) {
+	withTestStore(func() {
+		var created, updated certificate
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","createdAt":"29 MAR 2019"}`))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		json.Unmarshal(response.Body.Bytes(), &created)
+		if _, err := time.Parse(time.RFC3339Nano, created.CreatedAt); err != nil || created.UpdatedAt != created.CreatedAt {
+			t.Errorf("Expected the certificate to be created and updated now. Got %s", response.Body.String())
+		}
+
+		time.Sleep(time.Millisecond)
+		req, _ = http.NewRequest("PUT", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"renamed cert","issuedAt":"2019-03-29","ownerId":"10","createdAt":"2000-01-01T00:00:00Z","updatedAt":"2000-01-01T00:00:00Z"}`))
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		json.Unmarshal(response.Body.Bytes(), &updated)
+		if updated.CreatedAt != created.CreatedAt || timeSortKey(updated.UpdatedAt) <= timeSortKey(created.UpdatedAt) {
+			t.Errorf("Expected the certificate created at %s to be updated later. Got %s", created.CreatedAt, response.Body.String())
+		}
+
+		req, _ = http.NewRequest("GET", "http://localhost:8080/certificates/1", nil)
+		var got certificate
+		json.Unmarshal(executeRequest(req).Body.Bytes(), &got)
+		if got.CreatedAt != updated.CreatedAt || got.UpdatedAt != updated.UpdatedAt {
+			t.Errorf("Expected the times the update returned. Got %+v", got)
+		}
+	})
+}
@@ -0,0 +1,532 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The events webhooks can subscribe to
+const (
+	eventCertCreated       = "certificate.created"
+	eventCertUpdated       = "certificate.updated"
+	eventCertDeleted       = "certificate.deleted"
+	eventCertRestored      = "certificate.restored"
+	eventCertPurged        = "certificate.purged"
+	eventTransferRequested = "transfer.requested"
+	eventTransferAccepted  = "transfer.accepted"
+	eventTransferRejected  = "transfer.rejected"
+	eventTransferCancelled = "transfer.cancelled"
+	eventTransferExpired   = "transfer.expired"
+)
+
+// webhookEvents lists every event, in the order they are documented
+var webhookEvents = []string{
+	eventCertCreated, eventCertUpdated, eventCertDeleted, eventCertRestored, eventCertPurged,
+	eventTransferRequested, eventTransferAccepted, eventTransferRejected, eventTransferCancelled, eventTransferExpired,
+}
+
+// transferEvents maps the status a transfer moved to onto the event it raises
+var transferEvents = map[string]string{
+	transferRequested: eventTransferRequested,
+	transferAccepted:  eventTransferAccepted,
+	transferRejected:  eventTransferRejected,
+	transferCancelled: eventTransferCancelled,
+	transferExpired:   eventTransferExpired,
+}
+
+// The states of a delivery. A delivery is dead once its last attempt failed; dead deliveries are the dead-letter list
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryDead      = "dead"
+)
+
+// maxKeptDeliveries is how many deliveries are kept for inspection per webhook. The oldest ones are forgotten first
+const maxKeptDeliveries = 1000
+
+type webhook struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"` // shown to clients only when the webhook is created
+	CreatedAt string   `json:"createdAt"`
+}
+
+type webhooksMap map[string]webhook
+
+// webhookRequest is the body of a request to create a webhook
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// subscribes checks whether the webhook wants to hear about the event
+func (hook webhook) subscribes(event string) bool {
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// public returns the webhook as it is shown after it was created, without its secret
+func (hook webhook) public() webhook {
+	hook.Secret = ""
+	return hook
+}
+
+// newWebhookSecret returns a random secret to sign a webhook's deliveries with. It is made like a claim token
+func newWebhookSecret() string {
+	return newClaimToken()
+}
+
+// webhookEvent is the JSON body of every delivery
+type webhookEvent struct {
+	ID         string      `json:"id"` // the same for every webhook the event is delivered to
+	Event      string      `json:"event"`
+	OccurredAt string      `json:"occurredAt"`
+	Data       interface{} `json:"data"` // the certificate or the transfer the event happened to
+}
+
+// delivery is an event on its way to one webhook, with every attempt made to deliver it
+type delivery struct {
+	ID        string            `json:"id"`
+	WebhookID string            `json:"webhookId"`
+	EventID   string            `json:"eventId"`
+	Event     string            `json:"event"`
+	Status    string            `json:"status"`
+	CreatedAt string            `json:"createdAt"`
+	Attempts  []deliveryAttempt `json:"attempts"`
+
+	url     string
+	secret  string
+	payload []byte
+}
+
+// deliveryAttempt is one POST of a delivery. StatusCode is 0 when the receiver couldn't be reached
+type deliveryAttempt struct {
+	At         string `json:"at"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// newDeliveries prepares the delivery of an event to every webhook subscribed to it.
+// They are sent only once the change that raised the event is saved
+func newDeliveries(hooks WebhookStore, event string, data interface{}) []*delivery {
+	e := webhookEvent{ID: newID(), Event: event, OccurredAt: time.Now().UTC().Format(time.RFC3339Nano), Data: data}
+	var deliveries []*delivery
+	var payload []byte
+	for _, hook := range hooks.ListWebhooks() {
+		if !hook.subscribes(event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(e); err != nil {
+				log.Printf("cannot encode the %s event: %v", event, err)
+				return nil
+			}
+		}
+		deliveries = append(deliveries, &delivery{
+			ID: newID(), WebhookID: hook.ID, EventID: e.ID, Event: event, Status: deliveryPending, CreatedAt: e.OccurredAt,
+			url: hook.URL, secret: hook.Secret, payload: payload,
+		})
+	}
+	return deliveries
+}
+
+// transferDeliveries prepares the deliveries of the events raised by transfers that moved to a new status
+func transferDeliveries(hooks WebhookStore, xfers ...transfer) []*delivery {
+	var deliveries []*delivery
+	for _, xfer := range xfers {
+		if event, ok := transferEvents[xfer.Status]; ok {
+			xfer.ClaimToken = "" // only the client that requested the transfer ever sees it
+			deliveries = append(deliveries, newDeliveries(hooks, event, xfer)...)
+		}
+	}
+	return deliveries
+}
+
+// signPayload returns the signature of a delivery made at this Unix time: the hex HMAC-SHA256, keyed with the
+// webhook's secret, of the time, a dot and the body. Signing the time lets receivers reject replayed deliveries
+func signPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDispatcher delivers events to webhooks in the background, so that handlers never wait for a receiver.
+// A delivery that fails is retried with a doubling delay, and is dead after the last attempt. Retries wait on
+// timers rather than on workers, so that a failing receiver never holds up the deliveries to the others
+type webhookDispatcher struct {
+	client   *http.Client
+	attempts int
+	backoff  time.Duration // delay before the first retry. It doubles after every attempt
+
+	mu         sync.Mutex
+	deliveries map[string][]*delivery // kept for inspection, by webhook ID, oldest first
+	queue      chan *delivery
+	closed     bool
+	wg         sync.WaitGroup // workers
+	inflight   sync.WaitGroup // deliveries that are neither succeeded nor dead
+}
+
+// webhookDeliveries delivers the events webhooks are subscribed to. Without it, events aren't delivered
+var webhookDeliveries *webhookDispatcher
+
+// newWebhookClient returns a client that posts deliveries with this timeout, and refuses to connect to loopback, link-local,
+// private and other internal addresses that aren't in one of the allowed networks. The address is checked once the host
+// name is resolved, on every connection, so that no webhook can reach the server's own network by naming it
+func newWebhookClient(timeout time.Duration, allowed []*net.IPNet) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return checkWebhookAddress(address, allowed)
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // a proxy would connect to the webhook for us, past the check
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// checkWebhookAddress rejects a resolved host:port that webhooks may not be delivered to
+func checkWebhookAddress(address string, allowed []*net.IPNet) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("address %s is invalid", host)
+	}
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("address %s is internal, and webhooks may not be delivered to it", host)
+	}
+	return nil
+}
+
+// parseNetworks reads a comma-separated list of networks in CIDR notation, such as 10.0.0.0/8,192.168.1.0/24
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// newWebhookDispatcher starts workers that make the first attempt of up to queueSize queued deliveries through the client
+func newWebhookDispatcher(client *http.Client, workers, queueSize, attempts int, backoff time.Duration) *webhookDispatcher {
+	d := &webhookDispatcher{
+		client: client, attempts: attempts, backoff: backoff,
+		deliveries: make(map[string][]*delivery), queue: make(chan *delivery, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	return d
+}
+
+// work makes the first attempt of queued deliveries until the dispatcher is closed
+func (d *webhookDispatcher) work() {
+	defer d.wg.Done()
+	for dl := range d.queue {
+		d.attempt(dl)
+	}
+}
+
+// post sends the delivery to its webhook, and returns the status the receiver answered with
+func (d *webhookDispatcher) post(dl *delivery) (int, error) {
+	req, err := http.NewRequest("POST", dl.url, bytes.NewReader(dl.payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", dl.WebhookID)
+	req.Header.Set("X-Webhook-Event", dl.Event)
+	req.Header.Set("X-Webhook-Delivery", dl.ID)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", signPayload(dl.secret, timestamp, dl.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // lets the connection be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// attempt makes one attempt at the delivery, records it, and schedules the next one if it failed
+func (d *webhookDispatcher) attempt(dl *delivery) {
+	code, err := d.post(dl)
+
+	d.mu.Lock()
+	a := deliveryAttempt{At: time.Now().UTC().Format(time.RFC3339Nano), StatusCode: code}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	dl.Attempts = append(dl.Attempts, a)
+	n := len(dl.Attempts)
+	switch {
+	case err == nil:
+		dl.Status = deliverySucceeded
+	case n >= d.attempts:
+		dl.Status = deliveryDead
+	}
+	status := dl.Status
+	d.mu.Unlock()
+
+	if status == deliveryPending {
+		time.AfterFunc(d.backoff<<uint(n-1), func() { d.attempt(dl) })
+		return
+	}
+	if status == deliveryDead {
+		log.Printf("cannot deliver %s to webhook %s after %d attempts: %v", dl.Event, dl.WebhookID, n, err)
+	}
+	d.inflight.Done()
+}
+
+// send queues the deliveries. It never blocks: when the queue is full, the delivery is dead at once
+func (d *webhookDispatcher) send(deliveries ...*delivery) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, dl := range deliveries {
+		if d.closed {
+			return
+		}
+		kept := append(d.deliveries[dl.WebhookID], dl)
+		if len(kept) > maxKeptDeliveries {
+			kept = kept[len(kept)-maxKeptDeliveries:]
+		}
+		d.deliveries[dl.WebhookID] = kept
+
+		d.inflight.Add(1)
+		select {
+		case d.queue <- dl:
+		default:
+			dl.Status = deliveryDead
+			dl.Attempts = append(dl.Attempts, deliveryAttempt{At: time.Now().UTC().Format(time.RFC3339Nano), Error: "delivery queue is full"})
+			d.inflight.Done()
+		}
+	}
+}
+
+// list returns copies of the deliveries kept for the webhook, optionally only those with this status
+func (d *webhookDispatcher) list(webhookID, status string) []delivery {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var list []delivery
+	for _, dl := range d.deliveries[webhookID] {
+		if status == "" || dl.Status == status {
+			c := *dl
+			c.Attempts = append([]deliveryAttempt(nil), dl.Attempts...)
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// forget drops the deliveries kept for a webhook that was deleted
+func (d *webhookDispatcher) forget(webhookID string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.deliveries, webhookID)
+}
+
+// close stops accepting deliveries, and waits until the queued ones succeed or die
+func (d *webhookDispatcher) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+	d.inflight.Wait()
+}
+
+// createWebhook subscribes a URL to a set of events. The response is the only one that holds the webhook's secret
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateWebhook(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	events := append([]string(nil), req.Events...)
+	sort.Strings(events)
+	hook := webhook{ID: newID(), URL: req.URL, Secret: newWebhookSecret(), CreatedAt: time.Now().UTC().Format(time.RFC3339Nano)}
+	for i, event := range events {
+		if i == 0 || event != events[i-1] {
+			hook.Events = append(hook.Events, event)
+		}
+	}
+
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		if err := authorize(r, actionManageWebhooks, target{}); err != nil {
+			return err
+		}
+		return hooks.PutWebhook(hook)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/webhooks/"+url.PathEscape(hook.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook) // Return a JSON with the new webhook and its secret
+}
+
+// listWebhooks lists all webhooks, one page at a time
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	paging, err := parsePageRequest(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var list []webhook
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		if err := authorize(r, actionReadWebhooks, target{}); err != nil {
+			return err
+		}
+		for _, hook := range hooks.ListWebhooks() {
+			list = append(list, hook.public())
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(paging.paginate(webhookPageItems(list))) // Return a JSON with the webhooks
+	}
+}
+
+// lookupWebhook returns the webhook with the id in the path, once the user that sent the request is allowed the action on it
+func lookupWebhook(r *http.Request, hooks WebhookStore, a action, verb string) (webhook, error) {
+	hookID := mux.Vars(r)["id"]
+	if err := authorize(r, a, target{}); err != nil {
+		return webhook{}, err
+	}
+	hook, ok := hooks.GetWebhook(hookID)
+	if !ok {
+		return hook, newAPIError(http.StatusNotFound, codeWebhookNotFound, "Webhook ID "+hookID+" doesn't exist. Cannot "+verb+".").with("webhookId", hookID)
+	}
+	return hook, nil
+}
+
+// getWebhook returns the webhook with this id
+func getWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook webhook
+	err := db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var err error
+		hook, err = lookupWebhook(r, hooks, actionReadWebhooks, "read webhook")
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(hook.public()) // Return a JSON with the webhook
+	}
+}
+
+// deleteWebhook unsubscribes the webhook with this id, and forgets its deliveries
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook webhook
+	err := db.updateBy(r, func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var err error
+		if hook, err = lookupWebhook(r, hooks, actionManageWebhooks, "delete webhook"); err != nil {
+			return err
+		}
+		return hooks.DeleteWebhook(hook.ID)
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		webhookDeliveries.forget(hook.ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listDeliveries lists the deliveries made to the webhook with this id, oldest first, one page at a time.
+// The status query parameter selects the pending, succeeded or dead deliveries only
+func listDeliveries(w http.ResponseWriter, r *http.Request) {
+	paging, err := parsePageRequest(r, "createdAt")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != deliveryPending && status != deliverySucceeded && status != deliveryDead {
+		writeError(w, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Status "+status+" is invalid. It must be pending, succeeded or dead.").with("parameter", "status"))
+		return
+	}
+
+	var hook webhook
+	err = db.view(func(certificates CertificateStore, users UserStore, transfers TransferStore, hooks WebhookStore, revisions RevisionStore) error {
+		var err error
+		hook, err = lookupWebhook(r, hooks, actionReadWebhooks, "list deliveries")
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		json.NewEncoder(w).Encode(paging.paginate(deliveryPageItems(webhookDeliveries.list(hook.ID, status)))) // Return a JSON with the webhook's deliveries
+	}
+}
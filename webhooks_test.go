@@ -0,0 +1,274 @@
+// Copyright 2019 Idan Dekel. All rights reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedEvent is an event as a test receiver got it, with its signature
+type receivedEvent struct {
+	webhookEvent
+	timestamp, signature string
+	payload              []byte
+}
+
+// testReceiver is a local webhook receiver that answers with the next status in statuses, and 200 once they run out
+type testReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	events   []receivedEvent
+}
+
+// newTestReceiver starts a receiver. It must be closed
+func newTestReceiver(statuses ...int) *testReceiver {
+	rec := &testReceiver{statuses: statuses}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := ioutil.ReadAll(r.Body)
+		e := receivedEvent{timestamp: r.Header.Get("X-Webhook-Timestamp"), signature: r.Header.Get("X-Webhook-Signature"), payload: payload}
+		json.Unmarshal(payload, &e.webhookEvent)
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		status := http.StatusOK
+		if len(rec.statuses) > 0 {
+			status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+		}
+		if status == http.StatusOK {
+			rec.events = append(rec.events, e)
+		}
+		w.WriteHeader(status)
+	}))
+	return rec
+}
+
+// testWebhookClient delivers to the test receivers, which listen on the loopback interface
+var testWebhookClient = newWebhookClient(5*time.Second, []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}})
+
+// withWebhooks runs fn on a fresh store with a dispatcher that retries quickly, and waits for its deliveries
+func withWebhooks(fn func()) {
+	withTestStore(func() {
+		saved := webhookDeliveries
+		webhookDeliveries = newWebhookDispatcher(testWebhookClient, 2, 100, 3, time.Millisecond)
+		defer func() { webhookDeliveries = saved }()
+		fn()
+		webhookDeliveries.close()
+	})
+}
+
+// subscribe creates a webhook as the admin, and returns it with its secret
+func subscribe(t *testing.T, url string, events ...string) webhook {
+	body, _ := json.Marshal(webhookRequest{URL: url, Events: events})
+	req, _ := http.NewRequest("POST", "http://localhost:8080/webhooks", bytes.NewBuffer(body))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var hook webhook
+	json.Unmarshal(response.Body.Bytes(), &hook)
+	if hook.Secret == "" || response.Header().Get("Location") != "/webhooks/"+hook.ID {
+		t.Errorf("Expected a secret and the location of the webhook. Got %s and %q", response.Body.String(), response.Header().Get("Location"))
+	}
+	return hook
+}
+
+// listDeliveriesOf returns the deliveries of the webhook, optionally only those with this status
+func listDeliveriesOf(t *testing.T, hookID, status string) []delivery {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/webhooks/"+hookID+"/deliveries?status="+status, nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var p struct {
+		Items []delivery `json:"items"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &p)
+	return p.Items
+}
+
+// TestWebhookDelivery runs a certificate through its events, and verifies that the receiver gets the events it subscribed to,
+// signed with the webhook's secret
+func TestWebhookDelivery(t *testing.T) {
+	rec := newTestReceiver()
+	defer rec.Close()
+
+	var hook webhook
+	withWebhooks(func() {
+		hook = subscribe(t, rec.URL, eventCertCreated, eventCertDeleted, eventTransferRequested, eventTransferAccepted)
+		steps := []struct {
+			method, path, body, userID string
+		}{
+			{"POST", "/certificates/1", `{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`, "10"},
+			{"PUT", "/certificates/1", `{"title":"renamed cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`, "10"},
+			{"POST", "/certificates/1/transfers", `{"to":"test12@test.com"}`, "10"},
+			{"POST", "/certificates/1/transfers/accept", ``, "12"},
+			{"DELETE", "/certificates/1", ``, "12"},
+		}
+		for _, step := range steps {
+			req, _ := http.NewRequest(step.method, "http://localhost:8080"+step.path, bytes.NewBufferString(step.body))
+			if code := executeRequest(asUser(req, step.userID)).Code; code != http.StatusOK && code != http.StatusNoContent {
+				t.Fatalf("%s %s: unexpected response code %d", step.method, step.path, code)
+			}
+			webhookDeliveries.close() // waits for the delivery, so that the events arrive in order
+			webhookDeliveries = newWebhookDispatcher(testWebhookClient, 2, 100, 3, time.Millisecond)
+		}
+	})
+
+	expected := []string{eventCertCreated, eventTransferRequested, eventTransferAccepted, eventCertDeleted}
+	if len(rec.events) != len(expected) {
+		t.Fatalf("Expected %d events. Got %d", len(expected), len(rec.events))
+	}
+	for i, e := range rec.events {
+		if e.Event != expected[i] {
+			t.Errorf("Event %d: expected %s. Got %s", i, expected[i], e.Event)
+		}
+		timestamp, _ := strconv.ParseInt(e.timestamp, 10, 64)
+		if e.signature != signPayload(hook.Secret, timestamp, e.payload) {
+			t.Errorf("Event %d: the signature %s doesn't match the body", i, e.signature)
+		}
+	}
+	if data, _ := json.Marshal(rec.events[1].Data); bytes.Contains(data, []byte("claimToken")) {
+		t.Errorf("Expected the transfer event to leave out the claim token. Got %s", data)
+	}
+}
+
+// TestWebhookRetries verifies that failed deliveries are retried, and that the ones that fail every attempt are dead
+func TestWebhookRetries(t *testing.T) {
+	flaky := newTestReceiver(http.StatusInternalServerError, http.StatusBadGateway)
+	defer flaky.Close()
+	down := newTestReceiver(500, 500, 500)
+	defer down.Close()
+
+	withWebhooks(func() {
+		flakyHook := subscribe(t, flaky.URL, eventCertCreated)
+		downHook := subscribe(t, down.URL, eventCertCreated)
+
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		webhookDeliveries.close()
+
+		delivered := listDeliveriesOf(t, flakyHook.ID, deliverySucceeded)
+		if len(delivered) != 1 || len(delivered[0].Attempts) != 3 || delivered[0].Attempts[0].StatusCode != http.StatusInternalServerError {
+			t.Errorf("Expected a delivery that succeeded on its third attempt. Got %+v", delivered)
+		}
+		if dead := listDeliveriesOf(t, flakyHook.ID, deliveryDead); len(dead) != 0 {
+			t.Errorf("Expected no dead deliveries. Got %+v", dead)
+		}
+
+		dead := listDeliveriesOf(t, downHook.ID, deliveryDead)
+		if len(dead) != 1 || len(dead[0].Attempts) != 3 || dead[0].Event != eventCertCreated || dead[0].Attempts[2].Error == "" {
+			t.Errorf("Expected a dead delivery with 3 failed attempts. Got %+v", dead)
+		}
+	})
+	if len(down.events) != 0 || len(flaky.events) != 1 {
+		t.Errorf("Expected a single event to get through. Got %d and %d", len(flaky.events), len(down.events))
+	}
+}
+
+// TestWebhookInternalAddress verifies that deliveries to internal addresses are refused unless their network is allowed
+func TestWebhookInternalAddress(t *testing.T) {
+	allowed, err := parseNetworks("10.1.0.0/16, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		address string
+		ok      bool
+	}{
+		{"127.0.0.1:80", false},
+		{"[::1]:443", false},
+		{"10.0.0.5:80", false},
+		{"10.1.2.3:80", true},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"[fd00::1]:80", true},
+		{"0.0.0.0:80", false},
+		{"93.184.216.34:443", true},
+	} {
+		if err := checkWebhookAddress(test.address, allowed); (err == nil) != test.ok {
+			t.Errorf("%s: expected it to be allowed: %v. Got %v", test.address, test.ok, err)
+		}
+	}
+	if _, err := parseNetworks("10.0.0.0"); err == nil {
+		t.Errorf("Expected an error for a network without a mask")
+	}
+
+	rec := newTestReceiver()
+	defer rec.Close()
+	withWebhooks(func() {
+		webhookDeliveries.close()
+		webhookDeliveries = newWebhookDispatcher(newWebhookClient(time.Second, nil), 2, 100, 2, time.Millisecond)
+		hook := subscribe(t, rec.URL, eventCertCreated)
+
+		req, _ := http.NewRequest("POST", "http://localhost:8080/certificates/1", bytes.NewBufferString(`{"title":"first cert","issuedAt":"2019-03-29","ownerId":"10","year":2019}`))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+		webhookDeliveries.close()
+
+		dead := listDeliveriesOf(t, hook.ID, deliveryDead)
+		if len(dead) != 1 || !strings.Contains(dead[0].Attempts[0].Error, "internal") {
+			t.Errorf("Expected a dead delivery refused for its internal address. Got %+v", dead)
+		}
+	})
+	if len(rec.events) != 0 {
+		t.Errorf("Expected no event to reach the receiver. Got %d", len(rec.events))
+	}
+}
+
+// TestWebhookLifecycle reads, lists and deletes a webhook, and verifies that its secret is never shown again
+func TestWebhookLifecycle(t *testing.T) {
+	withWebhooks(func() {
+		hook := subscribe(t, "http://localhost:9/hook", eventTransferExpired, eventCertCreated, eventCertCreated)
+		if len(hook.Events) != 2 {
+			t.Errorf("Expected the events to be deduplicated. Got %v", hook.Events)
+		}
+
+		for _, path := range []string{"/webhooks/" + hook.ID, "/webhooks"} {
+			req, _ := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+			response := executeRequest(req)
+			checkResponseCode(t, http.StatusOK, response.Code)
+			if bytes.Contains(response.Body.Bytes(), []byte(hook.Secret)) || !bytes.Contains(response.Body.Bytes(), []byte(hook.ID)) {
+				t.Errorf("GET %s: expected the webhook without its secret. Got %s", path, response.Body.String())
+			}
+		}
+
+		req, _ := http.NewRequest("DELETE", "http://localhost:8080/webhooks/"+hook.ID, nil)
+		checkResponseCode(t, http.StatusNoContent, executeRequest(req).Code)
+		req, _ = http.NewRequest("GET", "http://localhost:8080/webhooks/"+hook.ID+"/deliveries", nil)
+		checkErrorResponse(t, executeRequest(req), http.StatusNotFound, codeWebhookNotFound, "Webhook ID "+hook.ID+" doesn't exist. Cannot list deliveries.")
+	})
+}
+
+// TestCreateInvalidWebhook verifies that webhooks with a bad URL or unknown events are rejected
+func TestCreateInvalidWebhook(t *testing.T) {
+	tests := []struct {
+		body, field string
+	}{
+		{`{"url":"","events":["certificate.created"]}`, "url"},
+		{`{"url":"ftp://localhost/hook","events":["certificate.created"]}`, "url"},
+		{`{"url":"/hook","events":["certificate.created"]}`, "url"},
+		{`{"url":"http://localhost/hook","events":[]}`, "events"},
+		{`{"url":"http://localhost/hook","events":["certificate.renamed"]}`, "events"},
+	}
+	withWebhooks(func() {
+		for _, test := range tests {
+			req, _ := http.NewRequest("POST", "http://localhost:8080/webhooks", bytes.NewBufferString(test.body))
+			response := executeRequest(req)
+			checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+			var e apiError
+			json.Unmarshal(response.Body.Bytes(), &e)
+			if fields, _ := e.Details["fields"].(map[string]interface{}); fields[test.field] == nil {
+				t.Errorf("%s: expected a problem with %s. Got %s", test.body, test.field, response.Body.String())
+			}
+		}
+	})
+}